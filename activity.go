@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+
+	"maunium.net/go/mautrix/bridge/commands"
+)
+
+// activityTypes are the activity types that can be set with the set-activity command.
+// Streaming needs a Twitch or YouTube URL and custom statuses work differently, so they're not included.
+var activityTypes = map[string]discordgo.ActivityType{
+	"playing":   discordgo.ActivityTypeGame,
+	"listening": discordgo.ActivityTypeListening,
+	"watching":  discordgo.ActivityTypeWatching,
+	"competing": discordgo.ActivityTypeCompeting,
+}
+
+func activityTypeName(activityType discordgo.ActivityType) string {
+	for name, typ := range activityTypes {
+		if typ == activityType {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// applyActivity sends the saved activity of the user over the gateway. Presence updates
+// don't survive reconnects, so this is called every time the connection is ready.
+func (user *User) applyActivity() error {
+	if user.Session == nil {
+		return ErrNotConnected
+	}
+	status := string(discordgo.StatusOnline)
+	if ready := user.Session.State.Ready; ready.Settings != nil && ready.Settings.Status != "" {
+		status = string(ready.Settings.Status)
+	}
+	data := discordgo.UpdateStatusData{Status: status}
+	if user.ActivityName != "" {
+		data.Activities = []*discordgo.Activity{{
+			Name: user.ActivityName,
+			Type: discordgo.ActivityType(user.ActivityType),
+		}}
+	}
+	return user.Session.UpdateStatusComplex(data)
+}
+
+var cmdSetActivity = &commands.FullHandler{
+	Func: wrapCommand(fnSetActivity),
+	Name: "set-activity",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Set the activity shown on your Discord profile, or clear it if no arguments are given",
+		Args:        "[playing/listening/watching/competing <_name_>]",
+	},
+	RequiresLogin: true,
+}
+
+func fnSetActivity(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.User.ActivityType = 0
+		ce.User.ActivityName = ""
+	} else if activityType, ok := activityTypes[strings.ToLower(ce.Args[0])]; !ok || len(ce.Args) < 2 {
+		ce.Reply("**Usage**: `$cmdprefix set-activity [playing/listening/watching/competing <name>]`")
+		return
+	} else {
+		ce.User.ActivityType = int(activityType)
+		ce.User.ActivityName = strings.Join(ce.Args[1:], " ")
+	}
+	ce.User.Update()
+	err := ce.User.applyActivity()
+	if err != nil {
+		ce.Reply("Activity saved, but failed to send it to Discord: %v", err)
+	} else if ce.User.ActivityName == "" {
+		ce.Reply("Activity cleared")
+	} else {
+		ce.Reply("Activity set to %s %s", activityTypeName(discordgo.ActivityType(ce.User.ActivityType)), ce.User.ActivityName)
+	}
+}
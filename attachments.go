@@ -2,11 +2,16 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"image"
 	"io"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"maunium.net/go/mautrix/crypto/attachment"
 
@@ -18,10 +23,96 @@ import (
 	"maunium.net/go/mautrix/id"
 )
 
-func (portal *Portal) downloadDiscordAttachment(url string) ([]byte, error) {
+// attachmentURLRefreshMargin is how close to the expiry of a signed Discord CDN URL
+// the bridge will ask Discord for a freshly signed one before downloading it.
+const attachmentURLRefreshMargin = 5 * time.Minute
+
+// parseAttachmentURLExpiry returns the expiry time encoded in the ex query parameter
+// of signed Discord CDN URLs. The second return value is false for unsigned URLs.
+func parseAttachmentURLExpiry(rawURL string) (time.Time, bool) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return time.Time{}, false
+	}
+	ex := parsed.Query().Get("ex")
+	if ex == "" {
+		return time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(ex, 16, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(unix, 0), true
+}
+
+type reqRefreshAttachmentURLs struct {
+	AttachmentURLs []string `json:"attachment_urls"`
+}
+
+type respRefreshAttachmentURLs struct {
+	RefreshedURLs []struct {
+		Original  string `json:"original"`
+		Refreshed string `json:"refreshed"`
+	} `json:"refreshed_urls"`
+}
+
+var endpointRefreshAttachmentURLs = discordgo.EndpointAPI + "attachments/refresh-urls"
+
+// refreshAttachmentURL asks Discord to re-sign an expired or soon-to-expire CDN URL.
+// It can be used whenever a stored Discord link is about to be handed out again.
+func (user *User) refreshAttachmentURL(rawURL string) (string, error) {
+	if user == nil || user.Session == nil {
+		return "", ErrNotConnected
+	}
+	data, err := user.Session.RequestWithBucketID(http.MethodPost, endpointRefreshAttachmentURLs, &reqRefreshAttachmentURLs{
+		AttachmentURLs: []string{rawURL},
+	}, endpointRefreshAttachmentURLs)
+	if err != nil {
+		return "", err
+	}
+	var resp respRefreshAttachmentURLs
+	err = json.Unmarshal(data, &resp)
+	if err != nil {
+		return "", err
+	}
+	for _, refreshed := range resp.RefreshedURLs {
+		if refreshed.Original == rawURL && refreshed.Refreshed != "" {
+			return refreshed.Refreshed, nil
+		}
+	}
+	return "", fmt.Errorf("discord didn't return a refreshed URL")
+}
+
+func (portal *Portal) downloadDiscordAttachment(source *User, url string) ([]byte, error) {
+	expiry, signed := parseAttachmentURLExpiry(url)
+	refreshed := false
+	if signed && time.Until(expiry) < attachmentURLRefreshMargin {
+		newURL, err := source.refreshAttachmentURL(url)
+		if err != nil {
+			portal.log.Warnfln("Failed to refresh expiring attachment URL: %v", err)
+		} else {
+			url = newURL
+			refreshed = true
+		}
+	}
+
+	data, status, err := portal.downloadDiscordURL(url)
+	if signed && !refreshed && (status == http.StatusForbidden || status == http.StatusNotFound) {
+		// The signature may have expired in between, try once more with a fresh URL
+		newURL, refreshErr := source.refreshAttachmentURL(url)
+		if refreshErr != nil {
+			portal.log.Warnfln("Failed to refresh attachment URL after HTTP %d: %v", status, refreshErr)
+		} else {
+			data, _, err = portal.downloadDiscordURL(newURL)
+		}
+	}
+	return data, err
+}
+
+func (portal *Portal) downloadDiscordURL(url string) ([]byte, int, error) {
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	for key, value := range discordgo.DroidDownloadHeaders {
 		req.Header.Set(key, value)
@@ -29,14 +120,15 @@ func (portal *Portal) downloadDiscordAttachment(url string) ([]byte, error) {
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode > 300 {
 		data, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, data)
+		return nil, resp.StatusCode, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, data)
 	}
-	return io.ReadAll(resp.Body)
+	data, err := io.ReadAll(resp.Body)
+	return data, resp.StatusCode, err
 }
 
 func (portal *Portal) downloadMatrixAttachment(content *event.MessageEventContent) ([]byte, error) {
@@ -87,6 +179,10 @@ func (portal *Portal) uploadMatrixAttachment(intent *appservice.IntentAPI, data
 		ContentBytes: data,
 		ContentType:  uploadMime,
 	}
+	if file == nil {
+		// Lets the homeserver serve the file with the right name when it's downloaded
+		req.FileName = matrixContentFileName(content)
+	}
 	var mxc id.ContentURI
 	if portal.bridge.Config.Homeserver.AsyncMedia {
 		uploaded, err := intent.UnstableUploadAsync(req)
@@ -113,3 +209,99 @@ func (portal *Portal) uploadMatrixAttachment(intent *appservice.IntentAPI, data
 
 	return nil
 }
+
+// discordAttachmentFilename returns the original name of a Discord attachment,
+// falling back to the last path segment of the CDN URL if the name is missing.
+func discordAttachmentFilename(att *discordgo.MessageAttachment) string {
+	if att.Filename != "" {
+		return att.Filename
+	}
+	if parsed, err := url.Parse(att.URL); err == nil {
+		if name := path.Base(parsed.Path); name != "." && name != "/" {
+			return name
+		}
+	}
+	return "file"
+}
+
+// discordAttachmentToMatrixContent converts the metadata of a Discord attachment into Matrix event content.
+// The filename is set explicitly so that clients download the file with its original name.
+func discordAttachmentToMatrixContent(att *discordgo.MessageAttachment) *event.MessageEventContent {
+	filename := discordAttachmentFilename(att)
+	content := &event.MessageEventContent{
+		Body:     filename,
+		FileName: filename,
+		Info: &event.FileInfo{
+			Height:   att.Height,
+			MimeType: att.ContentType,
+			Width:    att.Width,
+
+			// This gets overwritten later after the file is uploaded to the homeserver
+			Size: att.Size,
+		},
+	}
+
+	switch strings.ToLower(strings.Split(att.ContentType, "/")[0]) {
+	case "audio":
+		content.MsgType = event.MsgAudio
+	case "image":
+		content.MsgType = event.MsgImage
+	case "video":
+		content.MsgType = event.MsgVideo
+	default:
+		content.MsgType = event.MsgFile
+	}
+	return content
+}
+
+// Attachment flags that discordgo doesn't know about. Discord is still adding new ones, and unknown flags are ignored.
+const (
+	attachmentFlagClip  = 1 << 0
+	attachmentFlagRemix = 1 << 2
+)
+
+// parseAttachmentFlags extracts the flags of each attachment from a raw message payload, keyed by attachment ID.
+// Attachments are decoded one at a time, so an attachment with unexpected values only loses its own flags.
+func parseAttachmentFlags(data json.RawMessage) map[string]int {
+	var payload struct {
+		Attachments []json.RawMessage `json:"attachments"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil || len(payload.Attachments) == 0 {
+		return nil
+	}
+	flags := make(map[string]int, len(payload.Attachments))
+	for _, raw := range payload.Attachments {
+		var att struct {
+			ID    string `json:"id"`
+			Flags int    `json:"flags"`
+		}
+		if json.Unmarshal(raw, &att) == nil && att.ID != "" && att.Flags != 0 {
+			flags[att.ID] = att.Flags
+		}
+	}
+	return flags
+}
+
+// annotateDiscordAttachment adds a caption to media that Discord marks as a clip or a remix.
+// The filename stays in the filename field, so it isn't lost when the caption is added.
+func annotateDiscordAttachment(content *event.MessageEventContent, flags int) {
+	var markers []string
+	if flags&attachmentFlagClip != 0 {
+		markers = append(markers, "Clip")
+	}
+	if flags&attachmentFlagRemix != 0 {
+		markers = append(markers, "Remix")
+	}
+	if len(markers) > 0 {
+		content.Body = fmt.Sprintf("%s: %s", strings.Join(markers, ", "), content.FileName)
+	}
+}
+
+// matrixContentFileName returns the name a Matrix file should have on Discord. The filename field is
+// preferred, as the body may be a caption when both are present.
+func matrixContentFileName(content *event.MessageEventContent) string {
+	if content.FileName != "" {
+		return content.FileName
+	}
+	return content.Body
+}
@@ -0,0 +1,121 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+)
+
+func TestAttachmentFilenameRoundTrip(t *testing.T) {
+	type filenameTest struct {
+		name     string
+		att      *discordgo.MessageAttachment
+		expected string
+		msgType  event.MessageType
+	}
+
+	tests := []filenameTest{
+		{"Image", &discordgo.MessageAttachment{Filename: "holiday photo.jpg", ContentType: "image/jpeg", URL: "https://cdn.discordapp.com/attachments/1/2/holiday_photo.jpg"}, "holiday photo.jpg", event.MsgImage},
+		{"Document", &discordgo.MessageAttachment{Filename: "report.final.pdf", ContentType: "application/pdf"}, "report.final.pdf", event.MsgFile},
+		{"No content type", &discordgo.MessageAttachment{Filename: "notes.txt"}, "notes.txt", event.MsgFile},
+		{"Missing filename", &discordgo.MessageAttachment{ContentType: "audio/ogg", URL: "https://cdn.discordapp.com/attachments/1/2/voice-message.ogg?ex=65a1b2c3&hm=abc"}, "voice-message.ogg", event.MsgAudio},
+		{"Missing everything", &discordgo.MessageAttachment{}, "file", event.MsgFile},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content := discordAttachmentToMatrixContent(test.att)
+			assert.Equal(t, test.expected, content.Body)
+			assert.Equal(t, test.expected, content.FileName)
+			assert.Equal(t, test.msgType, content.MsgType)
+			// Sending the same content back to Discord must keep the name
+			assert.Equal(t, test.expected, matrixContentFileName(content))
+		})
+	}
+}
+
+func TestMatrixContentFileNamePrefersFilename(t *testing.T) {
+	assert.Equal(t, "image.png", matrixContentFileName(&event.MessageEventContent{Body: "look at this", FileName: "image.png"}))
+	assert.Equal(t, "image.png", matrixContentFileName(&event.MessageEventContent{Body: "image.png"}))
+}
+
+func TestAttachmentUnexpectedFields(t *testing.T) {
+	raw := []byte(`{
+		"id": "1000",
+		"channel_id": "2000",
+		"content": "",
+		"attachments": [
+			{
+				"id": "1",
+				"filename": "highlight.mp4",
+				"content_type": "video/mp4",
+				"size": 1048576,
+				"url": "https://cdn.discordapp.com/attachments/2000/1/highlight.mp4",
+				"width": 1280,
+				"height": 720,
+				"flags": 1,
+				"clip_created_at": "2024-05-01T12:00:00.000000+00:00",
+				"clip_participants": [{"id": "3000", "username": "someone"}],
+				"application": {"id": "4000", "name": "Some Game"},
+				"duration_secs": 29.5
+			},
+			{
+				"id": "2",
+				"filename": "edited.png",
+				"content_type": "image/png",
+				"flags": 4,
+				"placeholder": "3PcNNYSFeXh/d3eld0iHZoZgVwh2"
+			},
+			{
+				"id": "3",
+				"filename": "plain.txt",
+				"flags": "not a number",
+				"title": "plain",
+				"waveform": null
+			}
+		]
+	}`)
+
+	var msg discordgo.Message
+	assert.NoError(t, json.Unmarshal(raw, &msg))
+	assert.Len(t, msg.Attachments, 3)
+
+	flags := parseAttachmentFlags(raw)
+	assert.Equal(t, map[string]int{"1": attachmentFlagClip, "2": attachmentFlagRemix}, flags)
+
+	expected := []struct {
+		body    string
+		msgType event.MessageType
+	}{
+		{"Clip: highlight.mp4", event.MsgVideo},
+		{"Remix: edited.png", event.MsgImage},
+		{"plain.txt", event.MsgFile},
+	}
+	for i, att := range msg.Attachments {
+		content := discordAttachmentToMatrixContent(att)
+		annotateDiscordAttachment(content, flags[att.ID])
+		assert.Equal(t, expected[i].body, content.Body)
+		assert.Equal(t, expected[i].msgType, content.MsgType)
+		assert.Equal(t, att.Filename, matrixContentFileName(content))
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+
+	"maunium.net/go/mautrix/event"
+)
+
+type callVoiceState struct {
+	UserID    string `json:"user_id"`
+	ChannelID string `json:"channel_id"`
+}
+
+// callEvent is the payload of the CALL_CREATE, CALL_UPDATE and CALL_DELETE gateway events, which discordgo doesn't parse.
+type callEvent struct {
+	ChannelID   string           `json:"channel_id"`
+	MessageID   string           `json:"message_id"`
+	Ringing     []string         `json:"ringing"`
+	VoiceStates []callVoiceState `json:"voice_states"`
+	Unavailable bool             `json:"unavailable"`
+}
+
+// dmCall is the state of an ongoing call in a private channel as seen by the logged-in user.
+type dmCall struct {
+	callID   string
+	callerID string
+	ringing  bool
+	rang     bool
+	answered bool
+}
+
+func (ce *callEvent) isRinging(userID string) bool {
+	for _, ringingID := range ce.Ringing {
+		if ringingID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (user *User) callEventHandler(evt *discordgo.Event) {
+	if !user.bridge.Config.Bridge.CallNotices {
+		return
+	}
+	var call callEvent
+	if err := json.Unmarshal(evt.RawData, &call); err != nil {
+		user.log.Warnfln("Failed to parse %s: %v", evt.Type, err)
+		return
+	}
+	portal := user.GetExistingPortalByID(call.ChannelID)
+	if portal == nil || portal.MXID == "" || portal.GuildID != "" {
+		return
+	}
+
+	kind, notice, callID := user.updateCall(evt.Type, &call, portal)
+	if notice != "" {
+		portal.sendCallNotice(callID, kind, notice)
+	}
+}
+
+type callNoticeKind int
+
+const (
+	callNoticeRinging callNoticeKind = iota
+	callNoticeEnded
+)
+
+// updateCall applies a call event to the state of the call and returns the notice that it causes, if any.
+func (user *User) updateCall(evtType string, call *callEvent, portal *Portal) (kind callNoticeKind, notice, callID string) {
+	user.callsLock.Lock()
+	defer user.callsLock.Unlock()
+	state, ok := user.calls[call.ChannelID]
+	switch evtType {
+	case "CALL_CREATE":
+		state = &dmCall{callID: call.MessageID, callerID: portal.OtherUserID}
+		for _, voiceState := range call.VoiceStates {
+			if voiceState.UserID != user.DiscordID {
+				state.callerID = voiceState.UserID
+				break
+			}
+		}
+		user.calls[call.ChannelID] = state
+	case "CALL_UPDATE":
+		if !ok {
+			return
+		}
+	case "CALL_DELETE":
+		if !ok {
+			return
+		}
+		delete(user.calls, call.ChannelID)
+		if state.rang && !state.answered {
+			notice = fmt.Sprintf("Missed call from %s", user.callerName(state))
+		} else if state.rang {
+			notice = "Call ended"
+		}
+		return callNoticeEnded, notice, state.callID
+	}
+	ringing := call.isRinging(user.DiscordID)
+	if ringing && !state.ringing {
+		state.rang = true
+		notice = fmt.Sprintf("Incoming call from %s", user.callerName(state))
+	}
+	state.ringing = ringing
+	return callNoticeRinging, notice, state.callID
+}
+
+// callVoiceStateHandler marks calls as answered when the logged-in user joins them from another client.
+func (user *User) callVoiceStateHandler(evt *discordgo.Event) {
+	var voiceState callVoiceState
+	if err := json.Unmarshal(evt.RawData, &voiceState); err != nil || voiceState.UserID != user.DiscordID {
+		return
+	}
+	user.callsLock.Lock()
+	if state, ok := user.calls[voiceState.ChannelID]; ok {
+		state.answered = true
+	}
+	user.callsLock.Unlock()
+}
+
+func (user *User) callerName(state *dmCall) string {
+	if state.callerID == "" {
+		return "unknown user"
+	}
+	puppet := user.bridge.GetPuppetByID(state.callerID)
+	if puppet == nil || puppet.Name == "" {
+		return state.callerID
+	}
+	return puppet.Name
+}
+
+// sendCallNotice sends a call notice from the message loop. Every logged-in user in a group DM receives the
+// same call events, so only the first notice of each kind is sent for a call.
+func (portal *Portal) sendCallNotice(callID string, kind callNoticeKind, text string) {
+	portal.runInLoop(func() {
+		if portal.callNoticeCallID != callID || portal.callNoticesSent == nil {
+			portal.callNoticeCallID = callID
+			portal.callNoticesSent = make(map[callNoticeKind]struct{})
+		} else if _, sent := portal.callNoticesSent[kind]; sent {
+			return
+		}
+		portal.callNoticesSent[kind] = struct{}{}
+		_, err := portal.sendMatrixMessage(portal.MainIntent(), event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    text,
+		}, nil, 0)
+		if err != nil {
+			portal.log.Warnfln("Failed to send call notice: %v", err)
+		}
+	})
+}
@@ -0,0 +1,44 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCallNoticesAreSentOncePerCall(t *testing.T) {
+	br, events := newTestBridge(t)
+	portal := newTestPortal(br, "channel")
+
+	// Both logged-in users of a group DM receive the same call events
+	portal.sendCallNotice("call1", callNoticeRinging, "Incoming call from Alice")
+	portal.sendCallNotice("call1", callNoticeRinging, "Incoming call from Alice")
+	portal.sendCallNotice("call1", callNoticeEnded, "Missed call from Alice")
+	portal.sendCallNotice("call1", callNoticeEnded, "Call ended")
+	portal.sendCallNotice("call2", callNoticeRinging, "Incoming call from Bob")
+
+	assert.Equal(t, "Incoming call from Alice", nextMatrixEvent(t, events).Content["body"])
+	assert.Equal(t, "Missed call from Alice", nextMatrixEvent(t, events).Content["body"])
+	assert.Equal(t, "Incoming call from Bob", nextMatrixEvent(t, events).Content["body"])
+	select {
+	case evt := <-events:
+		t.Errorf("Unexpected %s event %v", evt.Type, evt.Content)
+	default:
+	}
+}
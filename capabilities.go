@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var gatewayIntentNames = []struct {
+	intent discordgo.Intent
+	name   string
+}{
+	{discordgo.IntentsGuilds, "guilds"},
+	{discordgo.IntentsGuildMembers, "guild members (privileged)"},
+	{discordgo.IntentsGuildBans, "guild bans"},
+	{discordgo.IntentsGuildEmojis, "emojis and stickers"},
+	{discordgo.IntentsGuildIntegrations, "integrations"},
+	{discordgo.IntentsGuildWebhooks, "webhooks"},
+	{discordgo.IntentsGuildInvites, "invites"},
+	{discordgo.IntentsGuildVoiceStates, "voice states"},
+	{discordgo.IntentsGuildPresences, "presences (privileged)"},
+	{discordgo.IntentsGuildMessages, "guild messages"},
+	{discordgo.IntentsGuildMessageReactions, "guild reactions"},
+	{discordgo.IntentsGuildMessageTyping, "guild typing"},
+	{discordgo.IntentsDirectMessages, "direct messages"},
+	{discordgo.IntentsDirectMessageReactions, "direct message reactions"},
+	{discordgo.IntentsDirectMessageTyping, "direct message typing"},
+	{discordgo.IntentsMessageContent, "message content (privileged)"},
+	{discordgo.IntentsGuildScheduledEvents, "scheduled events"},
+}
+
+// Client capability flags that user accounts send when identifying, as used by the official clients.
+var clientCapabilityNames = []string{
+	"lazy user notes",
+	"no affine user IDs",
+	"versioned read states",
+	"versioned user guild settings",
+	"dedupe user objects",
+	"prioritized ready payload",
+	"multiple guild experiment populations",
+	"non-channel read states",
+	"auth token refresh",
+	"user settings proto",
+	"client state v2",
+	"passive guild update",
+}
+
+type capabilityFeature struct {
+	name      string
+	available bool
+	note      string
+}
+
+// describeCapabilities reports which gateway intents or client capabilities a session identifies with,
+// and which bridge features are available as a result.
+func describeCapabilities(session *discordgo.Session, connected bool) string {
+	var output strings.Builder
+	identify := session.Identify
+	status := "disconnected"
+	if connected {
+		status = "connected"
+	}
+	hasIntent := func(intent discordgo.Intent) bool {
+		return session.IsUser || identify.Intents&intent == intent
+	}
+	if session.IsUser {
+		_, _ = fmt.Fprintf(&output, "Logged in with a **user** account (gateway %s).\n\n", status)
+		output.WriteString("User accounts don't use gateway intents: every event the account can see is received.\n\n")
+		_, _ = fmt.Fprintf(&output, "Client capabilities (`%d`):\n\n", identify.Capabilities)
+		for i, name := range clientCapabilityNames {
+			if identify.Capabilities&(1<<i) != 0 {
+				_, _ = fmt.Fprintf(&output, "* %s\n", name)
+			}
+		}
+	} else {
+		_, _ = fmt.Fprintf(&output, "Logged in with a **bot** account (gateway %s).\n\n", status)
+		_, _ = fmt.Fprintf(&output, "Gateway intents (`%d`):\n\n", identify.Intents)
+		for _, item := range gatewayIntentNames {
+			mark := "✗"
+			if identify.Intents&item.intent == item.intent {
+				mark = "✓"
+			}
+			_, _ = fmt.Fprintf(&output, "* %s %s\n", mark, item.name)
+		}
+	}
+
+	memberNote := "full member lists can be requested"
+	if session.IsUser {
+		memberNote = "full member lists require the Manage Roles, Kick Members or Ban Members permission in large guilds"
+	}
+	features := []capabilityFeature{
+		{"Message content", hasIntent(discordgo.IntentsMessageContent), "without it, messages that don't mention the account are empty"},
+		{"Member sync", hasIntent(discordgo.IntentsGuildMembers), memberNote},
+		{"Presence", hasIntent(discordgo.IntentsGuildPresences), "online status of users"},
+		{"Typing notifications", hasIntent(discordgo.IntentsGuildMessageTyping | discordgo.IntentsDirectMessageTyping), ""},
+		{"Reactions", hasIntent(discordgo.IntentsGuildMessageReactions | discordgo.IntentsDirectMessageReactions), ""},
+		{"Custom emojis and stickers", hasIntent(discordgo.IntentsGuildEmojis), "updates to the sticker pack of guild spaces"},
+	}
+	output.WriteString("\nFeatures:\n\n")
+	for _, feature := range features {
+		mark := "✗ unavailable"
+		if feature.available {
+			mark = "✓ available"
+		}
+		if feature.note != "" {
+			_, _ = fmt.Fprintf(&output, "* %s: %s (%s)\n", feature.name, mark, feature.note)
+		} else {
+			_, _ = fmt.Fprintf(&output, "* %s: %s\n", feature.name, mark)
+		}
+	}
+	return output.String()
+}
+
+func (user *User) describeCapabilities() string {
+	return describeCapabilities(user.Session, atomic.LoadInt32(&user.gatewayConnected) == 1)
+}
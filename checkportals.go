@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+)
+
+var (
+	errPortalNotJoined         = errors.New("the portal's Matrix user isn't joined to the room")
+	errPortalBridgeInfoMissing = errors.New("the room is missing bridge info state")
+)
+
+// checkRoom verifies that the Matrix room of the portal still exists and that the portal's main intent is in it.
+// The state is fetched from the homeserver rather than the state store, as the problems this detects are caused
+// by changes made outside the bridge.
+func (portal *Portal) checkRoom() error {
+	intent := portal.MainIntent()
+	var member event.MemberEventContent
+	err := intent.Client.StateEvent(portal.MXID, event.StateMember, intent.UserID.String(), &member)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errPortalNotJoined, err)
+	} else if member.Membership != event.MembershipJoin {
+		return fmt.Errorf("%w: membership is %s", errPortalNotJoined, member.Membership)
+	}
+	stateKey, _ := portal.getBridgeInfo()
+	var bridgeInfo event.BridgeEventContent
+	err = intent.Client.StateEvent(portal.MXID, event.StateBridge, stateKey, &bridgeInfo)
+	if err != nil || bridgeInfo.BridgeBot == "" {
+		return errPortalBridgeInfoMissing
+	}
+	return nil
+}
+
+// isRoomGoneError checks whether an error from joining a room means the room doesn't exist anymore or
+// the bridge isn't allowed in it, as opposed to a temporary problem with the homeserver.
+func isRoomGoneError(err error) bool {
+	return errors.Is(err, mautrix.MForbidden) || errors.Is(err, mautrix.MNotFound)
+}
+
+// repairRoom tries to fix a problem found by checkRoom. If the homeserver says the room can't be rejoined,
+// it's assumed to be gone and the portal is unlinked from it, so that a new room is created for the next message.
+func (portal *Portal) repairRoom(problem error) string {
+	if errors.Is(problem, errPortalNotJoined) {
+		err := portal.MainIntent().EnsureJoined(portal.MXID, appservice.EnsureJoinedParams{IgnoreCache: true})
+		if err != nil && isRoomGoneError(err) {
+			portal.log.Warnfln("Failed to rejoin room during portal check, unlinking it: %v", err)
+			portal.RemoveMXID()
+			return "couldn't rejoin, unlinked the room so a new one will be created"
+		} else if err != nil {
+			portal.log.Warnfln("Failed to rejoin room during portal check: %v", err)
+			return fmt.Sprintf("couldn't rejoin, try again later: %v", err)
+		}
+	}
+	portal.UpdateBridgeInfo()
+	if err := portal.checkRoom(); err != nil {
+		return fmt.Sprintf("repair failed: %v", err)
+	}
+	return "repaired"
+}
+
+var cmdCheckPortals = &commands.FullHandler{
+	Func: wrapCommand(fnCheckPortals),
+	Name: "check-portals",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Check that the Matrix rooms of all portals still exist and the bridge is joined to them",
+		Args:        "[--repair]",
+	},
+	RequiresAdmin: true,
+}
+
+func fnCheckPortals(ce *WrappedCommandEvent) {
+	repair := len(ce.Args) > 0 && ce.Args[0] == "--repair"
+	if len(ce.Args) > 1 || (len(ce.Args) == 1 && !repair) {
+		ce.Reply("**Usage**: `$cmdprefix check-portals [--repair]`")
+		return
+	}
+	var checked int
+	var output strings.Builder
+	for _, portal := range ce.Bridge.GetAllPortals() {
+		if portal.MXID == "" {
+			continue
+		}
+		checked++
+		roomID := portal.MXID
+		err := portal.checkRoom()
+		if err == nil {
+			continue
+		}
+		_, _ = fmt.Fprintf(&output, "* %s (`%s`, `%s`): %v", portal.Name, portal.Key.ChannelID, roomID, err)
+		if repair {
+			_, _ = fmt.Fprintf(&output, " - %s", portal.repairRoom(err))
+		}
+		output.WriteByte('\n')
+	}
+	if output.Len() == 0 {
+		ce.Reply("Checked %d portals, no problems found", checked)
+	} else if repair {
+		ce.Reply("Checked %d portals and tried to repair these:\n\n%s", checked, output.String())
+	} else {
+		ce.Reply("Checked %d portals, these have problems (use `--repair` to try fixing them):\n\n%s", checked, output.String())
+	}
+}
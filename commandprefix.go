@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+const maxCommandPrefixLength = 16
+
+// commandProcessor wraps the mautrix command processor to also accept the personal command prefix of the sender.
+// mautrix only strips the global prefix, so commands with a personal prefix arrive here with the prefix included.
+type commandProcessor struct {
+	*commands.Processor
+}
+
+func (proc *commandProcessor) Handle(roomID id.RoomID, eventID id.EventID, user bridge.User, message string, replyTo id.EventID) {
+	if prefix := user.(*User).CommandPrefix; prefix != "" && strings.HasPrefix(message, prefix) {
+		message = strings.TrimLeft(message[len(prefix):], " ")
+	}
+	proc.Processor.Handle(roomID, eventID, user, message, replyTo)
+}
+
+// validateCommandPrefix checks that a prefix can't be mistaken for a normal message,
+// i.e. it has no whitespace and starts with a symbol rather than a letter or digit.
+func validateCommandPrefix(prefix string) error {
+	if len(prefix) > maxCommandPrefixLength {
+		return fmt.Errorf("the prefix can be at most %d characters long", maxCommandPrefixLength)
+	} else if strings.IndexFunc(prefix, unicode.IsSpace) != -1 {
+		return fmt.Errorf("the prefix can't contain whitespace")
+	} else if first := []rune(prefix)[0]; unicode.IsLetter(first) || unicode.IsDigit(first) {
+		return fmt.Errorf("the prefix must start with a symbol like `!` or `.`")
+	}
+	return nil
+}
+
+// handleCustomPrefixCommand runs commands sent in portal rooms with the personal prefix of the sender,
+// which mautrix would otherwise pass to the portal as a normal message.
+func (br *DiscordBridge) handleCustomPrefixCommand(sender *User, evt *event.Event) bool {
+	if sender.CommandPrefix == "" || evt.Type != event.EventMessage {
+		return false
+	}
+	content := evt.Content.AsMessage()
+	if content.MsgType != event.MsgText || content.RelatesTo.GetReplaceID() != "" || !strings.HasPrefix(content.Body, sender.CommandPrefix) {
+		return false
+	}
+	go br.CommandProcessor.Handle(evt.RoomID, evt.ID, sender, content.Body, content.RelatesTo.GetReplyTo())
+	go br.SendMessageSuccessCheckpoint(evt, status.MsgStepCommand, 0)
+	return true
+}
+
+var cmdHelp = &commands.FullHandler{
+	Func: wrapCommand(fnHelp),
+	Name: "help",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Show this help message.",
+	},
+}
+
+func fnHelp(ce *WrappedCommandEvent) {
+	help := commands.FormatHelp(ce.Event)
+	if ce.User.CommandPrefix != "" {
+		help = fmt.Sprintf("Your personal command prefix is `%s`, which works everywhere `%s` does.\n\n%s",
+			ce.User.CommandPrefix, ce.Bridge.Config.Bridge.CommandPrefix, help)
+	}
+	ce.Reply("%s", help)
+}
+
+var cmdSetPrefix = &commands.FullHandler{
+	Func: wrapCommand(fnSetPrefix),
+	Name: "set-prefix",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionGeneral,
+		Description: "Set a personal command prefix to use in addition to the default one, e.g. if it collides with another bot",
+		Args:        "<_prefix_>/--reset",
+	},
+}
+
+func fnSetPrefix(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		if ce.User.CommandPrefix != "" {
+			ce.Reply("Your personal command prefix is `%s`", ce.User.CommandPrefix)
+		} else {
+			ce.Reply("You don't have a personal command prefix. **Usage**: `$cmdprefix set-prefix <prefix>`")
+		}
+		return
+	} else if ce.Args[0] == "--reset" {
+		ce.User.CommandPrefix = ""
+		ce.User.Update()
+		ce.Reply("Personal command prefix removed, use `%s` for commands", ce.Bridge.Config.Bridge.CommandPrefix)
+		return
+	} else if err := validateCommandPrefix(ce.Args[0]); err != nil {
+		ce.Reply("Invalid prefix: %v", err)
+		return
+	} else if ce.Args[0] == ce.Bridge.Config.Bridge.CommandPrefix {
+		ce.Reply("That's already the default command prefix")
+		return
+	}
+	ce.User.CommandPrefix = ce.Args[0]
+	ce.User.Update()
+	ce.Reply("Personal command prefix set to `%s`. The default prefix `%s` still works too", ce.User.CommandPrefix, ce.Bridge.Config.Bridge.CommandPrefix)
+}
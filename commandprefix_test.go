@@ -0,0 +1,32 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateCommandPrefix(t *testing.T) {
+	assert.NoError(t, validateCommandPrefix("!dc"))
+	assert.NoError(t, validateCommandPrefix(".d"))
+	assert.Error(t, validateCommandPrefix("dc"), "prefixes starting with a letter would match normal messages")
+	assert.Error(t, validateCommandPrefix("1dc"))
+	assert.Error(t, validateCommandPrefix("!d c"))
+	assert.Error(t, validateCommandPrefix("!a-very-long-prefix"))
+}
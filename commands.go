@@ -18,17 +18,25 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/bwmarrin/discordgo"
 	"github.com/skip2/go-qrcode"
 
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
 	"maunium.net/go/mautrix/bridge/commands"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
+	"go.mau.fi/mautrix-discord/database"
 	"go.mau.fi/mautrix-discord/remoteauth"
 )
 
@@ -40,15 +48,51 @@ type WrappedCommandEvent struct {
 }
 
 func (br *DiscordBridge) RegisterCommands() {
-	proc := br.CommandProcessor.(*commands.Processor)
+	proc := br.CommandProcessor.(*commandProcessor)
 	proc.AddHandlers(
+		cmdHelp,
+		cmdSetPrefix,
 		cmdLoginToken,
 		cmdLoginQR,
 		cmdLogout,
+		cmdPing,
 		cmdReconnect,
 		cmdDisconnect,
+		cmdSetProxy,
+		cmdCapabilities,
 		cmdGuilds,
+		cmdRoles,
 		cmdRejoinSpace,
+		cmdSetManagementRoom,
+		cmdSyncStickers,
+		cmdBridgeThread,
+		cmdFormatTest,
+		cmdSetSlowmode,
+		cmdSetNSFW,
+		cmdSuppressEmbeds,
+		cmdSetThreadArchive,
+		cmdSetBotName,
+		cmdReinvite,
+		cmdSetActivity,
+		cmdFetchMembers,
+		cmdTyping,
+		cmdPause,
+		cmdResume,
+		cmdDebugPortal,
+		cmdTestMedia,
+		cmdDumpConfig,
+		cmdFriends,
+		cmdAcceptFriend,
+		cmdIgnoreFriend,
+		cmdExportHistory,
+		cmdSetForumTags,
+		cmdResyncPuppet,
+		cmdCheckPortals,
+		cmdMapUser,
+		cmdUnmapUser,
+		cmdDeadLetters,
+		cmdErrors,
+		cmdRateLimits,
 		cmdDeleteAllPortals,
 	)
 }
@@ -116,17 +160,27 @@ func fnLoginQR(ce *WrappedCommandEvent) {
 
 	qrChan := make(chan string)
 	doneChan := make(chan struct{})
+	qrEventChan := make(chan id.EventID, 1)
 
-	var qrCodeEvent id.EventID
+	timeout := time.Duration(ce.Bridge.Config.Bridge.QRLoginTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 3 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
 	go func() {
-		code := <-qrChan
-		resp := sendQRCode(ce, code)
-		qrCodeEvent = resp
+		var evtID id.EventID
+		select {
+		case code, ok := <-qrChan:
+			if ok && code != "" {
+				evtID = sendQRCode(ce, code)
+			}
+		case <-ctx.Done():
+		}
+		qrEventChan <- evtID
 	}()
 
-	ctx := context.Background()
-
 	if err = client.Dial(ctx, qrChan, doneChan); err != nil {
 		close(qrChan)
 		close(doneChan)
@@ -135,13 +189,17 @@ func fnLoginQR(ce *WrappedCommandEvent) {
 	}
 
 	<-doneChan
+	cancel()
 
-	if qrCodeEvent != "" {
+	if qrCodeEvent := <-qrEventChan; qrCodeEvent != "" {
 		_, _ = ce.MainIntent().RedactEvent(ce.RoomID, qrCodeEvent)
 	}
 
 	user, err := client.Result()
-	if err != nil || len(user.Token) == 0 {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, remoteauth.ErrTimeout) {
+		ce.Reply("Login timed out: the QR code wasn't scanned in time. Run `$cmdprefix login` to get a new one.")
+		return
+	} else if err != nil || len(user.Token) == 0 {
 		ce.Reply("Error logging in: %v", err)
 		return
 	} else if err = ce.User.Login(user.Token); err != nil {
@@ -213,6 +271,31 @@ func fnLogout(ce *WrappedCommandEvent) {
 	}
 }
 
+var cmdPing = &commands.FullHandler{
+	Func: wrapCommand(fnPing),
+	Name: "ping",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "Check your connection to Discord",
+	},
+}
+
+func fnPing(ce *WrappedCommandEvent) {
+	if !ce.User.IsLoggedIn() {
+		ce.Reply("You're not logged in")
+		return
+	}
+	var status string
+	if !ce.User.Connected() {
+		status = "You're logged in as %s (`%s`), but not connected to Discord"
+	} else if atomic.LoadInt32(&ce.User.gatewayConnected) == 0 {
+		status = "You're logged in as %s (`%s`), but the Discord connection is currently down"
+	} else {
+		status = "You're logged in as %s (`%s`) and connected to Discord"
+	}
+	ce.Reply(status+".\n\n%s.", ce.User.GetRemoteName(), ce.User.DiscordID, ce.User.describeSendRateLimit())
+}
+
 var cmdDisconnect = &commands.FullHandler{
 	Func: wrapCommand(fnDisconnect),
 	Name: "disconnect",
@@ -249,11 +332,57 @@ func fnReconnect(ce *WrappedCommandEvent) {
 		ce.Reply("You're already connected")
 	} else if err := ce.User.Connect(); err != nil {
 		ce.Reply("Error while reconnecting: %v", err)
+		if isInvalidTokenError(err) {
+			ce.User.handleInvalidToken(err)
+		}
 	} else {
 		ce.Reply("Successfully reconnected")
 	}
 }
 
+var cmdSetProxy = &commands.FullHandler{
+	Func: wrapCommand(fnSetProxy),
+	Name: "set-proxy",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionAuth,
+		Description: "Route your Discord connection through a HTTP or SOCKS5 proxy",
+		Args:        "<_proxy URL_/none>",
+	},
+}
+
+func fnSetProxy(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix set-proxy <proxy URL/none>`")
+		return
+	}
+	if strings.ToLower(ce.Args[0]) == "none" {
+		ce.User.Proxy = ""
+	} else if _, err := parseProxyURL(ce.Args[0]); err != nil {
+		ce.Reply("Invalid proxy URL: %v", err)
+		return
+	} else {
+		ce.User.Proxy = ce.Args[0]
+	}
+	ce.User.Update()
+	if !ce.User.Connected() {
+		if ce.User.Proxy == "" {
+			ce.Reply("Proxy removed")
+		} else {
+			ce.Reply("Proxy saved, it will be used the next time you connect")
+		}
+		return
+	}
+	if err := ce.User.Disconnect(); err != nil {
+		ce.Reply("Proxy saved, but failed to disconnect to apply it: %v", err)
+	} else if err = ce.User.Connect(); err != nil {
+		ce.Reply("Proxy saved, but reconnecting failed: %v", err)
+	} else if ce.User.Proxy == "" {
+		ce.Reply("Proxy removed and successfully reconnected")
+	} else {
+		ce.Reply("Successfully reconnected through the proxy")
+	}
+}
+
 var cmdRejoinSpace = &commands.FullHandler{
 	Func: wrapCommand(fnRejoinSpace),
 	Name: "rejoin-space",
@@ -285,6 +414,24 @@ func fnRejoinSpace(ce *WrappedCommandEvent) {
 	}
 }
 
+var cmdCapabilities = &commands.FullHandler{
+	Func: wrapCommand(fnCapabilities),
+	Name: "capabilities",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Show which gateway intents your Discord connection has and which features they allow",
+	},
+	RequiresLogin: true,
+}
+
+func fnCapabilities(ce *WrappedCommandEvent) {
+	if ce.User.Session == nil {
+		ce.Reply("You're not connected to Discord")
+		return
+	}
+	ce.Reply("%s", ce.User.describeCapabilities())
+}
+
 var cmdGuilds = &commands.FullHandler{
 	Func:    wrapCommand(fnGuilds),
 	Name:    "guilds",
@@ -292,14 +439,14 @@ var cmdGuilds = &commands.FullHandler{
 	Help: commands.HelpMeta{
 		Section:     commands.HelpSectionUnclassified,
 		Description: "Guild bridging management",
-		Args:        "<status/bridge/unbridge> [_guild ID_] [--entire]",
+		Args:        "<status/bridge/unbridge/direction/puppet-power> [_guild ID_] [--entire]",
 	},
 	RequiresLogin: true,
 }
 
 func fnGuilds(ce *WrappedCommandEvent) {
 	if len(ce.Args) == 0 {
-		ce.Reply("**Usage**: `$cmdprefix guilds <status/bridge/unbridge> [guild ID] [--entire]`")
+		ce.Reply("**Usage**: `$cmdprefix guilds <status/bridge/unbridge/direction/puppet-power> [guild ID] [--entire/--keep-rooms]`")
 		return
 	}
 	subcommand := strings.ToLower(ce.Args[0])
@@ -311,6 +458,10 @@ func fnGuilds(ce *WrappedCommandEvent) {
 		fnBridgeGuild(ce)
 	case "unbridge":
 		fnUnbridgeGuild(ce)
+	case "direction":
+		fnSetGuildDirection(ce)
+	case "puppet-power":
+		fnSetGuildPuppetPower(ce)
 	}
 }
 
@@ -324,8 +475,17 @@ func fnListGuilds(ce *WrappedCommandEvent) {
 		status := "not bridged"
 		if guild.MXID != "" {
 			status = "bridged"
+			if guild.BridgeDirection != database.BridgeDirectionBoth {
+				status += fmt.Sprintf(" (%s only)", guild.BridgeDirection)
+			}
+			if guild.PuppetPowerLevel != 0 {
+				status += fmt.Sprintf(", puppet power level %d", guild.PuppetPowerLevel)
+			}
 		}
 		_, _ = fmt.Fprintf(&output, "* %s (`%s`) - %s\n", guild.Name, guild.ID, status)
+		for _, archived := range ce.Bridge.DB.ArchivedRoom.GetAllByGuildID(guild.ID) {
+			_, _ = fmt.Fprintf(&output, "  * Archived [%s](%s) on %s\n", archived.Name, archived.MXID.URI(ce.Bridge.AS.HomeserverDomain).MatrixToURL(), archived.ArchivedAt.Format("2006-01-02"))
+		}
 	}
 	if output.Len() == 0 {
 		ce.Reply("No guilds found")
@@ -337,21 +497,889 @@ func fnListGuilds(ce *WrappedCommandEvent) {
 func fnBridgeGuild(ce *WrappedCommandEvent) {
 	if len(ce.Args) == 0 || len(ce.Args) > 2 {
 		ce.Reply("**Usage**: `$cmdprefix guilds bridge <guild ID> [--entire]")
-	} else if err := ce.User.bridgeGuild(ce.Args[0], len(ce.Args) == 2 && strings.ToLower(ce.Args[1]) == "--entire"); err != nil {
+		return
+	}
+	skipped, err := ce.User.bridgeGuild(ce.Args[0], len(ce.Args) == 2 && strings.ToLower(ce.Args[1]) == "--entire")
+	if err != nil {
 		ce.Reply("Error bridging guild: %v", err)
+	} else if len(skipped) > 0 {
+		names := make([]string, len(skipped))
+		for i, ch := range skipped {
+			names[i] = "#" + ch.Name
+		}
+		ce.Reply("Successfully bridged guild. Skipped %d channels of types that aren't enabled in the bridge config: %s", len(skipped), strings.Join(names, ", "))
 	} else {
 		ce.Reply("Successfully bridged guild")
 	}
 }
 
 func fnUnbridgeGuild(ce *WrappedCommandEvent) {
-	if len(ce.Args) != 1 {
-		ce.Reply("**Usage**: `$cmdprefix guilds unbridge <guild ID>")
-	} else if err := ce.User.unbridgeGuild(ce.Args[0]); err != nil {
+	if len(ce.Args) == 0 || len(ce.Args) > 2 || (len(ce.Args) == 2 && strings.ToLower(ce.Args[1]) != "--keep-rooms") {
+		ce.Reply("**Usage**: `$cmdprefix guilds unbridge <guild ID> [--keep-rooms]`")
+		return
+	}
+	if ce.User.GetPermissionLevel() < bridgeconfig.PermissionLevelAdmin {
+		allowed, err := ce.User.hasGuildPermission(ce.Args[0], discordgo.PermissionManageChannels)
+		if err != nil {
+			ce.Reply("Failed to check your permissions: %v", err)
+			return
+		} else if !allowed {
+			ce.Reply("Only bridge admins and users with the Manage Channels permission can unbridge guilds")
+			return
+		}
+	}
+	keepRooms := len(ce.Args) == 2
+	count, err := ce.User.unbridgeGuild(ce.Args[0], keepRooms)
+	if err != nil {
 		ce.Reply("Error unbridging guild: %v", err)
+	} else if keepRooms {
+		ce.Reply("Successfully unbridged guild. Disconnected the space and %d channel rooms, they were kept with their history.", count)
+	} else {
+		ce.Reply("Successfully unbridged guild. Deleted the space and %d channel rooms, cleaning them up in the background.", count)
+	}
+}
+
+func fnSetGuildDirection(ce *WrappedCommandEvent) {
+	if ce.User.GetPermissionLevel() < bridgeconfig.PermissionLevelAdmin {
+		ce.Reply("Only bridge admins can change the bridge direction of guilds")
+		return
+	} else if len(ce.Args) != 2 || !database.BridgeDirection(strings.ToLower(ce.Args[1])).IsValid() {
+		ce.Reply("**Usage**: `$cmdprefix guilds direction <guild ID> <both/discord-to-matrix/matrix-to-discord>`")
+		return
+	}
+	guild := ce.Bridge.GetGuildByID(ce.Args[0], false)
+	if guild == nil || guild.MXID == "" {
+		ce.Reply("That guild is not bridged")
+		return
+	}
+	guild.BridgeDirection = database.BridgeDirection(strings.ToLower(ce.Args[1]))
+	guild.Update()
+	switch guild.BridgeDirection {
+	case database.BridgeDirectionDiscordToMatrix:
+		ce.Reply("Messages in %s will only be bridged from Discord to Matrix", guild.Name)
+	case database.BridgeDirectionMatrixToDiscord:
+		ce.Reply("Messages in %s will only be bridged from Matrix to Discord", guild.Name)
+	default:
+		ce.Reply("Messages in %s will be bridged in both directions", guild.Name)
+	}
+}
+
+func fnSetGuildPuppetPower(ce *WrappedCommandEvent) {
+	if ce.User.GetPermissionLevel() < bridgeconfig.PermissionLevelAdmin {
+		ce.Reply("Only bridge admins can change the power level of puppets")
+		return
+	} else if len(ce.Args) != 2 {
+		ce.Reply("**Usage**: `$cmdprefix guilds puppet-power <guild ID> <level>`")
+		return
+	}
+	level, err := strconv.Atoi(ce.Args[1])
+	if err != nil {
+		ce.Reply("**Usage**: `$cmdprefix guilds puppet-power <guild ID> <level>`")
+		return
+	}
+	guild := ce.Bridge.GetGuildByID(ce.Args[0], false)
+	if guild == nil || guild.MXID == "" {
+		ce.Reply("That guild is not bridged")
+		return
+	}
+	previous := guild.PuppetPowerLevel
+	guild.PuppetPowerLevel = level
+	guild.Update()
+	if level != previous {
+		go guild.updatePuppetPowerLevels(previous)
+	}
+	ce.Reply("Puppets in %s will get power level %d, unless their power level was changed on Matrix", guild.Name, level)
+}
+
+var cmdRoles = &commands.FullHandler{
+	Func: wrapCommand(fnRoles),
+	Name: "roles",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "List the roles of a guild along with the Matrix power level they map to",
+		Args:        "<_guild ID_>",
+	},
+	RequiresLogin: true,
+}
+
+func fnRoles(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix roles <guild ID>`")
+		return
+	}
+	guild := ce.Bridge.GetGuildByID(ce.Args[0], false)
+	if guild == nil {
+		ce.Reply("Guild not found")
+		return
+	} else if ce.User.GetPermissionLevel() < bridgeconfig.PermissionLevelAdmin {
+		if ce.User.Session == nil {
+			ce.Reply("You're not connected to Discord")
+			return
+		} else if _, err := ce.User.Session.State.Guild(guild.ID); err != nil {
+			ce.Reply("You're not in that guild")
+			return
+		}
+	}
+	roles := ce.Bridge.DB.Role.GetAll(guild.ID)
+	if len(roles) == 0 {
+		ce.Reply("No roles of %s are cached", guild.Name)
+		return
+	}
+	// Discord lists the highest role first
+	sort.Slice(roles, func(i, j int) bool {
+		return roles[i].Position > roles[j].Position
+	})
+	var output strings.Builder
+	for _, role := range roles {
+		_, _ = fmt.Fprintf(&output, "* %s (`%s`) - ", role.Name, role.ID)
+		if role.Color == 0 {
+			output.WriteString("no color")
+		} else {
+			_, _ = fmt.Fprintf(&output, "color #%06x", role.Color)
+		}
+		if role.Mentionable {
+			output.WriteString(", mentionable")
+		}
+		if role.Managed {
+			output.WriteString(", managed by an integration")
+		}
+		output.WriteByte('\n')
+	}
+	mapping := "Roles aren't mapped to Matrix power levels, puppets get the default power level"
+	if guild.PuppetPowerLevel != 0 {
+		mapping = fmt.Sprintf("Roles aren't mapped to Matrix power levels individually, all puppets get power level %d", guild.PuppetPowerLevel)
+	}
+	ce.Reply("Roles of %s:\n\n%s\n%s (see `$cmdprefix guilds puppet-power`)", guild.Name, output.String(), mapping)
+}
+
+var cmdSyncStickers = &commands.FullHandler{
+	Func: wrapCommand(fnSyncStickers),
+	Name: "sync-stickers",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Resync the custom stickers of a bridged guild into the sticker pack of the guild space",
+		Args:        "<_guild ID_>",
+	},
+	RequiresLogin: true,
+}
+
+func fnSyncStickers(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix sync-stickers <guild ID>`")
+		return
+	}
+	guild := ce.Bridge.GetGuildByID(ce.Args[0], false)
+	if guild == nil || guild.MXID == "" {
+		ce.Reply("That guild is not bridged")
+		return
+	}
+	count, err := ce.User.syncGuildStickers(guild)
+	if err != nil {
+		ce.Reply("Failed to sync stickers: %v", err)
+	} else {
+		ce.Reply("Synced %d stickers to the guild space", count)
+	}
+}
+
+var cmdSetManagementRoom = &commands.FullHandler{
+	Func: wrapCommand(fnSetManagementRoom),
+	Name: "set-management-room",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Make the current room your management room, where bridge notices and command replies are sent",
+	},
+}
+
+func fnSetManagementRoom(ce *WrappedCommandEvent) {
+	if ce.User.ManagementRoom == ce.RoomID {
+		ce.Reply("This room is already your management room")
+		return
+	} else if ce.Portal != nil || ce.Bridge.GetGuildByMXID(ce.RoomID) != nil {
+		ce.Reply("Portal rooms and guild spaces can't be used as the management room")
+		return
+	}
+	ce.Bridge.managementRoomsLock.Lock()
+	owner := ce.Bridge.managementRooms[ce.RoomID]
+	ce.Bridge.managementRoomsLock.Unlock()
+	if owner != nil && owner != ce.User {
+		ce.Reply("This room is already the management room of another user")
+		return
+	}
+	members, err := ce.Bot.JoinedMembers(ce.RoomID)
+	if err != nil {
+		ce.Reply("Failed to check the members of this room: %v", err)
+		return
+	}
+	_, userJoined := members.Joined[ce.User.MXID]
+	_, botJoined := members.Joined[ce.Bot.UserID]
+	if !userJoined || !botJoined || len(members.Joined) != 2 {
+		ce.Reply("The management room must only contain you and the bridge bot")
+		return
+	}
+	ce.User.SetManagementRoom(ce.RoomID)
+	ce.Reply("This room is now your management room")
+}
+
+var cmdBridgeThread = &commands.FullHandler{
+	Func: wrapCommand(fnBridgeThread),
+	Name: "bridge-thread",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Bridge a single Discord thread into its own Matrix room",
+		Args:        "<_thread ID_>",
+	},
+	RequiresLogin: true,
+}
+
+// threadBackfillLimit is the number of recent messages fetched when bridging a thread as its own room.
+const threadBackfillLimit = 50
+
+func fnBridgeThread(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix bridge-thread <thread ID>`")
+		return
+	}
+	channel, err := ce.User.Session.Channel(ce.Args[0])
+	if err != nil {
+		ce.Reply("Failed to fetch thread info: %v", err)
+		return
+	} else if !channel.IsThread() {
+		ce.Reply("That channel is not a thread")
+		return
+	}
+	portal := ce.User.GetPortalByMeta(channel)
+	if portal.MXID != "" {
+		portal.ensureUserInvited(ce.User)
+		ce.Reply("That thread is already bridged: [%s](%s)", portal.Name, portal.MXID.URI(ce.Bridge.AS.HomeserverDomain).MatrixToURL())
+		return
+	}
+	err = portal.CreateMatrixRoom(ce.User, channel)
+	if err != nil {
+		ce.Reply("Failed to create room for thread: %v", err)
+		return
+	}
+	ce.User.joinThreadPortal(channel.ID, channel.ParentID)
+
+	messages, err := ce.User.Session.ChannelMessages(channel.ID, threadBackfillLimit, "", "", "")
+	if err != nil {
+		ce.Reply("Created [%s](%s), but failed to fetch recent messages: %v", portal.Name, portal.MXID.URI(ce.Bridge.AS.HomeserverDomain).MatrixToURL(), err)
+		return
+	}
+	// Discord returns the newest messages first
+	for i := len(messages) - 1; i >= 0; i-- {
+		portal.discordMessages <- portalDiscordMessage{
+			msg:  &discordgo.MessageCreate{Message: messages[i]},
+			user: ce.User,
+		}
+	}
+	if post, err := ce.User.getForumPost(channel.ID); err != nil {
+		portal.log.Warnfln("Failed to fetch forum tags of %s: %v", channel.ID, err)
+	} else if err = portal.syncForumTags(ce.User, post.ParentID, post.AppliedTags); err != nil {
+		portal.log.Warnfln("Failed to sync forum tags of %s: %v", channel.ID, err)
+	}
+	ce.Reply("Created [%s](%s) and queued %d recent messages for backfill", portal.Name, portal.MXID.URI(ce.Bridge.AS.HomeserverDomain).MatrixToURL(), len(messages))
+}
+
+var cmdFormatTest = &commands.FullHandler{
+	Func: wrapCommand(fnFormatTest),
+	Name: "format-test",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Preview how the bridge converts formatting between Discord and Matrix without sending anything",
+		Args:        "[--matrix] <_text_>",
+	},
+}
+
+func fnFormatTest(ce *WrappedCommandEvent) {
+	toDiscord := len(ce.Args) > 0 && ce.Args[0] == "--matrix"
+	if toDiscord {
+		ce.Args = ce.Args[1:]
+	}
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage**: `$cmdprefix format-test [--matrix] <text>`")
+		return
+	}
+	text := strings.Join(ce.Args, " ")
+	portal := ce.Portal
+	if portal == nil {
+		// Formatting outside portals can't resolve channel-specific things like roles, but everything else works
+		portal = &Portal{Portal: ce.Bridge.DB.Portal.New(), bridge: ce.Bridge, log: ce.Bridge.Log.Sub("FormatTest")}
+	}
+	if toDiscord {
+		output := portal.parseMatrixHTML(ce.User, &event.MessageEventContent{
+			Body:          text,
+			Format:        event.FormatHTML,
+			FormattedBody: text,
+		})
+		ce.Reply("Discord markdown:\n\n```\n%s\n```", output)
+	} else {
+		content := portal.renderDiscordMarkdown(text)
+		ce.Reply("Matrix HTML:\n\n```html\n%s\n```\n\nPlaintext body:\n\n```\n%s\n```", content.FormattedBody, content.Body)
+	}
+}
+
+var cmdSetSlowmode = &commands.FullHandler{
+	Func:    wrapCommand(fnSetSlowmode),
+	Name:    "set-slowmode",
+	Aliases: []string{"slowmode"},
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Set the slow mode interval of the current Discord channel",
+		Args:        "<_seconds_>",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+// maxSlowmodeSeconds is the maximum rate_limit_per_user Discord allows (6 hours).
+const maxSlowmodeSeconds = 21600
+
+func fnSetSlowmode(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix set-slowmode <seconds>`")
+		return
+	}
+	seconds, err := strconv.Atoi(ce.Args[0])
+	if err != nil || seconds < 0 || seconds > maxSlowmodeSeconds {
+		ce.Reply("Slow mode must be a number of seconds between 0 and %d", maxSlowmodeSeconds)
+		return
+	} else if ce.Portal.GuildID == "" {
+		ce.Reply("Slow mode can only be set in guild channels")
+		return
+	}
+	allowed, err := ce.Portal.userHasPermission(ce.User, discordgo.PermissionManageChannels)
+	if err != nil {
+		ce.Reply("Failed to check your permissions: %v", err)
+		return
+	} else if !allowed {
+		ce.Reply("You need the Manage Channels permission to change slow mode")
+		return
+	}
+	_, err = ce.Portal.editDiscordChannel(ce.User, map[string]interface{}{
+		"rate_limit_per_user": seconds,
+	})
+	if err != nil {
+		ce.Reply("Failed to set slow mode: %v", err)
+	} else if seconds == 0 {
+		ce.Reply("Disabled slow mode")
+	} else {
+		ce.Reply("Set slow mode to %d seconds", seconds)
+	}
+}
+
+var cmdSetNSFW = &commands.FullHandler{
+	Func: wrapCommand(fnSetNSFW),
+	Name: "set-nsfw",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Mark the current Discord channel as age-restricted (NSFW) or not",
+		Args:        "<on/off>",
+	},
+	RequiresLogin:  true,
+	RequiresPortal: true,
+}
+
+// nsfwChannelTypes are the channel types that can be marked as NSFW. Threads follow their parent channel.
+var nsfwChannelTypes = map[discordgo.ChannelType]struct{}{
+	discordgo.ChannelTypeGuildText:       {},
+	discordgo.ChannelTypeGuildVoice:      {},
+	discordgo.ChannelTypeGuildNews:       {},
+	discordgo.ChannelTypeGuildStageVoice: {},
+	ChannelTypeGuildForum:                {},
+}
+
+func fnSetNSFW(ce *WrappedCommandEvent) {
+	var nsfw bool
+	switch strings.ToLower(strings.Join(ce.Args, " ")) {
+	case "on", "true":
+		nsfw = true
+	case "off", "false":
+		nsfw = false
+	default:
+		ce.Reply("**Usage**: `$cmdprefix set-nsfw <on/off>`")
+		return
+	}
+	if _, ok := nsfwChannelTypes[ce.Portal.Type]; !ok || ce.Portal.GuildID == "" {
+		ce.Reply("This type of channel can't be marked as NSFW")
+		return
+	}
+	allowed, err := ce.Portal.userHasPermission(ce.User, discordgo.PermissionManageChannels)
+	if err != nil {
+		ce.Reply("Failed to check your permissions: %v", err)
+		return
+	} else if !allowed {
+		ce.Reply("You need the Manage Channels permission to change the NSFW flag")
+		return
+	}
+	channel, err := ce.Portal.editDiscordChannel(ce.User, map[string]interface{}{
+		"nsfw": nsfw,
+	})
+	if err != nil {
+		ce.Reply("Failed to change the NSFW flag: %v", err)
+	} else if channel.NSFW {
+		ce.Reply("Marked the channel as NSFW")
+	} else {
+		ce.Reply("The channel is no longer marked as NSFW")
+	}
+}
+
+var cmdSuppressEmbeds = &commands.FullHandler{
+	Func: wrapCommand(fnSuppressEmbeds),
+	Name: "suppress-embeds",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Remove the link previews from one of your messages on Discord. Reply to the message with this command",
+		Args:        "[off]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnSuppressEmbeds(ce *WrappedCommandEvent) {
+	suppress := true
+	if len(ce.Args) > 1 || (len(ce.Args) == 1 && ce.Args[0] != "off") || ce.ReplyTo == "" {
+		ce.Reply("**Usage**: reply to your message with `$cmdprefix suppress-embeds [off]`")
+		return
+	} else if len(ce.Args) == 1 {
+		suppress = false
+	}
+	msg := ce.Bridge.DB.Message.GetByMXID(ce.Portal.Key, ce.ReplyTo)
+	if msg == nil {
+		ce.Reply("That message isn't bridged to Discord")
+		return
+	} else if msg.SenderID != ce.User.DiscordID {
+		ce.Reply("You can only remove the link previews of your own messages")
+		return
+	}
+	session := ce.User.Session
+	if session == nil {
+		ce.Reply("You're not connected to Discord")
+		return
+	}
+	channelID := msg.DiscordProtoChannelID()
+	discordMsg, err := session.ChannelMessage(channelID, msg.DiscordID)
+	if err != nil {
+		ce.Reply("Failed to fetch the message from Discord: %v", err)
+		return
+	}
+	flags := discordMsg.Flags &^ discordgo.MessageFlagsSuppressEmbeds
+	if suppress {
+		flags |= discordgo.MessageFlagsSuppressEmbeds
+	}
+	endpoint := discordgo.EndpointChannelMessage(channelID, msg.DiscordID)
+	_, err = session.RequestWithBucketID(http.MethodPatch, endpoint, map[string]interface{}{"flags": flags}, discordgo.EndpointChannelMessage(channelID, ""))
+	if err != nil {
+		ce.Reply("Failed to update the message: %v", err)
+	} else if suppress {
+		ce.Reply("Removed the link previews from the message")
+	} else {
+		ce.Reply("Restored the link previews of the message")
+	}
+}
+
+var cmdSetThreadArchive = &commands.FullHandler{
+	Func: wrapCommand(fnSetThreadArchive),
+	Name: "set-thread-archive",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Set the auto-archive duration of Discord threads started from Matrix in this room",
+		Args:        "<60/1440/4320/10080/default>",
+	},
+	RequiresPortal: true,
+}
+
+var validThreadArchiveDurations = []int{60, 1440, 4320, 10080}
+
+// canManagePortal checks that the user is a bridge admin or has the given Discord permission in the
+// portal's channel. Private channels can also be managed by the user they belong to. If the user
+// isn't allowed, the reason is sent as a reply.
+func canManagePortal(ce *WrappedCommandEvent, permission int64, permissionName string) bool {
+	if ce.User.GetPermissionLevel() >= bridgeconfig.PermissionLevelAdmin {
+		return true
+	} else if ce.Portal.GuildID == "" && ce.User.DiscordID != "" && ce.Portal.Key.Receiver == ce.User.DiscordID {
+		return true
+	} else if ce.User.Session == nil || ce.Portal.GuildID == "" {
+		ce.Reply("Only bridge admins and users with the %s permission can do that", permissionName)
+		return false
+	}
+	allowed, err := ce.Portal.userHasPermission(ce.User, permission)
+	if err != nil {
+		ce.Reply("Failed to check your permissions: %v", err)
+		return false
+	} else if !allowed {
+		ce.Reply("You need the %s permission to do that", permissionName)
+		return false
+	}
+	return true
+}
+
+func fnSetThreadArchive(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix set-thread-archive <60/1440/4320/10080/default>`")
+		return
+	} else if !canManagePortal(ce, discordgo.PermissionManageThreads, "Manage Threads") {
+		return
+	}
+	if strings.ToLower(ce.Args[0]) == "default" {
+		ce.Portal.ThreadArchiveDuration = 0
+		ce.Portal.Update()
+		ce.Reply("New threads will use the channel's default auto-archive duration")
+		return
+	}
+	minutes, err := strconv.Atoi(ce.Args[0])
+	valid := false
+	for _, duration := range validThreadArchiveDurations {
+		valid = valid || duration == minutes
+	}
+	if err != nil || !valid {
+		ce.Reply("The auto-archive duration must be 60, 1440, 4320 or 10080 minutes")
+		return
+	}
+	ce.Portal.ThreadArchiveDuration = minutes
+	ce.Portal.Update()
+	ce.Reply("New threads will be archived after %d minutes of inactivity", minutes)
+}
+
+var cmdTyping = &commands.FullHandler{
+	Func: wrapCommand(fnTyping),
+	Name: "typing",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "View or change whether typing notifications are bridged in this room",
+		Args:        "[on/off/default]",
+	},
+	RequiresPortal: true,
+}
+
+func fnTyping(ce *WrappedCommandEvent) {
+	if len(ce.Args) > 1 {
+		ce.Reply("**Usage**: `$cmdprefix typing [on/off/default]`")
+		return
+	} else if len(ce.Args) == 1 {
+		if !canManagePortal(ce, discordgo.PermissionManageChannels, "Manage Channels") {
+			return
+		}
+		switch strings.ToLower(ce.Args[0]) {
+		case "on":
+			enabled := true
+			ce.Portal.TypingNotifications = &enabled
+		case "off":
+			enabled := false
+			ce.Portal.TypingNotifications = &enabled
+		case "default":
+			ce.Portal.TypingNotifications = nil
+		default:
+			ce.Reply("**Usage**: `$cmdprefix typing [on/off/default]`")
+			return
+		}
+		ce.Portal.Update()
+	}
+	state := "disabled"
+	if ce.Portal.typingNotificationsEnabled() {
+		state = "enabled"
+	}
+	if ce.Portal.TypingNotifications == nil {
+		ce.Reply("Typing notifications are %s in this room (bridge default)", state)
 	} else {
-		ce.Reply("Successfully unbridged guild")
+		ce.Reply("Typing notifications are %s in this room", state)
+	}
+}
+
+var cmdPause = &commands.FullHandler{
+	Func: wrapCommand(fnPause),
+	Name: "pause",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Temporarily stop bridging messages in this room in both directions",
+	},
+	RequiresPortal: true,
+	RequiresAdmin:  true,
+}
+
+func fnPause(ce *WrappedCommandEvent) {
+	if ce.Portal.Paused {
+		ce.Reply("Bridging is already paused in this room")
+		return
+	}
+	ce.Portal.Paused = true
+	ce.Portal.Update()
+	ce.Reply("Bridging is now paused in this room. Messages sent on either side will be dropped until `$cmdprefix resume` is used.")
+}
+
+var cmdResume = &commands.FullHandler{
+	Func: wrapCommand(fnResume),
+	Name: "resume",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Resume bridging messages in this room after it was paused",
+	},
+	RequiresPortal: true,
+	RequiresAdmin:  true,
+}
+
+func fnResume(ce *WrappedCommandEvent) {
+	if !ce.Portal.Paused {
+		ce.Reply("Bridging isn't paused in this room")
+		return
+	}
+	ce.Portal.Paused = false
+	ce.Portal.Update()
+	ce.Reply("Bridging resumed. Messages sent while it was paused were not bridged.")
+}
+
+var cmdDebugPortal = &commands.FullHandler{
+	Func: wrapCommand(fnDebugPortal),
+	Name: "debug-portal",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Show the internal state of the portal in this room",
+	},
+	RequiresPortal: true,
+	RequiresAdmin:  true,
+}
+
+func fnDebugPortal(ce *WrappedCommandEvent) {
+	portal := ce.Portal
+	var output strings.Builder
+	_, _ = fmt.Fprintf(&output, "* Key: `%s`\n", portal.Key)
+	_, _ = fmt.Fprintf(&output, "* Room: `%s`\n", portal.MXID)
+	_, _ = fmt.Fprintf(&output, "* Name: %s\n", portal.Name)
+	_, _ = fmt.Fprintf(&output, "* Channel type: %d\n", portal.Type)
+	if portal.GuildID != "" {
+		_, _ = fmt.Fprintf(&output, "* Guild: `%s`\n", portal.GuildID)
+	}
+	if portal.ParentID != "" {
+		_, _ = fmt.Fprintf(&output, "* Parent: `%s`\n", portal.ParentID)
+	}
+	if portal.OtherUserID != "" {
+		_, _ = fmt.Fprintf(&output, "* Other user: `%s`\n", portal.OtherUserID)
+	}
+	_, _ = fmt.Fprintf(&output, "* Bridge direction: %s\n", portal.bridgeDirection())
+	_, _ = fmt.Fprintf(&output, "* Paused: %t\n", portal.Paused)
+	_, _ = fmt.Fprintf(&output, "* Typing notifications: %t\n", portal.typingNotificationsEnabled())
+	_, _ = fmt.Fprintf(&output, "* Encrypted: %t\n", portal.Encrypted)
+	if portal.InSpace != "" {
+		_, _ = fmt.Fprintf(&output, "* In space: `%s`\n", portal.InSpace)
+	}
+	ce.Reply("%s", output.String())
+}
+
+var cmdDumpConfig = &commands.FullHandler{
+	Func: wrapCommand(fnDumpConfig),
+	Name: "dump-config",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Show the bridge config currently in effect in your management room, with secrets redacted",
+	},
+	RequiresAdmin: true,
+}
+
+func fnDumpConfig(ce *WrappedCommandEvent) {
+	// Even redacted, the config shouldn't be shown to everyone in a shared room
+	if ce.RoomID != ce.User.ManagementRoom {
+		ce.Reply("The config can only be shown in your management room")
+		return
+	}
+	dump, err := ce.Bridge.Config.RedactedYAML()
+	if err != nil {
+		ce.Reply("Failed to serialize config: %v", err)
+		return
+	}
+	ce.Reply("```yaml\n%s```", dump)
+}
+
+var cmdSetBotName = &commands.FullHandler{
+	Func: wrapCommand(fnSetBotName),
+	Name: "set-bot-name",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Set the display name of the bridge bot in this room",
+		Args:        "<_name_/default>",
+	},
+	RequiresPortal: true,
+	RequiresAdmin:  true,
+}
+
+func fnSetBotName(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage**: `$cmdprefix set-bot-name <name/default>`")
+		return
+	}
+	name := strings.TrimSpace(strings.Join(ce.Args, " "))
+	if strings.ToLower(name) == "default" {
+		name = ""
+	}
+	prevName := ce.Portal.BotDisplayname
+	ce.Portal.BotDisplayname = name
+	err := ce.Portal.updateBotDisplayname()
+	if err != nil {
+		ce.Portal.BotDisplayname = prevName
+		ce.Reply("Failed to update bot display name: %v", err)
+		return
+	}
+	ce.Portal.Update()
+	if name == "" {
+		ce.Reply("The bridge bot will use its default display name in this room")
+	} else {
+		ce.Reply("The bridge bot will be called %s in this room", name)
+	}
+}
+
+var cmdResyncPuppet = &commands.FullHandler{
+	Func: wrapCommand(fnResyncPuppet),
+	Name: "resync-puppet",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Force a refresh of the Matrix display name and avatar of a Discord user",
+		Args:        "<_Discord user ID_>",
+	},
+	RequiresAdmin: true,
+	RequiresLogin: true,
+}
+
+func fnResyncPuppet(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix resync-puppet <Discord user ID>`")
+		return
+	}
+	puppet := ce.Bridge.GetPuppetByID(ce.Args[0])
+	if puppet == nil {
+		ce.Reply("Invalid Discord user ID")
+		return
+	}
+	oldName, oldAvatar := puppet.Name, puppet.AvatarURL
+	err := puppet.ForceResync(ce.User)
+	if err != nil {
+		ce.Reply("Failed to resync %s: %v", puppet.ID, err)
+		return
+	}
+	formatAvatar := func(mxc id.ContentURI) string {
+		if mxc.IsEmpty() {
+			return "none"
+		}
+		return mxc.String()
+	}
+	ce.Reply("Resynced [%s](%s):\n\n"+
+		"* Display name: %s → %s\n"+
+		"* Avatar: %s → %s",
+		puppet.ID, puppet.MXID.URI().MatrixToURL(),
+		oldName, puppet.Name,
+		formatAvatar(oldAvatar), formatAvatar(puppet.AvatarURL))
+}
+
+var cmdMapUser = &commands.FullHandler{
+	Func: wrapCommand(fnMapUser),
+	Name: "map-user",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Send messages from a Discord user through their real Matrix account instead of a puppet",
+		Args:        "<_Discord user ID_> <_Matrix user ID_>",
+	},
+	RequiresAdmin: true,
+}
+
+func fnMapUser(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 2 {
+		ce.Reply("**Usage**: `$cmdprefix map-user <Discord user ID> <Matrix user ID>`")
+		return
+	}
+	if _, err := strconv.ParseUint(ce.Args[0], 10, 64); err != nil {
+		ce.Reply("%q is not a valid Discord user ID", ce.Args[0])
+		return
+	}
+	mxid := id.UserID(ce.Args[1])
+	if _, _, err := mxid.Parse(); err != nil {
+		ce.Reply("%q is not a valid Matrix user ID", ce.Args[1])
+		return
+	} else if ce.Bridge.IsGhost(mxid) || mxid == ce.Bridge.Bot.UserID {
+		ce.Reply("Can't map Discord users to bridge users")
+		return
+	} else if !ce.Bridge.Config.CanAutoDoublePuppet(mxid) {
+		ce.Reply("No login shared secret is configured for the homeserver of %s, so the bridge can't send messages as them", mxid)
+		return
+	}
+	puppet := ce.Bridge.GetPuppetByID(ce.Args[0])
+	if existing := ce.Bridge.GetPuppetByCustomMXID(mxid); existing != nil && existing != puppet {
+		ce.Reply("%s is already mapped to Discord user %s", mxid, existing.ID)
+		return
+	}
+	accessToken, err := puppet.loginWithSharedSecret(mxid)
+	if err != nil {
+		ce.Reply("Failed to log in as %s: %v", mxid, err)
+		return
+	}
+	err = puppet.SwitchCustomMXID(accessToken, mxid)
+	if err != nil {
+		ce.Reply("Failed to map %s to %s: %v", puppet.ID, mxid, err)
+		return
+	}
+	ce.Reply("Messages from Discord user %s will now be sent as %s", puppet.ID, mxid)
+}
+
+var cmdUnmapUser = &commands.FullHandler{
+	Func: wrapCommand(fnUnmapUser),
+	Name: "unmap-user",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Remove a mapping created with map-user",
+		Args:        "<_Discord user ID_>",
+	},
+	RequiresAdmin: true,
+}
+
+func fnUnmapUser(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix unmap-user <Discord user ID>`")
+		return
+	}
+	puppet := ce.Bridge.GetPuppetByID(ce.Args[0])
+	if puppet.CustomMXID == "" {
+		ce.Reply("Discord user %s isn't mapped to a Matrix user", puppet.ID)
+		return
+	}
+	prevMXID := puppet.CustomMXID
+	err := puppet.SwitchCustomMXID("", "")
+	if err != nil {
+		ce.Reply("Failed to unmap %s: %v", puppet.ID, err)
+		return
+	}
+	ce.Reply("Messages from Discord user %s will no longer be sent as %s", puppet.ID, prevMXID)
+}
+
+var cmdDeadLetters = &commands.FullHandler{
+	Func: wrapCommand(fnDeadLetters),
+	Name: "dead-letters",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "List your recent messages that couldn't be delivered to Discord",
+		Args:        "[_limit_]",
+	},
+}
+
+func fnDeadLetters(ce *WrappedCommandEvent) {
+	limit := 10
+	if len(ce.Args) > 0 {
+		var err error
+		limit, err = strconv.Atoi(ce.Args[0])
+		if err != nil || limit <= 0 {
+			ce.Reply("**Usage**: `$cmdprefix dead-letters [limit]`")
+			return
+		}
+	}
+	letters := ce.Bridge.DB.DeadLetter.GetRecentBySender(ce.User.MXID, limit)
+	if len(letters) == 0 {
+		ce.Reply("No undelivered messages found")
+		return
+	}
+	var output strings.Builder
+	for _, letter := range letters {
+		_, _ = fmt.Fprintf(&output,
+			"* [%s](%s) (%s, %d attempts): %s\n  > %s\n",
+			letter.MXID, letter.RoomID.EventURI(letter.MXID, ce.Bridge.AS.HomeserverDomain).MatrixToURL(),
+			letter.Timestamp.Format(time.RFC3339), letter.Attempts, letter.Reason, strings.ReplaceAll(letter.Body, "\n", " "),
+		)
 	}
+	ce.Reply("Recent undelivered messages:\n\n%s", output.String())
 }
 
 var cmdDeleteAllPortals = &commands.FullHandler{
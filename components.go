@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/util/variationselector"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+// buttonReactions are the keycap emojis used to click the buttons of a message from Matrix, in button order.
+var buttonReactions = []string{"1️⃣", "2️⃣", "3️⃣", "4️⃣", "5️⃣", "6️⃣", "7️⃣", "8️⃣", "9️⃣", "🔟"}
+
+// maxCachedButtonMessages is how many bot messages each portal remembers the buttons of.
+const maxCachedButtonMessages = 100
+
+// interactionTimeout is how long to wait for Discord to say whether the bot accepted a button click.
+// Bots have to respond within 3 seconds, so this only runs out if the gateway event gets lost.
+const interactionTimeout = 15 * time.Second
+
+var (
+	errButtonDisabled      = errors.New("that button is disabled")
+	errInteractionFailed   = errors.New("the bot didn't respond to the button click")
+	errInteractionTimeout  = errors.New("timed out waiting for the bot to respond to the button click")
+	errInteractionNotFound = errors.New("there's no button with that number on the message anymore")
+)
+
+// messageButtons returns the buttons of a message that can be clicked, i.e. all buttons except links.
+func messageButtons(components []discordgo.MessageComponent) []*discordgo.Button {
+	var buttons []*discordgo.Button
+	for _, component := range components {
+		row, ok := component.(*discordgo.ActionsRow)
+		if !ok {
+			continue
+		}
+		for _, child := range row.Components {
+			if button, ok := child.(*discordgo.Button); ok && button.Style != discordgo.LinkButton {
+				buttons = append(buttons, button)
+			}
+		}
+	}
+	return buttons
+}
+
+// buttonReactionIndex returns the index of the button a reaction clicks, or -1 if it's not a number reaction.
+func buttonReactionIndex(key string) int {
+	key = variationselector.Remove(key)
+	for i, reaction := range buttonReactions {
+		if variationselector.Remove(reaction) == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// buttonMessage is a bot message along with the buttons that were shown for it in the room.
+type buttonMessage struct {
+	msg     *discordgo.Message
+	buttons []*discordgo.Button
+}
+
+// buttonMessageCache remembers the buttons of recent bot messages, so that a number reaction
+// clicks the button that had that number in the room without fetching the message again.
+type buttonMessageCache struct {
+	messages map[string]*buttonMessage
+	order    []string
+}
+
+// update stores the buttons of a bot message. Messages without buttons are stored too,
+// so that number reactions to them are known to be normal reactions.
+func (bc *buttonMessageCache) update(msg *discordgo.Message) {
+	if msg.Author == nil || !msg.Author.Bot {
+		return
+	}
+	if bc.messages == nil {
+		bc.messages = make(map[string]*buttonMessage)
+	}
+	if _, ok := bc.messages[msg.ID]; !ok {
+		bc.order = append(bc.order, msg.ID)
+		if len(bc.order) > maxCachedButtonMessages {
+			delete(bc.messages, bc.order[0])
+			bc.order = bc.order[1:]
+		}
+	}
+	bc.messages[msg.ID] = &buttonMessage{msg: msg, buttons: messageButtons(msg.Components)}
+}
+
+func (bc *buttonMessageCache) get(messageID string) (*buttonMessage, bool) {
+	bm, ok := bc.messages[messageID]
+	return bm, ok
+}
+
+// messageApplicationID returns the ID of the application that sent a bot message. Interaction responses are
+// sent through a webhook with the application ID, and the bot user of most applications has the same ID.
+func messageApplicationID(msg *discordgo.Message) string {
+	if msg.Application != nil && msg.Application.ID != "" {
+		return msg.Application.ID
+	} else if msg.Interaction != nil && msg.WebhookID != "" {
+		return msg.WebhookID
+	}
+	return msg.Author.ID
+}
+
+// linkButtons returns the link buttons of a message, which open a URL instead of sending an interaction to the bot.
+func linkButtons(components []discordgo.MessageComponent) []*discordgo.Button {
+	var buttons []*discordgo.Button
+	for _, component := range components {
+		row, ok := component.(*discordgo.ActionsRow)
+		if !ok {
+			continue
+		}
+		for _, child := range row.Components {
+			if button, ok := child.(*discordgo.Button); ok && button.Style == discordgo.LinkButton && button.URL != "" {
+				buttons = append(buttons, button)
+			}
+		}
+	}
+	return buttons
+}
+
+// buttonLabel returns the text of a button. Custom emojis can't be shown inline, so only Unicode emojis are included.
+func buttonLabel(button *discordgo.Button) string {
+	label := button.Label
+	if button.Emoji.Name != "" && button.Emoji.ID == "" {
+		label = strings.TrimSpace(button.Emoji.Name + " " + label)
+	}
+	return label
+}
+
+// renderDiscordComponents lists the buttons of a message with the number reactions that click them.
+// Link buttons are rendered as normal links, as opening them doesn't need the bot.
+func renderDiscordComponents(msg *discordgo.Message) string {
+	var lines []string
+	buttons := messageButtons(msg.Components)
+	if len(buttons) > 0 {
+		lines = append(lines, "React with a number to click a button:")
+	}
+	for i, button := range buttons {
+		if i >= len(buttonReactions) {
+			lines = append(lines, fmt.Sprintf("(%d more buttons can only be clicked on Discord)", len(buttons)-i))
+			break
+		}
+		line := fmt.Sprintf("%s %s", buttonReactions[i], discordMarkdownEscaper.Replace(buttonLabel(button)))
+		if button.Disabled {
+			line += " (disabled)"
+		}
+		lines = append(lines, line)
+	}
+	links := linkButtons(msg.Components)
+	if len(links) > 0 && len(lines) > 0 {
+		lines = append(lines, "")
+	}
+	for _, button := range links {
+		label := discordMarkdownEscaper.Replace(buttonLabel(button))
+		if label == "" {
+			// URLs are escaped when the message is rendered, so the fallback label mustn't be escaped here
+			label = button.URL
+		}
+		lines = append(lines, fmt.Sprintf("[%s](%s)", label, button.URL))
+	}
+	return strings.Join(lines, "\n")
+}
+
+type interactionResult struct {
+	Nonce string `json:"nonce"`
+}
+
+func (user *User) interactionResultHandler(evt *discordgo.Event) {
+	var result interactionResult
+	if err := json.Unmarshal(evt.RawData, &result); err != nil || result.Nonce == "" {
+		return
+	}
+	user.interactionsLock.Lock()
+	waiter, ok := user.interactions[result.Nonce]
+	delete(user.interactions, result.Nonce)
+	user.interactionsLock.Unlock()
+	if !ok {
+		return
+	}
+	if evt.Type == "INTERACTION_FAILURE" {
+		waiter <- errInteractionFailed
+	} else {
+		waiter <- nil
+	}
+}
+
+// clickButton sends a component interaction for the button and waits until Discord reports whether the bot handled it.
+func (user *User) clickButton(guildID string, msg *discordgo.Message, button *discordgo.Button) error {
+	if user.Session == nil {
+		return ErrNotConnected
+	}
+	nonce := generateNonce()
+	waiter := make(chan error, 1)
+	user.interactionsLock.Lock()
+	user.interactions[nonce] = waiter
+	user.interactionsLock.Unlock()
+	defer func() {
+		user.interactionsLock.Lock()
+		delete(user.interactions, nonce)
+		user.interactionsLock.Unlock()
+	}()
+
+	payload := map[string]interface{}{
+		"type":           3,
+		"nonce":          nonce,
+		"channel_id":     msg.ChannelID,
+		"message_id":     msg.ID,
+		"message_flags":  msg.Flags,
+		"application_id": messageApplicationID(msg),
+		"session_id":     user.Session.State.SessionID,
+		"data": map[string]interface{}{
+			"component_type": discordgo.ButtonComponent,
+			"custom_id":      button.CustomID,
+		},
+	}
+	if guildID != "" {
+		payload["guild_id"] = guildID
+	}
+	endpoint := discordgo.EndpointAPI + "interactions"
+	_, err := user.Session.RequestWithBucketID(http.MethodPost, endpoint, payload, endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to send button click: %w", err)
+	}
+	select {
+	case err = <-waiter:
+		return err
+	case <-time.After(interactionTimeout):
+		return errInteractionTimeout
+	}
+}
+
+// handleMatrixButtonClick checks if a number reaction is meant to click a button of the target message.
+// It returns false if the message doesn't have buttons, in which case the reaction is bridged normally.
+func (portal *Portal) handleMatrixButtonClick(sender *User, evt *event.Event, msg *database.Message, index int) bool {
+	if cached, ok := portal.buttonMessages.get(msg.DiscordID); ok {
+		if len(cached.buttons) == 0 {
+			return false
+		}
+		portal.clickMessageButton(sender, evt, cached, index)
+		return true
+	}
+	// Messages that haven't been bridged or edited since the bridge started are fetched outside the message loop.
+	// If they turn out not to have buttons, the reaction is passed back to the loop to be bridged normally.
+	go func() {
+		var discordMsg *discordgo.Message
+		var err error
+		if sender.Session == nil {
+			err = ErrNotConnected
+		} else {
+			discordMsg, err = sender.Session.ChannelMessage(msg.DiscordProtoChannelID(), msg.DiscordID)
+		}
+		if err != nil {
+			portal.log.Debugfln("Failed to fetch %s to check for buttons: %v", msg.DiscordID, err)
+		} else if buttons := messageButtons(discordMsg.Components); len(buttons) > 0 && discordMsg.Author != nil && discordMsg.Author.Bot {
+			portal.clickMessageButton(sender, evt, &buttonMessage{msg: discordMsg, buttons: buttons}, index)
+			return
+		}
+		portal.runInLoop(func() {
+			if discordMsg != nil {
+				portal.buttonMessages.update(discordMsg)
+			}
+			portal.sendMatrixReaction(sender, evt, msg)
+		})
+	}()
+	return true
+}
+
+func (portal *Portal) clickMessageButton(sender *User, evt *event.Event, bm *buttonMessage, index int) {
+	if index >= len(bm.buttons) {
+		go portal.sendMessageMetrics(evt, errInteractionNotFound, "Error clicking button")
+		return
+	} else if bm.buttons[index].Disabled {
+		go portal.sendMessageMetrics(evt, errButtonDisabled, "Error clicking button")
+		return
+	}
+	button := bm.buttons[index]
+	portal.log.Debugfln("Clicking button %d (%s) of %s for %s", index+1, button.CustomID, bm.msg.ID, sender.MXID)
+	go func() {
+		err := sender.clickButton(portal.GuildID, bm.msg, button)
+		portal.sendMessageMetrics(evt, err, "Error clicking button")
+	}()
+}
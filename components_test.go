@@ -0,0 +1,103 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderLinkButtons(t *testing.T) {
+	msg := &discordgo.Message{Components: []discordgo.MessageComponent{
+		&discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			&discordgo.Button{Label: "Docs", Style: discordgo.LinkButton, URL: "https://example.com/docs"},
+			&discordgo.Button{Label: "Website", Style: discordgo.LinkButton, URL: "https://example.com", Emoji: discordgo.ComponentEmoji{Name: "🌐"}},
+			&discordgo.Button{Style: discordgo.LinkButton, URL: "https://example.com/empty"},
+		}},
+	}}
+	assert.Empty(t, messageButtons(msg.Components))
+	assert.Equal(t, "[Docs](https://example.com/docs)\n"+
+		"[🌐 Website](https://example.com)\n"+
+		"[https://example.com/empty](https://example.com/empty)", renderDiscordComponents(msg))
+}
+
+func TestRenderLinkButtonWithoutLabel(t *testing.T) {
+	msg := &discordgo.Message{Components: []discordgo.MessageComponent{
+		&discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			&discordgo.Button{Style: discordgo.LinkButton, URL: "https://example.com/x_y"},
+		}},
+	}}
+	text := renderDiscordComponents(msg)
+	assert.Equal(t, "[https://example.com/x_y](https://example.com/x_y)", text)
+	content := (&Portal{}).renderDiscordMarkdown(text)
+	assert.Equal(t, `<a href="https://example.com/x_y">https://example.com/x_y</a>`, content.FormattedBody)
+}
+
+func TestRenderMixedButtons(t *testing.T) {
+	msg := &discordgo.Message{Components: []discordgo.MessageComponent{
+		&discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			&discordgo.Button{Label: "Accept", Style: discordgo.SuccessButton, CustomID: "accept"},
+			&discordgo.Button{Label: "Read *more*", Style: discordgo.LinkButton, URL: "https://example.com"},
+		}},
+	}}
+	assert.Equal(t, "React with a number to click a button:\n"+
+		"1️⃣ Accept\n"+
+		"\n"+
+		"[Read \\*more\\*](https://example.com)", renderDiscordComponents(msg))
+}
+
+func TestButtonMessageCacheFollowsEdits(t *testing.T) {
+	bot := &discordgo.User{ID: "10", Bot: true}
+	buttonRow := func(ids ...string) []discordgo.MessageComponent {
+		row := &discordgo.ActionsRow{}
+		for _, id := range ids {
+			row.Components = append(row.Components, &discordgo.Button{Label: id, Style: discordgo.PrimaryButton, CustomID: id})
+		}
+		return []discordgo.MessageComponent{row}
+	}
+	var cache buttonMessageCache
+	cache.update(&discordgo.Message{ID: "1", Author: bot, Components: buttonRow("a", "b")})
+	cache.update(&discordgo.Message{ID: "1", Author: bot, Components: buttonRow("c")})
+	cache.update(&discordgo.Message{ID: "2", Author: &discordgo.User{ID: "11"}, Components: buttonRow("d")})
+
+	cached, ok := cache.get("1")
+	if assert.True(t, ok) && assert.Len(t, cached.buttons, 1) {
+		assert.Equal(t, "c", cached.buttons[0].CustomID)
+	}
+	_, ok = cache.get("2")
+	assert.False(t, ok, "non-bot messages shouldn't be cached")
+
+	for i := 0; i < maxCachedButtonMessages; i++ {
+		cache.update(&discordgo.Message{ID: fmt.Sprintf("m%d", i), Author: bot})
+	}
+	_, ok = cache.get("1")
+	assert.False(t, ok, "oldest message should be evicted")
+	assert.Len(t, cache.messages, maxCachedButtonMessages)
+}
+
+func TestMessageApplicationID(t *testing.T) {
+	msg := &discordgo.Message{Author: &discordgo.User{ID: "1", Bot: true}}
+	assert.Equal(t, "1", messageApplicationID(msg))
+	msg.WebhookID = "2"
+	msg.Interaction = &discordgo.MessageInteraction{ID: "3"}
+	assert.Equal(t, "2", messageApplicationID(msg))
+	msg.Application = &discordgo.MessageApplication{ID: "4"}
+	assert.Equal(t, "4", messageApplicationID(msg))
+}
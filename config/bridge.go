@@ -19,6 +19,7 @@ package config
 import (
 	"errors"
 	"fmt"
+	"regexp"
 	"strings"
 	"text/template"
 
@@ -35,17 +36,35 @@ type BridgeConfig struct {
 	PrivateChatPortalMeta     bool   `yaml:"private_chat_portal_meta"`
 	PrivateChannelCreateLimit int    `yaml:"startup_private_channel_create_limit"`
 
+	DisplaynameSanitization DisplaynameSanitization `yaml:"displayname_sanitization"`
+
 	PortalMessageBuffer int `yaml:"portal_message_buffer"`
+	EmbedFieldLimit     int `yaml:"embed_field_limit"`
+	MaxSendRetries      int `yaml:"max_send_retries"`
+	MassMentionMaxWait  int `yaml:"mass_mention_max_wait"`
+	PendingEditMaxWait  int `yaml:"pending_edit_max_wait"`
+	QRLoginTimeout      int `yaml:"qr_login_timeout"`
 
 	DeliveryReceipts            bool `yaml:"delivery_receipts"`
 	MessageStatusEvents         bool `yaml:"message_status_events"`
 	MessageErrorNotices         bool `yaml:"message_error_notices"`
 	RestrictedRooms             bool `yaml:"restricted_rooms"`
 	AutojoinThreadOnOpen        bool `yaml:"autojoin_thread_on_open"`
+	ThreadsAsReplies            bool `yaml:"threads_as_replies"`
+	WebhookIdentities           bool `yaml:"webhook_identities"`
+	TypingNotifications         bool `yaml:"typing_notifications"`
+	FriendRequestNotices        bool `yaml:"friend_request_notices"`
+	ReactorListState            bool `yaml:"reactor_list_state"`
 	SyncDirectChatList          bool `yaml:"sync_direct_chat_list"`
 	ResendBridgeInfo            bool `yaml:"resend_bridge_info"`
 	DeletePortalOnChannelDelete bool `yaml:"delete_portal_on_channel_delete"`
 	FederateRooms               bool `yaml:"federate_rooms"`
+	SyncGuildMembers            bool `yaml:"sync_guild_members"`
+
+	ChannelTypes ChannelTypes `yaml:"channel_types"`
+
+	IntegrationNoticeRoom string `yaml:"integration_notice_room"`
+	CallNotices           bool   `yaml:"call_notices"`
 
 	DoublePuppetServerMap      map[string]string `yaml:"double_puppet_server_map"`
 	DoublePuppetAllowDiscovery bool              `yaml:"double_puppet_allow_discovery"`
@@ -61,6 +80,25 @@ type BridgeConfig struct {
 		SharedSecret string `yaml:"shared_secret"`
 	} `yaml:"provisioning"`
 
+	ReconnectBuffer struct {
+		MaxSize int `yaml:"max_size"`
+		MaxAge  int `yaml:"max_age"`
+	} `yaml:"reconnect_buffer"`
+
+	SendRateLimit struct {
+		Messages int `yaml:"messages"`
+		Period   int `yaml:"period"`
+	} `yaml:"send_rate_limit"`
+
+	ReloginPrompt struct {
+		Enabled bool `yaml:"enabled"`
+		AutoQR  bool `yaml:"auto_qr"`
+	} `yaml:"relogin_prompt"`
+
+	HealthCheck struct {
+		Address string `yaml:"address"`
+	} `yaml:"health_check"`
+
 	Permissions bridgeconfig.PermissionConfig `yaml:"permissions"`
 
 	usernameTemplate    *template.Template `yaml:"-"`
@@ -101,6 +139,8 @@ func (bc *BridgeConfig) Validate() error {
 
 type umBridgeConfig BridgeConfig
 
+var validLocalpartRegex = regexp.MustCompile(`^[a-z0-9._=/-]+$`)
+
 func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	err := unmarshal((*umBridgeConfig)(bc))
 	if err != nil {
@@ -112,10 +152,14 @@ func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	} else if !strings.Contains(bc.FormatUsername("1234567890"), "1234567890") {
 		return fmt.Errorf("username template is missing user ID placeholder")
+	} else if !validLocalpartRegex.MatchString(bc.FormatUsername("1234567890")) {
+		return fmt.Errorf("username template produces invalid Matrix localparts (only a-z, 0-9 and ._=-/ are allowed)")
 	}
 	bc.displaynameTemplate, err = template.New("displayname").Parse(bc.DisplaynameTemplate)
 	if err != nil {
 		return err
+	} else if strings.TrimSpace(bc.FormatDisplayname(&discordgo.User{ID: "1234567890", Username: "user", Discriminator: "0001"})) == "" {
+		return fmt.Errorf("displayname template produces empty displaynames")
 	}
 	bc.channelNameTemplate, err = template.New("channel_name").Parse(bc.ChannelNameTemplate)
 	if err != nil {
@@ -125,6 +169,9 @@ func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err != nil {
 		return err
 	}
+	if err = bc.ChannelTypes.validate(); err != nil {
+		return err
+	}
 
 	return nil
 }
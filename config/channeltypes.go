@@ -0,0 +1,65 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// channelTypeNames maps the names usable in the bridge.channel_types option to Discord guild channel types.
+var channelTypeNames = map[string]discordgo.ChannelType{
+	"text":         discordgo.ChannelTypeGuildText,
+	"voice":        discordgo.ChannelTypeGuildVoice,
+	"announcement": discordgo.ChannelTypeGuildNews,
+	"stage":        discordgo.ChannelTypeGuildStageVoice,
+	// discordgo doesn't have a constant for forum channels yet.
+	"forum": 15,
+}
+
+// ChannelTypes is the list of guild channel types that the bridge creates portals for.
+type ChannelTypes []string
+
+func (ct ChannelTypes) validate() error {
+	for _, name := range ct {
+		if _, ok := channelTypeNames[name]; !ok {
+			return fmt.Errorf("unknown channel type %q in channel_types", name)
+		}
+	}
+	return nil
+}
+
+// Allows returns whether channels of the given type should be bridged.
+func (ct ChannelTypes) Allows(channelType discordgo.ChannelType) bool {
+	for _, name := range ct {
+		if channelTypeNames[name] == channelType {
+			return true
+		}
+	}
+	return false
+}
+
+// IsConfigurableChannelType returns whether the channel type is one that can be listed in channel_types.
+func IsConfigurableChannelType(channelType discordgo.ChannelType) bool {
+	for _, knownType := range channelTypeNames {
+		if knownType == channelType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"strings"
+	"unicode"
+)
+
+type DisplaynameSanitization struct {
+	Enabled           bool `yaml:"enabled"`
+	MaxCombiningMarks int  `yaml:"max_combining_marks"`
+}
+
+func isInvisibleFormatChar(r rune) bool {
+	switch {
+	case r >= 0x202A && r <= 0x202E, r >= 0x2066 && r <= 0x2069:
+		// Bidirectional embeddings, overrides and isolates
+		return true
+	case r == 0x200E, r == 0x200F, r == 0x061C:
+		// Directional marks
+		return true
+	case r == 0x200B, r == 0x200C, r == 0x2060, r == 0xFEFF:
+		// Zero-width characters (except the joiner, which is used in emoji sequences)
+		return true
+	}
+	return false
+}
+
+// foldLookalike maps fullwidth and mathematical alphanumeric characters,
+// which are commonly used to imitate other names, to plain ASCII.
+func foldLookalike(r rune) rune {
+	switch {
+	case r >= 0xFF01 && r <= 0xFF5E:
+		return r - 0xFEE0
+	case r >= 0x1D400 && r <= 0x1D6A3:
+		offset := (r - 0x1D400) % 52
+		if offset < 26 {
+			return 'A' + offset
+		}
+		return 'a' + offset - 26
+	case r >= 0x1D7CE && r <= 0x1D7FF:
+		return '0' + (r-0x1D7CE)%10
+	}
+	return r
+}
+
+// Sanitize strips directional overrides and invisible characters, folds lookalike
+// alphanumerics and limits the number of combining marks on each character.
+func (ds DisplaynameSanitization) Sanitize(name string) string {
+	if !ds.Enabled {
+		return name
+	}
+	var output strings.Builder
+	output.Grow(len(name))
+	combining := 0
+	for _, r := range name {
+		if isInvisibleFormatChar(r) {
+			continue
+		} else if unicode.In(r, unicode.Mn, unicode.Me) {
+			combining++
+			if combining > ds.MaxCombiningMarks {
+				continue
+			}
+		} else {
+			combining = 0
+			r = foldLookalike(r)
+		}
+		output.WriteRune(r)
+	}
+	return strings.TrimSpace(output.String())
+}
@@ -27,20 +27,36 @@ func DoUpgrade(helper *up.Helper) {
 
 	helper.Copy(up.Str, "bridge", "username_template")
 	helper.Copy(up.Str, "bridge", "displayname_template")
+	helper.Copy(up.Bool, "bridge", "displayname_sanitization", "enabled")
+	helper.Copy(up.Int, "bridge", "displayname_sanitization", "max_combining_marks")
 	helper.Copy(up.Str, "bridge", "channel_name_template")
 	helper.Copy(up.Str, "bridge", "guild_name_template")
 	helper.Copy(up.Bool, "bridge", "private_chat_portal_meta")
 	helper.Copy(up.Int, "bridge", "startup_private_channel_create_limit")
 	helper.Copy(up.Int, "bridge", "portal_message_buffer")
+	helper.Copy(up.Int, "bridge", "embed_field_limit")
+	helper.Copy(up.Int, "bridge", "max_send_retries")
+	helper.Copy(up.Int, "bridge", "mass_mention_max_wait")
+	helper.Copy(up.Int, "bridge", "pending_edit_max_wait")
+	helper.Copy(up.Int, "bridge", "qr_login_timeout")
 	helper.Copy(up.Bool, "bridge", "delivery_receipts")
 	helper.Copy(up.Bool, "bridge", "message_status_events")
 	helper.Copy(up.Bool, "bridge", "message_error_notices")
 	helper.Copy(up.Bool, "bridge", "restricted_rooms")
 	helper.Copy(up.Bool, "bridge", "autojoin_thread_on_open")
+	helper.Copy(up.Bool, "bridge", "threads_as_replies")
+	helper.Copy(up.Bool, "bridge", "webhook_identities")
+	helper.Copy(up.Bool, "bridge", "typing_notifications")
+	helper.Copy(up.Bool, "bridge", "friend_request_notices")
+	helper.Copy(up.Bool, "bridge", "reactor_list_state")
 	helper.Copy(up.Bool, "bridge", "sync_direct_chat_list")
 	helper.Copy(up.Bool, "bridge", "resend_bridge_info")
 	helper.Copy(up.Bool, "bridge", "delete_portal_on_channel_delete")
 	helper.Copy(up.Bool, "bridge", "federate_rooms")
+	helper.Copy(up.Bool, "bridge", "sync_guild_members")
+	helper.Copy(up.List, "bridge", "channel_types")
+	helper.Copy(up.Str|up.Null, "bridge", "integration_notice_room")
+	helper.Copy(up.Bool, "bridge", "call_notices")
 	helper.Copy(up.Map, "bridge", "double_puppet_server_map")
 	helper.Copy(up.Bool, "bridge", "double_puppet_allow_discovery")
 	helper.Copy(up.Map, "bridge", "login_shared_secret_map")
@@ -68,6 +84,13 @@ func DoUpgrade(helper *up.Helper) {
 	} else {
 		helper.Copy(up.Str, "bridge", "provisioning", "shared_secret")
 	}
+	helper.Copy(up.Int, "bridge", "reconnect_buffer", "max_size")
+	helper.Copy(up.Int, "bridge", "reconnect_buffer", "max_age")
+	helper.Copy(up.Int, "bridge", "send_rate_limit", "messages")
+	helper.Copy(up.Int, "bridge", "send_rate_limit", "period")
+	helper.Copy(up.Bool, "bridge", "relogin_prompt", "enabled")
+	helper.Copy(up.Bool, "bridge", "relogin_prompt", "auto_qr")
+	helper.Copy(up.Str|up.Null, "bridge", "health_check", "address")
 
 	helper.Copy(up.Map, "bridge", "permissions")
 	//helper.Copy(up.Bool, "bridge", "relay", "enabled")
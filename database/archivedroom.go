@@ -0,0 +1,85 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+const archivedRoomSelect = "SELECT mxid, dcid, dc_guild_id, name, archived_at FROM archived_room"
+
+type ArchivedRoomQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (arq *ArchivedRoomQuery) New() *ArchivedRoom {
+	return &ArchivedRoom{
+		db:  arq.db,
+		log: arq.log,
+	}
+}
+
+// GetAllByGuildID returns the archived rooms of a guild, including its space, oldest first.
+func (arq *ArchivedRoomQuery) GetAllByGuildID(guildID string) []*ArchivedRoom {
+	rows, err := arq.db.Query(archivedRoomSelect+" WHERE dc_guild_id=$1 ORDER BY archived_at", guildID)
+	if err != nil {
+		arq.log.Errorln("Failed to query archived rooms:", err)
+		return nil
+	}
+
+	var rooms []*ArchivedRoom
+	for rows.Next() {
+		room := arq.New().Scan(rows)
+		if room != nil {
+			rooms = append(rooms, room)
+		}
+	}
+
+	return rooms
+}
+
+// ArchivedRoom is a Matrix room that was disconnected from Discord but kept for its history.
+type ArchivedRoom struct {
+	db  *Database
+	log log.Logger
+
+	MXID       id.RoomID
+	DiscordID  string
+	GuildID    string
+	Name       string
+	ArchivedAt time.Time
+}
+
+func (ar *ArchivedRoom) Scan(row dbutil.Scannable) *ArchivedRoom {
+	var archivedAt int64
+	err := row.Scan(&ar.MXID, &ar.DiscordID, &ar.GuildID, &ar.Name, &archivedAt)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			ar.log.Errorln("Database scan failed:", err)
+			panic(err)
+		}
+
+		return nil
+	}
+	ar.ArchivedAt = time.UnixMilli(archivedAt)
+	return ar
+}
+
+func (ar *ArchivedRoom) Insert() {
+	query := `
+		INSERT INTO archived_room (mxid, dcid, dc_guild_id, name, archived_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (mxid) DO UPDATE SET archived_at=excluded.archived_at
+	`
+	_, err := ar.db.Exec(query, ar.MXID, ar.DiscordID, ar.GuildID, ar.Name, ar.ArchivedAt.UnixMilli())
+	if err != nil {
+		ar.log.Warnfln("Failed to insert archived room %s: %v", ar.MXID, err)
+		panic(err)
+	}
+}
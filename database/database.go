@@ -24,6 +24,10 @@ type Database struct {
 	Emoji    *EmojiQuery
 	Guild    *GuildQuery
 	Role     *RoleQuery
+
+	DeadLetter      *DeadLetterQuery
+	ArchivedRoom    *ArchivedRoomQuery
+	WebhookIdentity *WebhookIdentityQuery
 }
 
 func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
@@ -65,6 +69,18 @@ func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
 		db:  db,
 		log: log.Sub("Role"),
 	}
+	db.DeadLetter = &DeadLetterQuery{
+		db:  db,
+		log: log.Sub("DeadLetter"),
+	}
+	db.ArchivedRoom = &ArchivedRoomQuery{
+		db:  db,
+		log: log.Sub("ArchivedRoom"),
+	}
+	db.WebhookIdentity = &WebhookIdentityQuery{
+		db:  db,
+		log: log.Sub("WebhookIdentity"),
+	}
 	return db
 }
 
@@ -0,0 +1,90 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+type DeadLetterQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+// language=postgresql
+const (
+	deadLetterSelect = "SELECT mxid, mx_room, sender, dc_chan_id, body, attempts, reason, timestamp FROM dead_letter"
+	deadLetterInsert = `
+		INSERT INTO dead_letter (mxid, mx_room, sender, dc_chan_id, body, attempts, reason, timestamp)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (mxid) DO UPDATE
+		    SET attempts=excluded.attempts, reason=excluded.reason, timestamp=excluded.timestamp
+	`
+)
+
+func (dlq *DeadLetterQuery) New() *DeadLetter {
+	return &DeadLetter{
+		db:  dlq.db,
+		log: dlq.log,
+	}
+}
+
+func (dlq *DeadLetterQuery) GetRecentBySender(sender id.UserID, limit int) []*DeadLetter {
+	rows, err := dlq.db.Query(deadLetterSelect+" WHERE sender=$1 ORDER BY timestamp DESC LIMIT $2", sender, limit)
+	if err != nil {
+		dlq.log.Errorfln("Failed to query dead letters of %s: %v", sender, err)
+		return nil
+	}
+
+	var letters []*DeadLetter
+	for rows.Next() {
+		letter := dlq.New().Scan(rows)
+		if letter != nil {
+			letters = append(letters, letter)
+		}
+	}
+
+	return letters
+}
+
+// DeadLetter is a Matrix event that permanently failed to be delivered to Discord.
+type DeadLetter struct {
+	db  *Database
+	log log.Logger
+
+	MXID      id.EventID
+	RoomID    id.RoomID
+	Sender    id.UserID
+	ChannelID string
+	Body      string
+	Attempts  int
+	Reason    string
+	Timestamp time.Time
+}
+
+func (dl *DeadLetter) Scan(row dbutil.Scannable) *DeadLetter {
+	var ts int64
+	err := row.Scan(&dl.MXID, &dl.RoomID, &dl.Sender, &dl.ChannelID, &dl.Body, &dl.Attempts, &dl.Reason, &ts)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			dl.log.Errorln("Database scan failed:", err)
+			panic(err)
+		}
+		return nil
+	}
+	dl.Timestamp = time.UnixMilli(ts).UTC()
+	return dl
+}
+
+func (dl *DeadLetter) Insert() {
+	_, err := dl.db.Exec(deadLetterInsert, dl.MXID, dl.RoomID, dl.Sender, dl.ChannelID, dl.Body, dl.Attempts, dl.Reason, dl.Timestamp.UnixMilli())
+	if err != nil {
+		dl.log.Warnfln("Failed to insert dead letter %s: %v", dl.MXID, err)
+		panic(err)
+	}
+}
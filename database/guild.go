@@ -16,13 +16,15 @@ type GuildQuery struct {
 }
 
 const (
-	guildSelect = "SELECT dcid, mxid, plain_name, name, name_set, avatar, avatar_url, avatar_set, auto_bridge_channels FROM guild"
+	guildSelect = "SELECT dcid, mxid, plain_name, name, name_set, avatar, avatar_url, avatar_set, topic, topic_set, auto_bridge_channels, bridge_direction, puppet_power_level, rules_channel_id, system_channel_id FROM guild"
 )
 
 func (gq *GuildQuery) New() *Guild {
 	return &Guild{
 		db:  gq.db,
 		log: gq.log,
+
+		BridgeDirection: BridgeDirectionBoth,
 	}
 }
 
@@ -66,14 +68,47 @@ type Guild struct {
 	Avatar    string
 	AvatarURL id.ContentURI
 	AvatarSet bool
+	Topic     string
+	TopicSet  bool
 
 	AutoBridgeChannels bool
+	BridgeDirection    BridgeDirection
+	PuppetPowerLevel   int
+
+	RulesChannelID  string
+	SystemChannelID string
+}
+
+// BridgeDirection describes which way messages are bridged in a guild.
+type BridgeDirection string
+
+const (
+	BridgeDirectionBoth            BridgeDirection = "both"
+	BridgeDirectionDiscordToMatrix BridgeDirection = "discord-to-matrix"
+	BridgeDirectionMatrixToDiscord BridgeDirection = "matrix-to-discord"
+)
+
+func (bd BridgeDirection) IsValid() bool {
+	switch bd {
+	case BridgeDirectionBoth, BridgeDirectionDiscordToMatrix, BridgeDirectionMatrixToDiscord:
+		return true
+	default:
+		return false
+	}
+}
+
+func (bd BridgeDirection) AllowsDiscordToMatrix() bool {
+	return bd != BridgeDirectionMatrixToDiscord
+}
+
+func (bd BridgeDirection) AllowsMatrixToDiscord() bool {
+	return bd != BridgeDirectionDiscordToMatrix
 }
 
 func (g *Guild) Scan(row dbutil.Scannable) *Guild {
 	var mxid sql.NullString
 	var avatarURL string
-	err := row.Scan(&g.ID, &mxid, &g.PlainName, &g.Name, &g.NameSet, &g.Avatar, &avatarURL, &g.AvatarSet, &g.AutoBridgeChannels)
+	err := row.Scan(&g.ID, &mxid, &g.PlainName, &g.Name, &g.NameSet, &g.Avatar, &avatarURL, &g.AvatarSet, &g.Topic, &g.TopicSet, &g.AutoBridgeChannels, &g.BridgeDirection, &g.PuppetPowerLevel, &g.RulesChannelID, &g.SystemChannelID)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			g.log.Errorln("Database scan failed:", err)
@@ -96,10 +131,12 @@ func (g *Guild) mxidPtr() *id.RoomID {
 
 func (g *Guild) Insert() {
 	query := `
-		INSERT INTO guild (dcid, mxid, plain_name, name, name_set, avatar, avatar_url, avatar_set, auto_bridge_channels)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		INSERT INTO guild (dcid, mxid, plain_name, name, name_set, avatar, avatar_url, avatar_set, topic, topic_set,
+		                   auto_bridge_channels, bridge_direction, puppet_power_level, rules_channel_id, system_channel_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
 	`
-	_, err := g.db.Exec(query, g.ID, g.mxidPtr(), g.PlainName, g.Name, g.NameSet, g.Avatar, g.AvatarURL.String(), g.AvatarSet, g.AutoBridgeChannels)
+	_, err := g.db.Exec(query, g.ID, g.mxidPtr(), g.PlainName, g.Name, g.NameSet, g.Avatar, g.AvatarURL.String(), g.AvatarSet, g.Topic, g.TopicSet,
+		g.AutoBridgeChannels, g.BridgeDirection, g.PuppetPowerLevel, g.RulesChannelID, g.SystemChannelID)
 	if err != nil {
 		g.log.Warnfln("Failed to insert %s: %v", g.ID, err)
 		panic(err)
@@ -108,10 +145,12 @@ func (g *Guild) Insert() {
 
 func (g *Guild) Update() {
 	query := `
-		UPDATE guild SET mxid=$1, plain_name=$2, name=$3, name_set=$4, avatar=$5, avatar_url=$6, avatar_set=$7, auto_bridge_channels=$8
-		WHERE dcid=$9
+		UPDATE guild SET mxid=$1, plain_name=$2, name=$3, name_set=$4, avatar=$5, avatar_url=$6, avatar_set=$7, topic=$8, topic_set=$9,
+		                 auto_bridge_channels=$10, bridge_direction=$11, puppet_power_level=$12, rules_channel_id=$13, system_channel_id=$14
+		WHERE dcid=$15
 	`
-	_, err := g.db.Exec(query, g.mxidPtr(), g.PlainName, g.Name, g.NameSet, g.Avatar, g.AvatarURL.String(), g.AvatarSet, g.AutoBridgeChannels, g.ID)
+	_, err := g.db.Exec(query, g.mxidPtr(), g.PlainName, g.Name, g.NameSet, g.Avatar, g.AvatarURL.String(), g.AvatarSet, g.Topic, g.TopicSet,
+		g.AutoBridgeChannels, g.BridgeDirection, g.PuppetPowerLevel, g.RulesChannelID, g.SystemChannelID, g.ID)
 	if err != nil {
 		g.log.Warnfln("Failed to update %s: %v", g.ID, err)
 		panic(err)
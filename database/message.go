@@ -55,6 +55,13 @@ func (mq *MessageQuery) GetFirstByDiscordID(key PortalKey, discordID string) *Me
 	return mq.New().Scan(mq.db.QueryRow(query, key.ChannelID, key.Receiver, discordID))
 }
 
+// GetFirstByDiscordIDInAnyChannel finds a message by its Discord ID regardless of which portal it's in.
+// Discord message IDs are snowflakes, so they're unique across channels.
+func (mq *MessageQuery) GetFirstByDiscordIDInAnyChannel(discordID string) *Message {
+	query := messageSelect + " WHERE dcid=$1 AND dc_edit_index=0 ORDER BY dc_attachment_id ASC LIMIT 1"
+	return mq.New().Scan(mq.db.QueryRow(query, discordID))
+}
+
 func (mq *MessageQuery) GetLastByDiscordID(key PortalKey, discordID string) *Message {
 	query := messageSelect + " WHERE dc_chan_id=$1 AND dc_chan_receiver=$2 AND dcid=$3 AND dc_edit_index=0 ORDER BY dc_attachment_id DESC LIMIT 1"
 	return mq.New().Scan(mq.db.QueryRow(query, key.ChannelID, key.Receiver, discordID))
@@ -90,6 +97,12 @@ func (mq *MessageQuery) GetByMXID(key PortalKey, mxid id.EventID) *Message {
 	return mq.New().Scan(row)
 }
 
+// GetByMXIDInAnyChannel finds a message by its Matrix event ID regardless of which portal it's in.
+func (mq *MessageQuery) GetByMXIDInAnyChannel(mxid id.EventID) *Message {
+	query := messageSelect + " WHERE mxid=$1"
+	return mq.New().Scan(mq.db.QueryRow(query, mxid))
+}
+
 type Message struct {
 	db  *Database
 	log log.Logger
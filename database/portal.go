@@ -16,7 +16,7 @@ const (
 	portalSelect = `
 		SELECT dcid, receiver, type, other_user_id, dc_guild_id, dc_parent_id, mxid,
 		       plain_name, name, name_set, topic, topic_set, avatar, avatar_url, avatar_set,
-		       encrypted, in_space, first_event_id
+		       encrypted, in_space, first_event_id, thread_archive_duration, bot_displayname, typing_notifications, paused, slowmode
 		FROM portal
 	`
 )
@@ -64,6 +64,10 @@ func (pq *PortalQuery) GetByMXID(mxid id.RoomID) *Portal {
 	return pq.get(portalSelect+" WHERE mxid=$1", mxid)
 }
 
+func (pq *PortalQuery) FindByGuild(guildID string) []*Portal {
+	return pq.getAll(portalSelect+" WHERE dc_guild_id=$1", guildID)
+}
+
 func (pq *PortalQuery) FindPrivateChatsWith(id string) []*Portal {
 	return pq.getAll(portalSelect+" WHERE other_user_id=$1 AND type=$2", id, discordgo.ChannelTypeDM)
 }
@@ -117,6 +121,12 @@ type Portal struct {
 	InSpace   id.RoomID
 
 	FirstEventID id.EventID
+
+	ThreadArchiveDuration int
+	BotDisplayname        string
+	TypingNotifications   *bool
+	Paused                bool
+	Slowmode              *int
 }
 
 func (p *Portal) Scan(row dbutil.Scannable) *Portal {
@@ -126,7 +136,7 @@ func (p *Portal) Scan(row dbutil.Scannable) *Portal {
 
 	err := row.Scan(&p.Key.ChannelID, &p.Key.Receiver, &chanType, &otherUserID, &guildID, &parentID,
 		&mxid, &p.PlainName, &p.Name, &p.NameSet, &p.Topic, &p.TopicSet, &p.Avatar, &avatarURL, &p.AvatarSet,
-		&p.Encrypted, &p.InSpace, &firstEventID)
+		&p.Encrypted, &p.InSpace, &firstEventID, &p.ThreadArchiveDuration, &p.BotDisplayname, &p.TypingNotifications, &p.Paused, &p.Slowmode)
 
 	if err != nil {
 		if err != sql.ErrNoRows {
@@ -152,13 +162,13 @@ func (p *Portal) Insert() {
 	query := `
 		INSERT INTO portal (dcid, receiver, type, other_user_id, dc_guild_id, dc_parent_id, mxid,
 		                    plain_name, name, name_set, topic, topic_set, avatar, avatar_url, avatar_set,
-		                    encrypted, in_space, first_event_id)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)
+		                    encrypted, in_space, first_event_id, thread_archive_duration, bot_displayname, typing_notifications, paused, slowmode)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23)
 	`
 	_, err := p.db.Exec(query, p.Key.ChannelID, p.Key.Receiver, p.Type,
 		strPtr(p.OtherUserID), strPtr(p.GuildID), strPtr(p.ParentID), strPtr(string(p.MXID)),
 		p.PlainName, p.Name, p.NameSet, p.Topic, p.TopicSet, p.Avatar, p.AvatarURL.String(), p.AvatarSet,
-		p.Encrypted, p.InSpace, p.FirstEventID.String())
+		p.Encrypted, p.InSpace, p.FirstEventID.String(), p.ThreadArchiveDuration, p.BotDisplayname, p.TypingNotifications, p.Paused, p.Slowmode)
 
 	if err != nil {
 		p.log.Warnfln("Failed to insert %s: %v", p.Key, err)
@@ -171,13 +181,13 @@ func (p *Portal) Update() {
 		UPDATE portal
 		SET type=$1, other_user_id=$2, dc_guild_id=$3, dc_parent_id=$4, mxid=$5,
 			plain_name=$6, name=$7, name_set=$8, topic=$9, topic_set=$10, avatar=$11, avatar_url=$12, avatar_set=$13,
-			encrypted=$14, in_space=$15, first_event_id=$16
-		WHERE dcid=$17 AND receiver=$18
+			encrypted=$14, in_space=$15, first_event_id=$16, thread_archive_duration=$17, bot_displayname=$18, typing_notifications=$19, paused=$20, slowmode=$21
+		WHERE dcid=$22 AND receiver=$23
 	`
 	_, err := p.db.Exec(query,
 		p.Type, strPtr(p.OtherUserID), strPtr(p.GuildID), strPtr(p.ParentID), strPtr(string(p.MXID)),
 		p.PlainName, p.Name, p.NameSet, p.Topic, p.TopicSet, p.Avatar, p.AvatarURL.String(), p.AvatarSet,
-		p.Encrypted, p.InSpace, p.FirstEventID.String(),
+		p.Encrypted, p.InSpace, p.FirstEventID.String(), p.ThreadArchiveDuration, p.BotDisplayname, p.TypingNotifications, p.Paused, p.Slowmode,
 		p.Key.ChannelID, p.Key.Receiver)
 
 	if err != nil {
@@ -10,7 +10,7 @@ import (
 )
 
 const (
-	puppetSelect = "SELECT id, name, name_set, avatar, avatar_url, avatar_set," +
+	puppetSelect = "SELECT id, name, original_name, name_set, avatar, avatar_url, avatar_set," +
 		" custom_mxid, access_token, next_batch" +
 		" FROM puppet "
 )
@@ -73,6 +73,9 @@ type Puppet struct {
 	AvatarURL id.ContentURI
 	AvatarSet bool
 
+	// The displayname before sanitization, only set if it was changed by sanitizing.
+	OriginalName string
+
 	CustomMXID  id.UserID
 	AccessToken string
 	NextBatch   string
@@ -82,7 +85,7 @@ func (p *Puppet) Scan(row dbutil.Scannable) *Puppet {
 	var avatarURL string
 	var customMXID, accessToken, nextBatch sql.NullString
 
-	err := row.Scan(&p.ID, &p.Name, &p.NameSet, &p.Avatar, &avatarURL, &p.AvatarSet,
+	err := row.Scan(&p.ID, &p.Name, &p.OriginalName, &p.NameSet, &p.Avatar, &avatarURL, &p.AvatarSet,
 		&customMXID, &accessToken, &nextBatch)
 
 	if err != nil {
@@ -104,10 +107,10 @@ func (p *Puppet) Scan(row dbutil.Scannable) *Puppet {
 
 func (p *Puppet) Insert() {
 	query := `
-		INSERT INTO puppet (id, name, name_set, avatar, avatar_url, avatar_set, custom_mxid, access_token, next_batch)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		INSERT INTO puppet (id, name, original_name, name_set, avatar, avatar_url, avatar_set, custom_mxid, access_token, next_batch)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 	`
-	_, err := p.db.Exec(query, p.ID, p.Name, p.NameSet, p.Avatar, p.AvatarURL.String(), p.AvatarSet,
+	_, err := p.db.Exec(query, p.ID, p.Name, p.OriginalName, p.NameSet, p.Avatar, p.AvatarURL.String(), p.AvatarSet,
 		strPtr(string(p.CustomMXID)), strPtr(p.AccessToken), strPtr(p.NextBatch))
 
 	if err != nil {
@@ -119,11 +122,11 @@ func (p *Puppet) Insert() {
 func (p *Puppet) Update() {
 	query := `
 		UPDATE puppet SET name=$1, name_set=$2, avatar=$3, avatar_url=$4, avatar_set=$5,
-		                  custom_mxid=$6, access_token=$7, next_batch=$8
-		WHERE id=$9
+		                  custom_mxid=$6, access_token=$7, next_batch=$8, original_name=$9
+		WHERE id=$10
 	`
 	_, err := p.db.Exec(query, p.Name, p.NameSet, p.Avatar, p.AvatarURL.String(), p.AvatarSet,
-		strPtr(string(p.CustomMXID)), strPtr(p.AccessToken), strPtr(p.NextBatch),
+		strPtr(string(p.CustomMXID)), strPtr(p.AccessToken), strPtr(p.NextBatch), p.OriginalName,
 		p.ID)
 
 	if err != nil {
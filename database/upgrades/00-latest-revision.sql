@@ -1,4 +1,4 @@
--- v0 -> v9: Latest revision
+-- v0 -> v25: Latest revision
 
 CREATE TABLE guild (
     dcid       TEXT PRIMARY KEY,
@@ -9,8 +9,15 @@ CREATE TABLE guild (
     avatar     TEXT NOT NULL,
     avatar_url TEXT NOT NULL,
     avatar_set BOOLEAN NOT NULL,
+    topic      TEXT NOT NULL DEFAULT '',
+    topic_set  BOOLEAN NOT NULL DEFAULT false,
 
-    auto_bridge_channels BOOLEAN NOT NULL
+    auto_bridge_channels BOOLEAN NOT NULL,
+    bridge_direction     TEXT    NOT NULL DEFAULT 'both',
+    puppet_power_level   INTEGER NOT NULL DEFAULT 0,
+
+    rules_channel_id  TEXT NOT NULL DEFAULT '',
+    system_channel_id TEXT NOT NULL DEFAULT ''
 );
 
 CREATE TABLE portal (
@@ -39,6 +46,12 @@ CREATE TABLE portal (
 
     first_event_id TEXT NOT NULL,
 
+    thread_archive_duration INTEGER NOT NULL DEFAULT 0,
+    bot_displayname         TEXT NOT NULL DEFAULT '',
+    typing_notifications    BOOLEAN,
+    paused                  BOOLEAN NOT NULL DEFAULT false,
+    slowmode                INTEGER,
+
     PRIMARY KEY (dcid, receiver),
     CONSTRAINT portal_parent_fkey FOREIGN KEY (dc_parent_id, dc_parent_receiver) REFERENCES portal (dcid, receiver) ON DELETE CASCADE,
     CONSTRAINT portal_guild_fkey  FOREIGN KEY (dc_guild_id) REFERENCES guild(dcid) ON DELETE CASCADE
@@ -65,6 +78,8 @@ CREATE TABLE puppet (
     avatar_url TEXT NOT NULL,
     avatar_set BOOLEAN NOT NULL,
 
+    original_name TEXT NOT NULL DEFAULT '',
+
     custom_mxid  TEXT,
     access_token TEXT,
     next_batch   TEXT
@@ -79,7 +94,13 @@ CREATE TABLE "user" (
     space_room      TEXT,
     dm_space_room   TEXT,
 
-    read_state_version INTEGER NOT NULL DEFAULT 0
+    read_state_version INTEGER NOT NULL DEFAULT 0,
+    proxy              TEXT,
+
+    activity_type INTEGER NOT NULL DEFAULT 0,
+    activity_name TEXT,
+
+    command_prefix TEXT
 );
 
 CREATE TABLE user_portal (
@@ -150,3 +171,30 @@ CREATE TABLE role (
     PRIMARY KEY (dc_guild_id, dcid),
     CONSTRAINT role_guild_fkey FOREIGN KEY (dc_guild_id) REFERENCES guild (dcid) ON DELETE CASCADE
 );
+
+CREATE TABLE dead_letter (
+    mxid       TEXT PRIMARY KEY,
+    mx_room    TEXT    NOT NULL,
+    sender     TEXT    NOT NULL,
+    dc_chan_id TEXT    NOT NULL,
+    body       TEXT    NOT NULL,
+    attempts   INTEGER NOT NULL,
+    reason     TEXT    NOT NULL,
+    timestamp  BIGINT  NOT NULL
+);
+
+CREATE TABLE archived_room (
+    mxid        TEXT PRIMARY KEY,
+    dcid        TEXT   NOT NULL,
+    dc_guild_id TEXT   NOT NULL,
+    name        TEXT   NOT NULL,
+    archived_at BIGINT NOT NULL
+);
+
+CREATE TABLE webhook_identity (
+    webhook_id TEXT,
+    username   TEXT,
+    puppet_id  TEXT NOT NULL,
+
+    PRIMARY KEY (webhook_id, username)
+);
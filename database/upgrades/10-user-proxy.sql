@@ -0,0 +1,2 @@
+-- v10: Store per-user proxy
+ALTER TABLE "user" ADD COLUMN proxy TEXT;
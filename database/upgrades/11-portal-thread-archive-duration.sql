@@ -0,0 +1,2 @@
+-- v11: Store thread auto-archive duration for threads created from Matrix
+ALTER TABLE portal ADD COLUMN thread_archive_duration INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,11 @@
+-- v12: Store messages that permanently failed to send
+CREATE TABLE dead_letter (
+    mxid       TEXT PRIMARY KEY,
+    mx_room    TEXT    NOT NULL,
+    sender     TEXT    NOT NULL,
+    dc_chan_id TEXT    NOT NULL,
+    body       TEXT    NOT NULL,
+    attempts   INTEGER NOT NULL,
+    reason     TEXT    NOT NULL,
+    timestamp  BIGINT  NOT NULL
+);
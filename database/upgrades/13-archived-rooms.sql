@@ -0,0 +1,8 @@
+-- v13: Store rooms that were unbridged but kept
+CREATE TABLE archived_room (
+    mxid        TEXT PRIMARY KEY,
+    dcid        TEXT   NOT NULL,
+    dc_guild_id TEXT   NOT NULL,
+    name        TEXT   NOT NULL,
+    archived_at BIGINT NOT NULL
+);
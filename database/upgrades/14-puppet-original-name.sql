@@ -0,0 +1,2 @@
+-- v14: Store unsanitized puppet displaynames
+ALTER TABLE puppet ADD COLUMN original_name TEXT NOT NULL DEFAULT '';
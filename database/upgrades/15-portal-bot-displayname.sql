@@ -0,0 +1,2 @@
+-- v15: Store per-portal display name overrides for the bridge bot
+ALTER TABLE portal ADD COLUMN bot_displayname TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- v16: Store per-guild message bridging direction
+ALTER TABLE guild ADD COLUMN bridge_direction TEXT NOT NULL DEFAULT 'both';
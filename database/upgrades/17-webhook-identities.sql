@@ -0,0 +1,8 @@
+-- v17: Store puppets used for the different identities of Discord webhooks
+CREATE TABLE webhook_identity (
+    webhook_id TEXT,
+    username   TEXT,
+    puppet_id  TEXT NOT NULL,
+
+    PRIMARY KEY (webhook_id, username)
+);
@@ -0,0 +1,2 @@
+-- v18: Store per-portal typing notification overrides
+ALTER TABLE portal ADD COLUMN typing_notifications BOOLEAN;
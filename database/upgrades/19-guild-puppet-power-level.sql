@@ -0,0 +1,2 @@
+-- v19: Store per-guild default power level of puppets
+ALTER TABLE guild ADD COLUMN puppet_power_level INTEGER NOT NULL DEFAULT 0;
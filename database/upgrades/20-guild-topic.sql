@@ -0,0 +1,3 @@
+-- v20: Store the topic of guild spaces
+ALTER TABLE guild ADD COLUMN topic TEXT NOT NULL DEFAULT '';
+ALTER TABLE guild ADD COLUMN topic_set BOOLEAN NOT NULL DEFAULT false;
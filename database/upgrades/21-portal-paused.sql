@@ -0,0 +1,2 @@
+-- v21: Store whether bridging is paused in portals
+ALTER TABLE portal ADD COLUMN paused BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,3 @@
+-- v22: Store per-user Discord activity
+ALTER TABLE "user" ADD COLUMN activity_type INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE "user" ADD COLUMN activity_name TEXT;
@@ -0,0 +1,3 @@
+-- v23: Store the rules and system channels of guilds
+ALTER TABLE guild ADD COLUMN rules_channel_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE guild ADD COLUMN system_channel_id TEXT NOT NULL DEFAULT '';
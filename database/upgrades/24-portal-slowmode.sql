@@ -0,0 +1,2 @@
+-- v24: Store the slow mode interval of portals
+ALTER TABLE portal ADD COLUMN slowmode INTEGER;
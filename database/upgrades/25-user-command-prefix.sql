@@ -0,0 +1,2 @@
+-- v25: Store per-user command prefixes
+ALTER TABLE "user" ADD COLUMN command_prefix TEXT;
@@ -22,18 +22,19 @@ func (uq *UserQuery) New() *User {
 }
 
 func (uq *UserQuery) GetByMXID(userID id.UserID) *User {
-	query := `SELECT mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version FROM "user" WHERE mxid=$1`
+	query := `SELECT mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version, proxy, activity_type, activity_name, command_prefix FROM "user" WHERE mxid=$1`
 	return uq.New().Scan(uq.db.QueryRow(query, userID))
 }
 
 func (uq *UserQuery) GetByID(id string) *User {
-	query := `SELECT mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version FROM "user" WHERE dcid=$1`
+	query := `SELECT mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version, proxy, activity_type, activity_name, command_prefix FROM "user" WHERE dcid=$1`
 	return uq.New().Scan(uq.db.QueryRow(query, id))
 }
 
 func (uq *UserQuery) GetAllWithToken() []*User {
 	query := `
-		SELECT mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version
+		SELECT mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version, proxy,
+		       activity_type, activity_name, command_prefix
 		FROM "user" WHERE discord_token IS NOT NULL
 	`
 	rows, err := uq.db.Query(query)
@@ -63,11 +64,17 @@ type User struct {
 	DMSpaceRoom    id.RoomID
 
 	ReadStateVersion int
+	Proxy            string
+
+	ActivityType int
+	ActivityName string
+
+	CommandPrefix string
 }
 
 func (u *User) Scan(row dbutil.Scannable) *User {
-	var discordID, managementRoom, spaceRoom, dmSpaceRoom, discordToken sql.NullString
-	err := row.Scan(&u.MXID, &discordID, &discordToken, &managementRoom, &spaceRoom, &dmSpaceRoom, &u.ReadStateVersion)
+	var discordID, managementRoom, spaceRoom, dmSpaceRoom, discordToken, proxy, activityName, commandPrefix sql.NullString
+	err := row.Scan(&u.MXID, &discordID, &discordToken, &managementRoom, &spaceRoom, &dmSpaceRoom, &u.ReadStateVersion, &proxy, &u.ActivityType, &activityName, &commandPrefix)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			u.log.Errorln("Database scan failed:", err)
@@ -80,12 +87,15 @@ func (u *User) Scan(row dbutil.Scannable) *User {
 	u.ManagementRoom = id.RoomID(managementRoom.String)
 	u.SpaceRoom = id.RoomID(spaceRoom.String)
 	u.DMSpaceRoom = id.RoomID(dmSpaceRoom.String)
+	u.Proxy = proxy.String
+	u.ActivityName = activityName.String
+	u.CommandPrefix = commandPrefix.String
 	return u
 }
 
 func (u *User) Insert() {
-	query := `INSERT INTO "user" (mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version) VALUES ($1, $2, $3, $4, $5, $6, $7)`
-	_, err := u.db.Exec(query, u.MXID, strPtr(u.DiscordID), strPtr(u.DiscordToken), strPtr(string(u.ManagementRoom)), strPtr(string(u.SpaceRoom)), strPtr(string(u.DMSpaceRoom)), u.ReadStateVersion)
+	query := `INSERT INTO "user" (mxid, dcid, discord_token, management_room, space_room, dm_space_room, read_state_version, proxy, activity_type, activity_name, command_prefix) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+	_, err := u.db.Exec(query, u.MXID, strPtr(u.DiscordID), strPtr(u.DiscordToken), strPtr(string(u.ManagementRoom)), strPtr(string(u.SpaceRoom)), strPtr(string(u.DMSpaceRoom)), u.ReadStateVersion, strPtr(u.Proxy), u.ActivityType, strPtr(u.ActivityName), strPtr(u.CommandPrefix))
 	if err != nil {
 		u.log.Warnfln("Failed to insert %s: %v", u.MXID, err)
 		panic(err)
@@ -93,8 +103,8 @@ func (u *User) Insert() {
 }
 
 func (u *User) Update() {
-	query := `UPDATE "user" SET dcid=$1, discord_token=$2, management_room=$3, space_room=$4, dm_space_room=$5, read_state_version=$6 WHERE mxid=$7`
-	_, err := u.db.Exec(query, strPtr(u.DiscordID), strPtr(u.DiscordToken), strPtr(string(u.ManagementRoom)), strPtr(string(u.SpaceRoom)), strPtr(string(u.DMSpaceRoom)), u.ReadStateVersion, u.MXID)
+	query := `UPDATE "user" SET dcid=$1, discord_token=$2, management_room=$3, space_room=$4, dm_space_room=$5, read_state_version=$6, proxy=$7, activity_type=$8, activity_name=$9, command_prefix=$10 WHERE mxid=$11`
+	_, err := u.db.Exec(query, strPtr(u.DiscordID), strPtr(u.DiscordToken), strPtr(string(u.ManagementRoom)), strPtr(string(u.SpaceRoom)), strPtr(string(u.DMSpaceRoom)), u.ReadStateVersion, strPtr(u.Proxy), u.ActivityType, strPtr(u.ActivityName), strPtr(u.CommandPrefix), u.MXID)
 	if err != nil {
 		u.log.Warnfln("Failed to update %q: %v", u.MXID, err)
 		panic(err)
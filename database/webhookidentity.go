@@ -0,0 +1,37 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+type WebhookIdentityQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+// GetPuppetID returns the ID of the puppet used for messages sent by the webhook with the given username,
+// or an empty string if the identity hasn't been seen before.
+func (wiq *WebhookIdentityQuery) GetPuppetID(webhookID, username string) string {
+	var puppetID string
+	err := wiq.db.QueryRow("SELECT puppet_id FROM webhook_identity WHERE webhook_id=$1 AND username=$2", webhookID, username).Scan(&puppetID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		wiq.log.Errorfln("Failed to get puppet of webhook %s identity %q: %v", webhookID, username, err)
+		panic(err)
+	}
+	return puppetID
+}
+
+func (wiq *WebhookIdentityQuery) Insert(webhookID, username, puppetID string) {
+	query := `
+		INSERT INTO webhook_identity (webhook_id, username, puppet_id) VALUES ($1, $2, $3)
+		ON CONFLICT (webhook_id, username) DO UPDATE SET puppet_id=excluded.puppet_id
+	`
+	_, err := wiq.db.Exec(query, webhookID, username, puppetID)
+	if err != nil {
+		wiq.log.Warnfln("Failed to insert puppet of webhook %s identity %q: %v", webhookID, username, err)
+		panic(err)
+	}
+}
@@ -1,16 +1,159 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
 	"github.com/bwmarrin/discordgo"
 )
 
-func channelIsBridgeable(channel *discordgo.Channel) bool {
-	switch channel.Type {
-	case discordgo.ChannelTypeGuildText:
-		fallthrough
-	case discordgo.ChannelTypeGuildNews:
-		return true
+// ChannelTypeGuildForum is the channel type of forum channels, which discordgo doesn't know about yet.
+const ChannelTypeGuildForum discordgo.ChannelType = 15
+
+// StickerFormatTypeGIF is the format of GIF stickers, which discordgo doesn't know about yet.
+const StickerFormatTypeGIF discordgo.StickerFormat = 4
+
+type forumDefaultReaction struct {
+	EmojiID   string `json:"emoji_id"`
+	EmojiName string `json:"emoji_name"`
+}
+
+// forumChannel contains the forum-specific fields of a channel that are missing from discordgo.Channel.
+type forumChannel struct {
+	ID   string                `json:"id"`
+	Type discordgo.ChannelType `json:"type"`
+
+	DefaultReactionEmoji *forumDefaultReaction `json:"default_reaction_emoji"`
+	AvailableTags        []forumTag            `json:"available_tags"`
+}
+
+// DefaultReaction returns the emoji that is automatically added to new posts,
+// or nil if the forum doesn't have one configured.
+func (fc *forumChannel) DefaultReaction() *discordgo.Emoji {
+	if fc.DefaultReactionEmoji == nil || (fc.DefaultReactionEmoji.EmojiID == "" && fc.DefaultReactionEmoji.EmojiName == "") {
+		return nil
+	}
+	return &discordgo.Emoji{
+		ID:   fc.DefaultReactionEmoji.EmojiID,
+		Name: fc.DefaultReactionEmoji.EmojiName,
+	}
+}
+
+// forumChannelCacheTTL is how long fetched forum channels are reused when syncing the tags of forum posts.
+const forumChannelCacheTTL = 10 * time.Minute
+
+type cachedForumChannel struct {
+	channel *forumChannel
+	fetched time.Time
+}
+
+// getCachedForumChannel is like getForumChannel, but reuses recently fetched channels.
+// Channels that aren't forums are cached too, so that they're not fetched again for every thread update.
+func (user *User) getCachedForumChannel(channelID string) (*forumChannel, error) {
+	user.bridge.forumChannelsLock.Lock()
+	cached, ok := user.bridge.forumChannels[channelID]
+	user.bridge.forumChannelsLock.Unlock()
+	if ok && time.Since(cached.fetched) < forumChannelCacheTTL {
+		return cached.channel, nil
 	}
+	return user.getForumChannel(channelID)
+}
 
-	return false
+// getForumChannel fetches a channel from the REST API including the forum-specific fields.
+// It returns nil without an error if the channel isn't a forum.
+func (user *User) getForumChannel(channelID string) (*forumChannel, error) {
+	if user.Session == nil {
+		return nil, ErrNotConnected
+	}
+	endpoint := discordgo.EndpointChannel(channelID)
+	body, err := user.Session.RequestWithBucketID(http.MethodGet, endpoint, nil, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	var channel forumChannel
+	err = json.Unmarshal(body, &channel)
+	if err != nil {
+		return nil, err
+	}
+	cached := cachedForumChannel{fetched: time.Now()}
+	if channel.Type == ChannelTypeGuildForum {
+		cached.channel = &channel
+	}
+	user.bridge.forumChannelsLock.Lock()
+	user.bridge.forumChannels[channelID] = cached
+	user.bridge.forumChannelsLock.Unlock()
+	return cached.channel, nil
+}
+
+// channelIsBridgeable returns whether portals should be created for the guild channel when bridging the guild.
+func (br *DiscordBridge) channelIsBridgeable(channel *discordgo.Channel) bool {
+	return br.Config.Bridge.ChannelTypes.Allows(channel.Type)
+}
+
+// discordErrorCode returns the JSON error code from a Discord REST API error,
+// or -1 if the error doesn't contain one.
+func discordErrorCode(err error) int {
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Message != nil {
+		return restErr.Message.Code
+	}
+	return -1
+}
+
+// isRetriableDiscordError returns true if a failed request may succeed when sent again, i.e. it failed due to
+// a network error or a temporary server-side error rather than being rejected. Discord may have handled the request
+// anyway in those cases, so only requests that are safe to repeat should be retried, like sends with an enforced nonce.
+func isRetriableDiscordError(err error) bool {
+	var restErr *discordgo.RESTError
+	var netErr net.Error
+	if errors.As(err, &restErr) {
+		if restErr.Response == nil {
+			return false
+		}
+		switch restErr.Response.StatusCode {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		default:
+			return false
+		}
+	}
+	return errors.As(err, &netErr)
+}
+
+// messageSendWithNonce is a message send request that makes Discord return the already sent message
+// instead of creating a new one if a message with the same nonce was sent recently.
+type messageSendWithNonce struct {
+	*discordgo.MessageSend
+	EnforceNonce bool `json:"enforce_nonce,omitempty"`
+}
+
+// sendMessageEnforceNonce sends a message like ChannelMessageSendComplex, but with the nonce enforced,
+// so that retrying a send whose response was lost doesn't create duplicates.
+func sendMessageEnforceNonce(session *discordgo.Session, channelID string, sendReq *discordgo.MessageSend) (*discordgo.Message, error) {
+	endpoint := discordgo.EndpointChannelMessages(channelID)
+	data := &messageSendWithNonce{MessageSend: sendReq, EnforceNonce: sendReq.Nonce != ""}
+	var resp []byte
+	var err error
+	if len(sendReq.Files) > 0 {
+		contentType, body, encodeErr := discordgo.MultipartBodyWithJSON(data, sendReq.Files)
+		if encodeErr != nil {
+			return nil, encodeErr
+		}
+		resp, err = session.RequestWithLockedBucket(http.MethodPost, endpoint, contentType, body, session.Ratelimiter.LockBucket(endpoint), 0)
+	} else {
+		resp, err = session.RequestWithBucketID(http.MethodPost, endpoint, data, endpoint)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var msg discordgo.Message
+	if err = json.Unmarshal(resp, &msg); err != nil {
+		return nil, fmt.Errorf("%w: %v", discordgo.ErrJSONUnmarshal, err)
+	}
+	return &msg, nil
 }
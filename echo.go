@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/variationselector"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+// outgoingNonceTTL is how long to remember the nonce of a sent message while waiting for its gateway echo.
+const outgoingNonceTTL = 5 * time.Minute
+
+type outgoingNonce struct {
+	eventID id.EventID
+	expires time.Time
+}
+
+// nonceTracker remembers the nonces of messages the bridge sent to Discord, so that the
+// MESSAGE_CREATE echo can be recognized even when the author ID doesn't match the sender
+// (e.g. relay or webhook sends) or when the send request itself reported an error.
+type nonceTracker struct {
+	lock   sync.Mutex
+	nonces map[string]outgoingNonce
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+func newNonceTracker(ttl time.Duration) *nonceTracker {
+	return &nonceTracker{
+		nonces: make(map[string]outgoingNonce),
+		ttl:    ttl,
+		now:    time.Now,
+	}
+}
+
+// Add records the nonce of an outgoing message sent for the given Matrix event.
+func (nt *nonceTracker) Add(nonce string, eventID id.EventID) {
+	if nonce == "" {
+		return
+	}
+	nt.lock.Lock()
+	defer nt.lock.Unlock()
+	now := nt.now()
+	for key, item := range nt.nonces {
+		if now.After(item.expires) {
+			delete(nt.nonces, key)
+		}
+	}
+	nt.nonces[nonce] = outgoingNonce{eventID: eventID, expires: now.Add(nt.ttl)}
+}
+
+// Pop returns the Matrix event ID a nonce was sent for and forgets the nonce.
+// The second return value is false if the nonce is unknown or has expired.
+func (nt *nonceTracker) Pop(nonce string) (id.EventID, bool) {
+	if nonce == "" {
+		return "", false
+	}
+	nt.lock.Lock()
+	defer nt.lock.Unlock()
+	item, ok := nt.nonces[nonce]
+	if !ok {
+		return "", false
+	}
+	delete(nt.nonces, nonce)
+	if nt.now().After(item.expires) {
+		return "", false
+	}
+	return item.eventID, true
+}
+
+// messageCreateWithNonce is a MESSAGE_CREATE event along with its nonce, poll and attachment flags,
+// which discordgo.Message doesn't include.
+type messageCreateWithNonce struct {
+	*discordgo.MessageCreate
+	Nonce           string
+	Poll            *discordPoll
+	AttachmentFlags map[string]int
+}
+
+// parseMessageNonce extracts the nonce from a raw MESSAGE_CREATE payload.
+// Discord echoes nonces the way they were sent, which may be either a string or an integer.
+func parseMessageNonce(data json.RawMessage) string {
+	var payload struct {
+		Nonce json.RawMessage `json:"nonce"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil || len(payload.Nonce) == 0 || string(payload.Nonce) == "null" {
+		return ""
+	}
+	return strings.Trim(string(payload.Nonce), `"`)
+}
+
+func (user *User) messageCreateHandler(evt *discordgo.Event) {
+	m, ok := evt.Struct.(*discordgo.MessageCreate)
+	if !ok || m.Message == nil {
+		return
+	}
+	user.pushPortalMessage(&messageCreateWithNonce{
+		MessageCreate:   m,
+		Nonce:           parseMessageNonce(evt.RawData),
+		Poll:            parseMessagePoll(evt.RawData),
+		AttachmentFlags: parseAttachmentFlags(evt.RawData),
+	}, "message create", m.ChannelID, m.GuildID)
+}
+
+// handleOwnEcho checks whether an incoming message is the echo of a message the bridge sent.
+// If the send request didn't return the message (e.g. it timed out), the mapping is stored now.
+func (portal *Portal) handleOwnEcho(msg *discordgo.Message, nonce string, thread *Thread) bool {
+	evtID, ok := portal.outgoingNonces.Pop(nonce)
+	if !ok {
+		return false
+	} else if portal.bridge.DB.Message.GetByDiscordID(portal.Key, msg.ID) != nil {
+		return true
+	}
+	portal.log.Debugfln("Received echo %s of Matrix event %s before the send request returned (nonce %s)", msg.ID, evtID, nonce)
+	var threadID string
+	if thread != nil {
+		threadID = thread.ID
+	}
+	var attachmentID string
+	if len(msg.Attachments) > 0 {
+		attachmentID = msg.Attachments[0].ID
+	}
+	ts, _ := discordgo.SnowflakeTimestamp(msg.ID)
+	portal.markMessageHandled(msg.ID, 0, msg.Author.ID, ts, threadID, []database.MessagePart{{AttachmentID: attachmentID, MXID: evtID}})
+	return true
+}
+
+// reactionEchoKey identifies a reaction for matching Matrix-originated reactions to their gateway echo.
+// Custom emojis are identified by ID only, as the name in the echo may differ from the one used when sending.
+func reactionEchoKey(messageID, userID string, emoji *discordgo.Emoji) string {
+	emojiKey := emoji.ID
+	if emojiKey == "" {
+		emojiKey = variationselector.Remove(emoji.Name)
+	}
+	return messageID + "/" + userID + "/" + emojiKey
+}
+
+// getExistingReaction finds the database entry of a Discord reaction. Reactions sent from Matrix
+// store custom emojis in the name:id API format rather than just the ID, so both are checked.
+func (portal *Portal) getExistingReaction(messageID, userID string, emoji *discordgo.Emoji) *database.Reaction {
+	if emoji.ID == "" {
+		existing := portal.bridge.DB.Reaction.GetByDiscordID(portal.Key, messageID, userID, emoji.Name)
+		if existing == nil && variationselector.Remove(emoji.Name) != emoji.Name {
+			existing = portal.bridge.DB.Reaction.GetByDiscordID(portal.Key, messageID, userID, variationselector.Remove(emoji.Name))
+		}
+		return existing
+	}
+	existing := portal.bridge.DB.Reaction.GetByDiscordID(portal.Key, messageID, userID, emoji.ID)
+	if existing == nil && emoji.Name != "" {
+		existing = portal.bridge.DB.Reaction.GetByDiscordID(portal.Key, messageID, userID, emoji.APIName())
+	}
+	return existing
+}
+
+// handleOwnReactionEcho checks whether an incoming reaction is the echo of a reaction the bridge sent.
+// If the send request failed even though Discord applied the reaction, the mapping is stored now.
+func (portal *Portal) handleOwnReactionEcho(reaction *discordgo.MessageReaction, message *database.Message, thread *Thread) bool {
+	evtID, ok := portal.outgoingReactions.Pop(reactionEchoKey(message.DiscordID, reaction.UserID, &reaction.Emoji))
+	if !ok {
+		return false
+	}
+	portal.log.Debugfln("Received echo of Matrix reaction %s without a stored mapping", evtID)
+	dbReaction := portal.bridge.DB.Reaction.New()
+	dbReaction.Channel = portal.Key
+	dbReaction.MessageID = message.DiscordID
+	dbReaction.FirstAttachmentID = message.AttachmentID
+	dbReaction.Sender = reaction.UserID
+	dbReaction.EmojiName = reaction.Emoji.APIName()
+	dbReaction.MXID = evtID
+	if thread != nil {
+		dbReaction.ThreadID = thread.ID
+	}
+	dbReaction.Insert()
+	portal.queueReactorListUpdate(dbReaction.MessageID)
+	return true
+}
@@ -0,0 +1,104 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestNonceTrackerMatchesEcho(t *testing.T) {
+	nt := newNonceTracker(time.Minute)
+	nt.Add("1234", "$event")
+
+	evtID, ok := nt.Pop("1234")
+	assert.True(t, ok)
+	assert.Equal(t, id.EventID("$event"), evtID)
+
+	// Each nonce only suppresses a single echo
+	_, ok = nt.Pop("1234")
+	assert.False(t, ok)
+}
+
+func TestNonceTrackerIgnoresUnknownNonces(t *testing.T) {
+	nt := newNonceTracker(time.Minute)
+	nt.Add("1234", "$event")
+
+	_, ok := nt.Pop("5678")
+	assert.False(t, ok)
+	// Messages from other clients usually don't have a nonce at all
+	_, ok = nt.Pop("")
+	assert.False(t, ok)
+
+	nt.Add("", "$other")
+	_, ok = nt.Pop("")
+	assert.False(t, ok)
+}
+
+func TestNonceTrackerExpiry(t *testing.T) {
+	now := time.Now()
+	nt := newNonceTracker(time.Minute)
+	nt.now = func() time.Time { return now }
+	nt.Add("1234", "$old")
+
+	now = now.Add(2 * time.Minute)
+	_, ok := nt.Pop("1234")
+	assert.False(t, ok)
+
+	nt.Add("5678", "$new")
+	nt.Add("1111", "$newer")
+	assert.Len(t, nt.nonces, 2)
+	evtID, ok := nt.Pop("5678")
+	assert.True(t, ok)
+	assert.Equal(t, id.EventID("$new"), evtID)
+}
+
+func TestParseMessageNonce(t *testing.T) {
+	assert.Equal(t, "1046361878761046016", parseMessageNonce([]byte(`{"id":"1","nonce":"1046361878761046016"}`)))
+	assert.Equal(t, "1046361878761046016", parseMessageNonce([]byte(`{"id":"1","nonce":1046361878761046016}`)))
+	assert.Equal(t, "", parseMessageNonce([]byte(`{"id":"1","nonce":null}`)))
+	assert.Equal(t, "", parseMessageNonce([]byte(`{"id":"1"}`)))
+}
+
+func TestSelfReactionEchoIsSuppressed(t *testing.T) {
+	reactions := newNonceTracker(time.Minute)
+	// The Matrix side only knows the emoji ID of custom emojis and strips variation selectors.
+	reactions.Add(reactionEchoKey("100", "200", &discordgo.Emoji{ID: "300"}), "$custom")
+	reactions.Add(reactionEchoKey("100", "200", &discordgo.Emoji{Name: "\u2764"}), "$heart")
+
+	evtID, ok := reactions.Pop(reactionEchoKey("100", "200", &discordgo.Emoji{ID: "300", Name: "blobcat"}))
+	assert.True(t, ok)
+	assert.Equal(t, id.EventID("$custom"), evtID)
+	evtID, ok = reactions.Pop(reactionEchoKey("100", "200", &discordgo.Emoji{Name: "\u2764\ufe0f"}))
+	assert.True(t, ok)
+	assert.Equal(t, id.EventID("$heart"), evtID)
+
+	// The same reaction from another client isn't an echo once the bridge's own echo was handled.
+	_, ok = reactions.Pop(reactionEchoKey("100", "200", &discordgo.Emoji{ID: "300", Name: "blobcat"}))
+	assert.False(t, ok)
+}
+
+func TestReactionEchoKeyDistinguishesSenders(t *testing.T) {
+	emoji := &discordgo.Emoji{Name: "\U0001f44d"}
+	assert.NotEqual(t, reactionEchoKey("100", "200", emoji), reactionEchoKey("100", "201", emoji))
+	assert.NotEqual(t, reactionEchoKey("100", "200", emoji), reactionEchoKey("101", "200", emoji))
+}
@@ -0,0 +1,113 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func discordMessageLink(guildID, channelID, messageID string) string {
+	if guildID == "" {
+		guildID = "@me"
+	}
+	return fmt.Sprintf("https://discord.com/channels/%s/%s/%s", guildID, channelID, messageID)
+}
+
+func (portal *Portal) renderDiscordEmbeds(msg *discordgo.Message) string {
+	link := discordMessageLink(msg.GuildID, msg.ChannelID, msg.ID)
+	return renderEmbedsMarkdown(msg.Content, msg.Embeds, portal.bridge.Config.Bridge.EmbedFieldLimit, link)
+}
+
+// embedDuplicatesContent returns true for embeds that are just a preview of a media link
+// which is already in the message content, like the image embed Discord adds to a URL-only message.
+func embedDuplicatesContent(content string, embed *discordgo.MessageEmbed) bool {
+	switch embed.Type {
+	case discordgo.EmbedTypeImage, discordgo.EmbedTypeGifv, discordgo.EmbedTypeVideo:
+		return embed.URL != "" && strings.Contains(content, embed.URL) && embed.Title == "" && embed.Description == ""
+	default:
+		return false
+	}
+}
+
+func renderEmbedsMarkdown(content string, embeds []*discordgo.MessageEmbed, fieldLimit int, messageLink string) string {
+	rendered := make([]string, 0, len(embeds))
+	for _, embed := range embeds {
+		if embedDuplicatesContent(content, embed) {
+			continue
+		}
+		text := renderEmbedMarkdown(embed, fieldLimit, messageLink)
+		if text != "" {
+			rendered = append(rendered, text)
+		}
+	}
+	return strings.Join(rendered, "\n\n")
+}
+
+// renderEmbedMarkdown converts a Discord embed into a Discord markdown blockquote,
+// which can then be rendered the same way as normal message content.
+//
+// If fieldLimit is positive, fields past the limit are replaced with a link to the message on Discord.
+func renderEmbedMarkdown(embed *discordgo.MessageEmbed, fieldLimit int, messageLink string) string {
+	var lines []string
+	if embed.Author != nil && embed.Author.Name != "" {
+		if embed.Author.URL != "" {
+			lines = append(lines, fmt.Sprintf("[%s](%s)", escapeDiscordMarkdown(embed.Author.Name), embed.Author.URL))
+		} else {
+			lines = append(lines, escapeDiscordMarkdown(embed.Author.Name))
+		}
+	}
+	if embed.Title != "" {
+		if embed.URL != "" {
+			lines = append(lines, fmt.Sprintf("**[%s](%s)**", escapeDiscordMarkdown(embed.Title), embed.URL))
+		} else {
+			lines = append(lines, fmt.Sprintf("**%s**", escapeDiscordMarkdown(embed.Title)))
+		}
+	}
+	if embed.Description != "" {
+		lines = append(lines, strings.Split(embed.Description, "\n")...)
+	}
+	fields := embed.Fields
+	var hiddenFields int
+	if fieldLimit > 0 && len(fields) > fieldLimit {
+		hiddenFields = len(fields) - fieldLimit
+		fields = fields[:fieldLimit]
+	}
+	for _, field := range fields {
+		lines = append(lines, fmt.Sprintf("**%s**", escapeDiscordMarkdown(field.Name)))
+		lines = append(lines, strings.Split(field.Value, "\n")...)
+	}
+	if hiddenFields == 1 {
+		lines = append(lines, fmt.Sprintf("*...and 1 more field* ([view on Discord](%s))", messageLink))
+	} else if hiddenFields > 1 {
+		lines = append(lines, fmt.Sprintf("*...and %d more fields* ([view on Discord](%s))", hiddenFields, messageLink))
+	}
+	if embed.Image != nil && embed.Image.URL != "" {
+		lines = append(lines, fmt.Sprintf("[Image](%s)", embed.Image.URL))
+	} else if embed.Video != nil && embed.Video.URL != "" {
+		lines = append(lines, fmt.Sprintf("[Video](%s)", embed.Video.URL))
+	}
+	if embed.Footer != nil && embed.Footer.Text != "" {
+		lines = append(lines, fmt.Sprintf("*%s*", escapeDiscordMarkdown(embed.Footer.Text)))
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return "> " + strings.Join(lines, "\n> ")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+)
+
+const (
+	exportHistoryDefaultCount = 100
+	exportHistoryMaxCount     = 5000
+	// exportHistoryPageSize is the maximum number of messages Discord returns per request.
+	exportHistoryPageSize = 100
+)
+
+type exportedAttachment struct {
+	Filename    string `json:"filename"`
+	URL         string `json:"url"`
+	Size        int    `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+type exportedAuthor struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Bot      bool   `json:"bot,omitempty"`
+}
+
+type exportedMessage struct {
+	ID          string                `json:"id"`
+	Type        discordgo.MessageType `json:"type"`
+	Author      *exportedAuthor       `json:"author,omitempty"`
+	Timestamp   time.Time             `json:"timestamp"`
+	Edited      *time.Time            `json:"edited_timestamp,omitempty"`
+	Content     string                `json:"content"`
+	ReplyTo     string                `json:"reply_to,omitempty"`
+	Attachments []exportedAttachment  `json:"attachments,omitempty"`
+}
+
+type exportedHistory struct {
+	ChannelID  string            `json:"channel_id"`
+	GuildID    string            `json:"guild_id,omitempty"`
+	Name       string            `json:"name"`
+	ExportedAt time.Time         `json:"exported_at"`
+	Messages   []exportedMessage `json:"messages"`
+}
+
+func exportDiscordMessage(msg *discordgo.Message) exportedMessage {
+	exported := exportedMessage{
+		ID:        msg.ID,
+		Type:      msg.Type,
+		Timestamp: msg.Timestamp,
+		Edited:    msg.EditedTimestamp,
+		Content:   msg.Content,
+	}
+	if msg.Author != nil {
+		exported.Author = &exportedAuthor{
+			ID:       msg.Author.ID,
+			Username: msg.Author.String(),
+			Bot:      msg.Author.Bot,
+		}
+	}
+	if msg.MessageReference != nil {
+		exported.ReplyTo = msg.MessageReference.MessageID
+	}
+	for _, att := range msg.Attachments {
+		exported.Attachments = append(exported.Attachments, exportedAttachment{
+			Filename:    discordAttachmentFilename(att),
+			URL:         att.URL,
+			Size:        att.Size,
+			ContentType: att.ContentType,
+		})
+	}
+	return exported
+}
+
+// fetchHistory fetches up to count of the most recent messages in the channel, oldest first.
+// discordgo waits for the ratelimit bucket between pages, so large exports are just slow rather than failing.
+func (user *User) fetchHistory(channelID string, count int) ([]*discordgo.Message, error) {
+	messages := make([]*discordgo.Message, 0, count)
+	var before string
+	for len(messages) < count {
+		limit := count - len(messages)
+		if limit > exportHistoryPageSize {
+			limit = exportHistoryPageSize
+		}
+		page, err := user.Session.ChannelMessages(channelID, limit, before, "", "")
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, page...)
+		if len(page) < limit {
+			break
+		}
+		before = page[len(page)-1].ID
+	}
+	// Discord returns the newest messages first
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+var cmdExportHistory = &commands.FullHandler{
+	Func: wrapCommand(fnExportHistory),
+	Name: "export-history",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Export recent messages of the Discord channel to a JSON transcript file",
+		Args:        "[_count_]",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnExportHistory(ce *WrappedCommandEvent) {
+	count := exportHistoryDefaultCount
+	if len(ce.Args) > 0 {
+		var err error
+		count, err = strconv.Atoi(ce.Args[0])
+		if err != nil || count <= 0 {
+			ce.Reply("**Usage**: `$cmdprefix export-history [count]`")
+			return
+		} else if count > exportHistoryMaxCount {
+			ce.Reply("Can't export more than %d messages at once", exportHistoryMaxCount)
+			return
+		}
+	}
+	channelID := ce.Portal.Key.ChannelID
+	messages, err := ce.User.fetchHistory(channelID, count)
+	if err != nil && len(messages) == 0 {
+		ce.Reply("Failed to fetch messages: %v", err)
+		return
+	} else if err != nil {
+		ce.Reply("Failed to fetch all messages, exporting the %d that were fetched: %v", len(messages), err)
+	}
+	history := exportedHistory{
+		ChannelID:  channelID,
+		GuildID:    ce.Portal.GuildID,
+		Name:       ce.Portal.Name,
+		ExportedAt: time.Now().UTC(),
+		Messages:   make([]exportedMessage, len(messages)),
+	}
+	for i, msg := range messages {
+		history.Messages[i] = exportDiscordMessage(msg)
+	}
+	data, err := json.MarshalIndent(&history, "", "  ")
+	if err != nil {
+		ce.Reply("Failed to serialize transcript: %v", err)
+		return
+	}
+	fileName := fmt.Sprintf("discord-%s-%s.json", channelID, history.ExportedAt.Format("20060102-150405"))
+	content := &event.MessageEventContent{
+		MsgType:  event.MsgFile,
+		Body:     fileName,
+		FileName: fileName,
+		Info:     &event.FileInfo{MimeType: "application/json"},
+	}
+	intent := ce.Portal.MainIntent()
+	err = ce.Portal.uploadMatrixAttachment(intent, data, content)
+	if err != nil {
+		ce.Reply("Failed to upload transcript: %v", err)
+		return
+	}
+	_, err = ce.Portal.sendMatrixMessage(intent, event.EventMessage, content, nil, 0)
+	if err != nil {
+		ce.Reply("Failed to send transcript: %v", err)
+	}
+}
@@ -27,12 +27,75 @@ import (
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/format/mdext"
+
+	"go.mau.fi/mautrix-discord/database"
 )
 
 var discordExtensions = goldmark.WithExtensions(mdext.EscapeHTML, mdext.SimpleSpoiler, mdext.DiscordUnderline)
 var escapeFixer = regexp.MustCompile(`\\(__[^_]|\*\*[^*])`)
 
+var codeBlockRegex = regexp.MustCompile("(?s)```.*?```|`[^`]*`")
+var urlMarkdownEscaper = strings.NewReplacer(
+	`*`, `\*`,
+	`_`, `\_`,
+	`~`, `\~`,
+	`|`, `\|`,
+)
+
+const markdownDelimiters = "*_~|"
+
+// linkEnd finds where a link matched by discordLinkRegex really ends. Formatting delimiters at the end of
+// the match close formatting that was opened before the link, like in **https://example.com**, so they're
+// not a part of the link if the same delimiters appear earlier in the text.
+func linkEnd(text string, start, end int) int {
+	trailingStart := end
+	for trailingStart > start && strings.IndexByte(markdownDelimiters, text[trailingStart-1]) != -1 {
+		trailingStart--
+	}
+	for ; trailingStart < end; trailingStart++ {
+		closing := []byte(text[trailingStart:end])
+		for i, j := 0, len(closing)-1; i < j; i, j = i+1, j-1 {
+			closing[i], closing[j] = closing[j], closing[i]
+		}
+		if strings.Contains(text[:start], string(closing)) {
+			return trailingStart
+		}
+	}
+	return end
+}
+
+// escapeMarkdownInURLs escapes markdown characters inside plain links, because Discord
+// doesn't apply formatting inside URLs. Links inside code blocks are left alone.
+func escapeMarkdownInURLs(text string) string {
+	links := discordLinkRegex.FindAllStringIndex(text, -1)
+	if links == nil {
+		return text
+	}
+	code := codeBlockRegex.FindAllStringIndex(text, -1)
+	var builder strings.Builder
+	offset := 0
+	for _, link := range links {
+		inCode := false
+		for _, block := range code {
+			if link[0] >= block[0] && link[0] < block[1] {
+				inCode = true
+				break
+			}
+		}
+		if inCode {
+			continue
+		}
+		end := linkEnd(text, link[0], link[1])
+		builder.WriteString(text[offset:link[0]])
+		builder.WriteString(urlMarkdownEscaper.Replace(text[link[0]:end]))
+		offset = end
+	}
+	builder.WriteString(text[offset:])
+	return builder.String()
+}
+
 func (portal *Portal) renderDiscordMarkdown(text string) event.MessageEventContent {
+	text = escapeMarkdownInURLs(text)
 	text = escapeFixer.ReplaceAllStringFunc(text, func(s string) string {
 		return s[:2] + `\` + s[2:]
 	})
@@ -71,16 +134,22 @@ func pillConverter(displayname, mxid, eventID string, ctx format.Context) string
 				//	// TODO is mentioning private channels possible at all?
 				//}
 			} else if msg := user.bridge.DB.Message.GetByMXID(portal.Key, id.EventID(eventID)); msg != nil {
-				guildID := portal.GuildID
-				if guildID == "" {
-					guildID = "@me"
-				}
-				return fmt.Sprintf("https://discord.com/channels/%s/%s/%s", guildID, msg.DiscordProtoChannelID(), msg.DiscordID)
+				return user.bridge.discordMessageLink(msg)
+			}
+		}
+		if eventID != "" {
+			// The event may have been bridged in a different portal than the room it was linked with,
+			// e.g. a thread bridged as its own room.
+			if msg := user.bridge.DB.Message.GetByMXIDInAnyChannel(id.EventID(eventID)); msg != nil {
+				return user.bridge.discordMessageLink(msg)
 			}
 		}
 	} else if mxid[0] == '@' {
 		parsedID, ok := user.bridge.ParsePuppetMXID(id.UserID(mxid))
-		if ok {
+		if ok && isWebhookIdentityPuppetID(parsedID) {
+			// Webhooks can't be mentioned
+			return displayname
+		} else if ok {
 			return fmt.Sprintf("<@%s>", parsedID)
 		}
 		mentionedUser := user.bridge.GetUserByMXID(id.UserID(mxid))
@@ -91,6 +160,16 @@ func pillConverter(displayname, mxid, eventID string, ctx format.Context) string
 	return displayname
 }
 
+// discordMessageLink makes a Discord permalink to a bridged message. The guild ID is looked up from the
+// portal the message was bridged in, as it may be different from the guild of the current portal.
+func (br *DiscordBridge) discordMessageLink(msg *database.Message) string {
+	guildID := "@me"
+	if msgPortal := br.GetExistingPortalByID(msg.Channel); msgPortal != nil && msgPortal.GuildID != "" {
+		guildID = msgPortal.GuildID
+	}
+	return fmt.Sprintf("https://discord.com/channels/%s/%s/%s", guildID, msg.DiscordProtoChannelID(), msg.DiscordID)
+}
+
 // Discord links start with http:// or https://, contain at least two characters afterwards,
 // don't contain < or whitespace anywhere, and don't end with "'),.:;]
 //
@@ -19,6 +19,7 @@ package main
 import (
 	"testing"
 
+	"github.com/bwmarrin/discordgo"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -55,3 +56,50 @@ func TestEscapeDiscordMarkdown(t *testing.T) {
 		})
 	}
 }
+
+func TestRenderURLOnlyMessage(t *testing.T) {
+	const url = "https://cdn.example.com/some_image_name*1*.png"
+	embeds := []*discordgo.MessageEmbed{{
+		Type: discordgo.EmbedTypeImage,
+		URL:  url,
+		Thumbnail: &discordgo.MessageEmbedThumbnail{
+			URL: url,
+		},
+	}}
+
+	assert.Equal(t, "", renderEmbedsMarkdown(url, embeds, 10, "https://discord.com/channels/1/2/3"))
+
+	portal := &Portal{}
+	content := portal.renderDiscordMarkdown(url)
+	assert.Equal(t, url, content.Body)
+	assert.Equal(t, "", content.FormattedBody)
+}
+
+func TestRenderFormattedLinks(t *testing.T) {
+	type linkTest struct {
+		name     string
+		input    string
+		expected string
+	}
+
+	tests := []linkTest{
+		{"Bold", "**https://example.com**", "<strong>https://example.com</strong>"},
+		{"Bold with text", "**see https://example.com/a_b**", "<strong>see https://example.com/a_b</strong>"},
+		{"Italic", "*https://example.com*", "<em>https://example.com</em>"},
+		{"Strikethrough", "~~https://example.com~~", "<del>https://example.com</del>"},
+		{"Spoiler", "||https://example.com||", "<span data-mx-spoiler>https://example.com</span>"},
+	}
+
+	portal := &Portal{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content := portal.renderDiscordMarkdown(test.input)
+			assert.Equal(t, test.expected, content.FormattedBody)
+			assert.Contains(t, content.Body, "https://example.com")
+		})
+	}
+}
+
+func TestEscapeMarkdownInURLsKeepsTrailingCharacters(t *testing.T) {
+	assert.Equal(t, `https://a\_b\_c/\*def\*`, escapeMarkdownInURLs("https://a_b_c/*def*"))
+}
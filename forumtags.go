@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+)
+
+// StateForumTags is the state event that contains the tags applied to a bridged forum post.
+var StateForumTags = event.Type{Type: "fi.mau.discord.forum_tags", Class: event.StateEventType}
+
+// maxAppliedForumTags is the maximum number of tags Discord allows on a single forum post.
+const maxAppliedForumTags = 5
+
+type forumTag struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Moderated bool   `json:"moderated"`
+	EmojiID   string `json:"emoji_id"`
+	EmojiName string `json:"emoji_name"`
+}
+
+// forumPost contains the forum-specific fields of a thread that are missing from discordgo.Channel.
+type forumPost struct {
+	ID          string   `json:"id"`
+	GuildID     string   `json:"guild_id"`
+	ParentID    string   `json:"parent_id"`
+	OwnerID     string   `json:"owner_id"`
+	AppliedTags []string `json:"applied_tags"`
+}
+
+type ForumTagInfo struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Emoji string `json:"emoji,omitempty"`
+}
+
+type ForumTagsEventContent struct {
+	Tags []ForumTagInfo `json:"tags"`
+	// The emoji Discord clients add to new posts of the forum. Custom emojis are shown by name.
+	DefaultReaction string `json:"default_reaction,omitempty"`
+}
+
+func (user *User) getForumPost(threadID string) (*forumPost, error) {
+	if user.Session == nil {
+		return nil, ErrNotConnected
+	}
+	endpoint := discordgo.EndpointChannel(threadID)
+	body, err := user.Session.RequestWithBucketID(http.MethodGet, endpoint, nil, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	var post forumPost
+	err = json.Unmarshal(body, &post)
+	return &post, err
+}
+
+// findForumTag finds an available tag of the forum by ID or case-insensitive name.
+func (fc *forumChannel) findForumTag(query string) *forumTag {
+	for i, tag := range fc.AvailableTags {
+		if tag.ID == query || strings.EqualFold(tag.Name, query) {
+			return &fc.AvailableTags[i]
+		}
+	}
+	return nil
+}
+
+func (fc *forumChannel) describeTags(tagIDs []string) []ForumTagInfo {
+	tags := make([]ForumTagInfo, 0, len(tagIDs))
+	for _, tagID := range tagIDs {
+		info := ForumTagInfo{ID: tagID}
+		if tag := fc.findForumTag(tagID); tag != nil {
+			info.Name = tag.Name
+			if tag.EmojiID == "" {
+				info.Emoji = tag.EmojiName
+			}
+		}
+		tags = append(tags, info)
+	}
+	return tags
+}
+
+func (fc *forumChannel) describeDefaultReaction() string {
+	emoji := fc.DefaultReaction()
+	if emoji == nil {
+		return ""
+	} else if emoji.ID != "" {
+		return fmt.Sprintf(":%s:", emoji.Name)
+	}
+	return emoji.Name
+}
+
+// isForumChannel checks whether a channel is a forum, preferring the gateway state cache over fetching the channel.
+func (user *User) isForumChannel(channelID string) bool {
+	if user.Session != nil {
+		if channel, err := user.Session.State.Channel(channelID); err == nil {
+			return channel.Type == ChannelTypeGuildForum
+		}
+	}
+	forum, err := user.getCachedForumChannel(channelID)
+	return err == nil && forum != nil
+}
+
+// syncForumTags updates the forum tag state event of a forum post portal, which also shows the default reaction
+// of the forum. The forum is fetched outside the message loop, but the state event is sent from the loop, where
+// it's compared to the last one sent so that every logged-in user receiving the same update doesn't cause another
+// state event.
+func (portal *Portal) syncForumTags(source *User, parentID string, tagIDs []string) error {
+	if portal.MXID == "" || parentID == "" {
+		return nil
+	}
+	forum, err := source.getCachedForumChannel(parentID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch forum channel: %w", err)
+	} else if forum == nil {
+		return nil
+	}
+	content := &ForumTagsEventContent{Tags: forum.describeTags(tagIDs), DefaultReaction: forum.describeDefaultReaction()}
+	portal.runInLoop(func() {
+		if portal.forumTags != nil && reflect.DeepEqual(portal.forumTags, content) {
+			return
+		}
+		_, err := portal.MainIntent().SendStateEvent(portal.MXID, StateForumTags, "", content)
+		if err != nil {
+			portal.log.Warnfln("Failed to send forum tags: %v", err)
+		} else {
+			portal.forumTags = content
+		}
+	})
+	return nil
+}
+
+// threadUpdateHandler syncs the applied tags of bridged forum posts from raw THREAD_UPDATE events,
+// as discordgo.Channel doesn't include them. The activity counts in the topic are updated too.
+func (user *User) threadUpdateHandler(evt *discordgo.Event) {
+	var post forumPost
+	if err := json.Unmarshal(evt.RawData, &post); err != nil {
+		user.log.Warnln("Failed to parse thread update:", err)
+		return
+	}
+	portal := user.GetExistingPortalByID(post.ID)
+	if portal == nil || portal.MXID == "" {
+		return
+	}
+	if post.ParentID != "" && user.isForumChannel(post.ParentID) {
+		if err := portal.syncForumTags(user, post.ParentID, post.AppliedTags); err != nil {
+			portal.log.Warnfln("Failed to sync forum tags: %v", err)
+		}
+	}
+	var meta discordgo.Channel
+	if err := json.Unmarshal(evt.RawData, &meta); err != nil {
+		user.log.Warnln("Failed to parse thread update:", err)
+	} else {
+		portal.queueThreadStats(&meta)
+	}
+}
+
+var cmdSetForumTags = &commands.FullHandler{
+	Func: wrapCommand(fnSetForumTags),
+	Name: "set-forum-tags",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Set the tags of the forum post bridged to this room. Tag names with spaces must be separated by commas",
+		Args:        "<_tag_>[, _tag_...]/--clear",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnSetForumTags(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		ce.Reply("**Usage**: `$cmdprefix set-forum-tags <tag>[, tag...]` or `$cmdprefix set-forum-tags --clear`")
+		return
+	}
+	post, err := ce.User.getForumPost(ce.Portal.Key.ChannelID)
+	if err != nil {
+		ce.Reply("Failed to fetch channel info: %v", err)
+		return
+	}
+	forum, err := ce.User.getForumChannel(post.ParentID)
+	if err != nil {
+		ce.Reply("Failed to fetch forum info: %v", err)
+		return
+	} else if forum == nil {
+		ce.Reply("This room isn't a forum post")
+		return
+	}
+	tagIDs := make([]string, 0)
+	needsModerator := false
+	if ce.Args[0] != "--clear" {
+		for _, query := range strings.Split(strings.Join(ce.Args, " "), ",") {
+			query = strings.TrimSpace(query)
+			if query == "" {
+				continue
+			}
+			tag := forum.findForumTag(query)
+			if tag == nil {
+				ce.Reply("The forum doesn't have a tag called %s", query)
+				return
+			}
+			needsModerator = needsModerator || tag.Moderated
+			tagIDs = append(tagIDs, tag.ID)
+		}
+		if len(tagIDs) > maxAppliedForumTags {
+			ce.Reply("Forum posts can have at most %d tags", maxAppliedForumTags)
+			return
+		}
+	}
+	if needsModerator || post.OwnerID != ce.User.DiscordID {
+		allowed, err := ce.Portal.userHasPermission(ce.User, discordgo.PermissionManageThreads)
+		if err != nil {
+			ce.Reply("Failed to check your permissions: %v", err)
+			return
+		} else if !allowed {
+			ce.Reply("You need the Manage Threads permission to change tags of this post")
+			return
+		}
+	}
+	_, err = ce.Portal.editDiscordChannel(ce.User, map[string]interface{}{
+		"applied_tags": tagIDs,
+	})
+	if err != nil {
+		ce.Reply("Failed to set tags: %v", err)
+		return
+	}
+	err = ce.Portal.syncForumTags(ce.User, post.ParentID, tagIDs)
+	if err != nil {
+		ce.Log.Warnfln("Failed to sync forum tags after setting them: %v", err)
+	}
+	if len(tagIDs) == 0 {
+		ce.Reply("Removed all tags from the post")
+	} else {
+		ce.Reply("Updated the tags of the post")
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+// Relationship types used by the Discord relationships API.
+const (
+	relationshipFriend          = 1
+	relationshipIncomingRequest = 3
+	relationshipOutgoingRequest = 4
+)
+
+var errBotAccount = errors.New("bot accounts don't have friends")
+
+func (user *User) isBotAccount() bool {
+	return user.Session != nil && user.Session.State.User != nil && user.Session.State.User.Bot
+}
+
+func (user *User) setFriendPresences(presences []*discordgo.Presence) {
+	user.friendPresencesLock.Lock()
+	defer user.friendPresencesLock.Unlock()
+	for _, presence := range presences {
+		if presence.User != nil {
+			user.friendPresences[presence.User.ID] = presence.Status
+		}
+	}
+}
+
+func (user *User) friendStatus(userID string) discordgo.Status {
+	user.friendPresencesLock.Lock()
+	defer user.friendPresencesLock.Unlock()
+	status, ok := user.friendPresences[userID]
+	if !ok {
+		return discordgo.StatusOffline
+	}
+	return status
+}
+
+// presenceUpdateHandler tracks the online status of friends, which is sent without a guild ID.
+func (user *User) presenceUpdateHandler(_ *discordgo.Session, p *discordgo.PresenceUpdate) {
+	if p.GuildID == "" {
+		user.setFriendPresences([]*discordgo.Presence{&p.Presence})
+	}
+}
+
+func (user *User) relationshipAddHandler(_ *discordgo.Session, r *discordgo.RelationshipAdd) {
+	if r.Relationship == nil || r.Type != relationshipIncomingRequest || r.User == nil {
+		return
+	} else if !user.bridge.Config.Bridge.FriendRequestNotices || user.ManagementRoom == "" {
+		return
+	}
+	text := fmt.Sprintf("Incoming friend request from %s (`%s`). Use `%s accept-friend %s` or `%s ignore-friend %s` to respond.",
+		r.User.String(), r.User.ID, user.bridge.Config.Bridge.CommandPrefix, r.User.ID, user.bridge.Config.Bridge.CommandPrefix, r.User.ID)
+	content := format.RenderMarkdown(text, true, false)
+	content.MsgType = event.MsgNotice
+	_, err := user.bridge.Bot.SendMessageEvent(user.ManagementRoom, event.EventMessage, &content)
+	if err != nil {
+		user.log.Warnfln("Failed to send friend request notice for %s: %v", r.User.ID, err)
+	}
+}
+
+func (user *User) getRelationships() ([]*discordgo.Relationship, error) {
+	if user.Session == nil {
+		return nil, ErrNotConnected
+	} else if user.isBotAccount() {
+		return nil, errBotAccount
+	}
+	return user.Session.RelationshipsGet()
+}
+
+// findIncomingFriendRequest checks that the user has a pending friend request from the given Discord user.
+func (user *User) findIncomingFriendRequest(userID string) (*discordgo.Relationship, error) {
+	relationships, err := user.getRelationships()
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range relationships {
+		if rel.ID == userID && rel.Type == relationshipIncomingRequest {
+			return rel, nil
+		}
+	}
+	return nil, nil
+}
+
+var cmdFriends = &commands.FullHandler{
+	Func: wrapCommand(fnFriends),
+	Name: "friends",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "List your Discord friends and pending friend requests, or open a DM with a friend",
+		Args:        "[dm <_user ID_>]",
+	},
+	RequiresLogin: true,
+}
+
+var friendStatusOrder = map[discordgo.Status]int{
+	discordgo.StatusOnline:       0,
+	discordgo.StatusIdle:         1,
+	discordgo.StatusDoNotDisturb: 2,
+	discordgo.StatusOffline:      3,
+}
+
+func fnFriends(ce *WrappedCommandEvent) {
+	if len(ce.Args) > 0 {
+		if strings.ToLower(ce.Args[0]) == "dm" && len(ce.Args) == 2 {
+			fnFriendDM(ce, ce.Args[1])
+		} else {
+			ce.Reply("**Usage**: `$cmdprefix friends [dm <user ID>]`")
+		}
+		return
+	}
+	relationships, err := ce.User.getRelationships()
+	if err != nil {
+		ce.Reply("Failed to get friends: %v", err)
+		return
+	}
+	var friends, incoming, outgoing []*discordgo.Relationship
+	for _, rel := range relationships {
+		if rel.User == nil {
+			continue
+		}
+		switch rel.Type {
+		case relationshipFriend:
+			friends = append(friends, rel)
+		case relationshipIncomingRequest:
+			incoming = append(incoming, rel)
+		case relationshipOutgoingRequest:
+			outgoing = append(outgoing, rel)
+		}
+	}
+	sort.SliceStable(friends, func(i, j int) bool {
+		return friendStatusOrder[ce.User.friendStatus(friends[i].ID)] < friendStatusOrder[ce.User.friendStatus(friends[j].ID)]
+	})
+	var output strings.Builder
+	if len(friends) == 0 {
+		output.WriteString("You don't have any friends on Discord\n")
+	} else {
+		output.WriteString("Friends:\n\n")
+		for _, rel := range friends {
+			_, _ = fmt.Fprintf(&output, "* %s (`%s`) - %s\n", rel.User.String(), rel.ID, ce.User.friendStatus(rel.ID))
+		}
+		output.WriteString("\nUse `$cmdprefix friends dm <user ID>` to open a DM with a friend.\n")
+	}
+	if len(incoming) > 0 {
+		output.WriteString("\nIncoming friend requests:\n\n")
+		for _, rel := range incoming {
+			_, _ = fmt.Fprintf(&output, "* %s (`%s`)\n", rel.User.String(), rel.ID)
+		}
+		output.WriteString("\nUse `$cmdprefix accept-friend <user ID>` or `$cmdprefix ignore-friend <user ID>` to respond.\n")
+	}
+	if len(outgoing) > 0 {
+		output.WriteString("\nSent friend requests:\n\n")
+		for _, rel := range outgoing {
+			_, _ = fmt.Fprintf(&output, "* %s (`%s`)\n", rel.User.String(), rel.ID)
+		}
+	}
+	ce.Reply("%s", output.String())
+}
+
+func fnFriendDM(ce *WrappedCommandEvent, userID string) {
+	session := ce.User.Session
+	if session == nil {
+		ce.Reply("You're not connected to Discord")
+		return
+	} else if ce.User.isBotAccount() {
+		ce.Reply("%v", errBotAccount)
+		return
+	}
+	channel, err := session.UserChannelCreate(userID)
+	if err != nil {
+		ce.Reply("Failed to open DM channel: %v", err)
+		return
+	}
+	portal := ce.User.GetPortalByMeta(channel)
+	if portal.MXID == "" {
+		err = portal.CreateMatrixRoom(ce.User, channel)
+		if err != nil {
+			ce.Reply("Failed to create DM room: %v", err)
+			return
+		}
+	} else {
+		ce.User.ensureInvited(portal.MainIntent(), portal.MXID, true)
+	}
+	ce.Reply("Opened DM: [%s](%s)", portal.Name, portal.MXID.URI(ce.Bridge.AS.HomeserverDomain).MatrixToURL())
+}
+
+var cmdAcceptFriend = &commands.FullHandler{
+	Func: wrapCommand(fnAcceptFriend),
+	Name: "accept-friend",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Accept an incoming Discord friend request",
+		Args:        "<_user ID_>",
+	},
+	RequiresLogin: true,
+}
+
+func fnAcceptFriend(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix accept-friend <user ID>`")
+		return
+	}
+	rel, err := ce.User.findIncomingFriendRequest(ce.Args[0])
+	if err != nil {
+		ce.Reply("Failed to get friend requests: %v", err)
+		return
+	} else if rel == nil {
+		ce.Reply("You don't have a friend request from that user")
+		return
+	}
+	err = ce.User.Session.RelationshipFriendRequestAccept(rel.ID)
+	if err != nil {
+		ce.Reply("Failed to accept friend request: %v", err)
+	} else {
+		ce.Reply("Accepted friend request from %s", rel.User.String())
+	}
+}
+
+var cmdIgnoreFriend = &commands.FullHandler{
+	Func: wrapCommand(fnIgnoreFriend),
+	Name: "ignore-friend",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Ignore an incoming Discord friend request",
+		Args:        "<_user ID_>",
+	},
+	RequiresLogin: true,
+}
+
+func fnIgnoreFriend(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix ignore-friend <user ID>`")
+		return
+	}
+	rel, err := ce.User.findIncomingFriendRequest(ce.Args[0])
+	if err != nil {
+		ce.Reply("Failed to get friend requests: %v", err)
+		return
+	} else if rel == nil {
+		ce.Reply("You don't have a friend request from that user")
+		return
+	}
+	err = ce.User.Session.RelationshipDelete(rel.ID)
+	if err != nil {
+		ce.Reply("Failed to ignore friend request: %v", err)
+	} else {
+		ce.Reply("Ignored friend request from %s", rel.User.String())
+	}
+}
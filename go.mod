@@ -11,6 +11,7 @@ require (
 	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/stretchr/testify v1.8.1
 	github.com/yuin/goldmark v1.5.3
+	gopkg.in/yaml.v3 v3.0.1
 	maunium.net/go/maulogger/v2 v2.3.2
 	maunium.net/go/mautrix v0.12.4-0.20221202220300-b00e31daa1d3
 )
@@ -28,7 +29,6 @@ require (
 	golang.org/x/crypto v0.2.0 // indirect
 	golang.org/x/net v0.2.0 // indirect
 	golang.org/x/sys v0.2.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 	maunium.net/go/mauflag v1.0.0 // indirect
 )
 
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util"
+)
+
+// guildMemberFetchTimeout is how long to wait for all GUILD_MEMBERS_CHUNK events of a single request.
+const guildMemberFetchTimeout = 2 * time.Minute
+
+type guildMemberRequest struct {
+	guildID    string
+	members    []*discordgo.Member
+	received   int
+	chunkCount int
+	done       chan struct{}
+}
+
+// fetchGuildMembers requests the full member list of a guild over the gateway
+// and waits until every chunk matching the request nonce has arrived.
+func (user *User) fetchGuildMembers(guildID string) ([]*discordgo.Member, error) {
+	req, err := user.requestGuildMembers(guildID)
+	if err != nil {
+		return nil, err
+	}
+	return req.members, nil
+}
+
+// requestGuildMembers is like fetchGuildMembers, but returns the request so that the chunk counts can be inspected.
+// If the request times out, the chunks received so far are returned along with the error.
+func (user *User) requestGuildMembers(guildID string) (*guildMemberRequest, error) {
+	session := user.Session
+	if session == nil {
+		return nil, ErrNotConnected
+	}
+	nonce := util.RandomString(16)
+	req := &guildMemberRequest{
+		guildID: guildID,
+		done:    make(chan struct{}),
+	}
+	user.memberRequestsLock.Lock()
+	user.memberRequests[nonce] = req
+	user.memberRequestsLock.Unlock()
+	defer func() {
+		user.memberRequestsLock.Lock()
+		delete(user.memberRequests, nonce)
+		user.memberRequestsLock.Unlock()
+	}()
+
+	err := session.RequestGuildMembers(guildID, "", 0, nonce, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request guild members: %w", err)
+	}
+	select {
+	case <-req.done:
+		return req, nil
+	case <-time.After(guildMemberFetchTimeout):
+		user.memberRequestsLock.Lock()
+		defer user.memberRequestsLock.Unlock()
+		// Stop accepting chunks so that the partial result can be read safely
+		delete(user.memberRequests, nonce)
+		return req, fmt.Errorf("timed out after receiving %d member chunks", req.received)
+	}
+}
+
+func (user *User) guildMembersChunkHandler(_ *discordgo.Session, c *discordgo.GuildMembersChunk) {
+	user.memberRequestsLock.Lock()
+	defer user.memberRequestsLock.Unlock()
+	req, ok := user.memberRequests[c.Nonce]
+	if !ok || req.guildID != c.GuildID {
+		user.log.Debugfln("Ignoring member chunk %d/%d for %s with unknown nonce %q", c.ChunkIndex+1, c.ChunkCount, c.GuildID, c.Nonce)
+		return
+	}
+	req.members = append(req.members, c.Members...)
+	req.received++
+	req.chunkCount = c.ChunkCount
+	user.log.Debugfln("Received member chunk %d/%d for %s (%d members)", c.ChunkIndex+1, c.ChunkCount, c.GuildID, len(c.Members))
+	// Chunks may arrive in any order, so count them instead of looking at the index
+	if req.received >= c.ChunkCount {
+		close(req.done)
+		delete(user.memberRequests, c.Nonce)
+	}
+}
+
+// syncGuildMembers fetches the complete member list of a guild and makes the
+// guild space membership match it.
+func (user *User) syncGuildMembers(guild *Guild) error {
+	if guild.MXID == "" {
+		return fmt.Errorf("guild space doesn't exist")
+	}
+	members, err := user.fetchGuildMembers(guild.ID)
+	if err != nil {
+		return err
+	}
+	user.log.Debugfln("Fetched %d members of %s, syncing space membership", len(members), guild.ID)
+
+	expected := make(map[id.UserID]struct{}, len(members))
+	for _, member := range members {
+		if member.User == nil {
+			continue
+		}
+		puppet := user.bridge.GetPuppetByID(member.User.ID)
+		puppet.UpdateInfo(user, member.User)
+		expected[puppet.MXID] = struct{}{}
+		err = puppet.DefaultIntent().EnsureJoined(guild.MXID)
+		if err != nil {
+			user.log.Warnfln("Failed to join %s to guild space %s: %v", puppet.MXID, guild.ID, err)
+		}
+	}
+
+	joined, err := user.bridge.Bot.JoinedMembers(guild.MXID)
+	if err != nil {
+		return fmt.Errorf("failed to get space members: %w", err)
+	}
+	for userID := range joined.Joined {
+		if _, ok := expected[userID]; ok {
+			continue
+		}
+		puppet := user.bridge.GetPuppetByMXID(userID)
+		if puppet == nil {
+			continue
+		}
+		_, err = puppet.DefaultIntent().LeaveRoom(guild.MXID)
+		if err != nil {
+			user.log.Warnfln("Failed to remove %s from guild space %s: %v", userID, guild.ID, err)
+		}
+	}
+	return nil
+}
+
+var cmdFetchMembers = &commands.FullHandler{
+	Func: wrapCommand(fnFetchMembers),
+	Name: "fetch-members",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Fetch the full member list of a guild over the gateway and report how long it took",
+		Args:        "<_guild ID_>",
+	},
+	RequiresAdmin: true,
+	RequiresLogin: true,
+}
+
+func fnFetchMembers(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix fetch-members <guild ID>`")
+		return
+	}
+	if ce.User.Session == nil {
+		ce.Reply("You're not connected to Discord")
+		return
+	}
+	guildID := ce.Args[0]
+	discordGuild, err := ce.User.Session.State.Guild(guildID)
+	if err != nil {
+		ce.Reply("You're not in a guild with that ID")
+		return
+	}
+	start := time.Now()
+	req, err := ce.User.requestGuildMembers(guildID)
+	duration := time.Since(start).Round(time.Millisecond)
+	if req == nil {
+		ce.Reply("Failed to fetch members: %v", err)
+		return
+	}
+	completeness := "complete"
+	if req.received < req.chunkCount || req.chunkCount == 0 {
+		completeness = "incomplete"
+	}
+	reply := fmt.Sprintf("Fetched %d members of %s in %s from %d/%d chunks (%s)",
+		len(req.members), guildID, duration, req.received, req.chunkCount, completeness)
+	if discordGuild.MemberCount > 0 {
+		reply += fmt.Sprintf(", Discord reports %d members in total", discordGuild.MemberCount)
+	}
+	if err != nil {
+		reply += fmt.Sprintf(".\n\nThe request %v. Fetching members requires the server members intent, which "+
+			"Discord may not grant for large guilds", err)
+	}
+	ce.Reply("%s", reply)
+}
@@ -0,0 +1,56 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	log "maunium.net/go/maulogger/v2"
+)
+
+func TestGuildMembersChunksInAnyOrder(t *testing.T) {
+	user := &User{log: log.Sub("User"), memberRequests: make(map[string]*guildMemberRequest)}
+	req := &guildMemberRequest{guildID: "guild", done: make(chan struct{})}
+	user.memberRequests["nonce"] = req
+
+	var wg sync.WaitGroup
+	for _, index := range []int{2, 0, 1} {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			user.guildMembersChunkHandler(nil, &discordgo.GuildMembersChunk{
+				GuildID:    "guild",
+				Nonce:      "nonce",
+				ChunkIndex: index,
+				ChunkCount: 3,
+				Members:    []*discordgo.Member{{User: &discordgo.User{ID: fmt.Sprint(index)}}},
+			})
+		}(index)
+	}
+	// Chunks for other requests are ignored
+	user.guildMembersChunkHandler(nil, &discordgo.GuildMembersChunk{GuildID: "guild", Nonce: "other", ChunkCount: 1})
+	wg.Wait()
+
+	<-req.done
+	assert.Len(t, req.members, 3)
+	assert.Equal(t, 3, req.received)
+	assert.NotContains(t, user.memberRequests, "nonce")
+}
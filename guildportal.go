@@ -18,7 +18,9 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	log "maunium.net/go/maulogger/v2"
 
@@ -181,6 +183,14 @@ func (guild *Guild) CreateMatrixRoom(user *User, meta *discordgo.Guild) error {
 		StateKey: &bridgeInfoStateKey,
 	}}
 
+	if guild.Topic != "" {
+		initialState = append(initialState, &event.Event{
+			Type: event.StateTopic,
+			Content: event.Content{Parsed: &event.TopicEventContent{
+				Topic: guild.Topic,
+			}},
+		})
+	}
 	if !guild.AvatarURL.IsEmpty() {
 		initialState = append(initialState, &event.Event{
 			Type: event.StateRoomAvatar,
@@ -212,6 +222,7 @@ func (guild *Guild) CreateMatrixRoom(user *User, meta *discordgo.Guild) error {
 	guild.MXID = resp.RoomID
 	guild.NameSet = true
 	guild.AvatarSet = !guild.AvatarURL.IsEmpty()
+	guild.TopicSet = guild.Topic != ""
 	guild.Update()
 	guild.bridge.guildsLock.Lock()
 	guild.bridge.guildsByMXID[guild.MXID] = guild
@@ -230,6 +241,8 @@ func (guild *Guild) UpdateInfo(source *User, meta *discordgo.Guild) *discordgo.G
 	changed := false
 	changed = guild.UpdateName(meta) || changed
 	changed = guild.UpdateAvatar(meta.Icon) || changed
+	changed = guild.UpdateTopic(meta) || changed
+	changed = guild.UpdateChannelDesignations(source, meta) || changed
 	if changed {
 		guild.UpdateBridgeInfo()
 		guild.Update()
@@ -285,3 +298,165 @@ func (guild *Guild) UpdateAvatar(iconID string) bool {
 	}
 	return true
 }
+
+// guildBoostStatus describes the Server Boost level of a guild, or returns an empty string if it has no boosts.
+func guildBoostStatus(meta *discordgo.Guild) string {
+	boosts := pluralize(meta.PremiumSubscriptionCount, "boost")
+	if meta.PremiumTier == discordgo.PremiumTierNone {
+		if meta.PremiumSubscriptionCount == 0 {
+			return ""
+		}
+		return fmt.Sprintf("Server Boosts: %s, no boost level yet", boosts)
+	}
+	return fmt.Sprintf("Server Boost level %d (%s)", meta.PremiumTier, boosts)
+}
+
+// guildTopic makes the space topic out of the guild description, vanity invite link and boost status.
+func guildTopic(meta *discordgo.Guild) string {
+	var parts []string
+	if description := strings.TrimSpace(meta.Description); description != "" {
+		parts = append(parts, description)
+	}
+	if meta.VanityURLCode != "" {
+		parts = append(parts, fmt.Sprintf("Invite: https://discord.gg/%s", meta.VanityURLCode))
+	}
+	if boostStatus := guildBoostStatus(meta); boostStatus != "" {
+		parts = append(parts, boostStatus)
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+func (guild *Guild) UpdateTopic(meta *discordgo.Guild) bool {
+	topic := guildTopic(meta)
+	if guild.Topic == topic && (guild.TopicSet || guild.MXID == "") {
+		return false
+	}
+	guild.log.Debugfln("Updating topic %q -> %q", guild.Topic, topic)
+	guild.Topic = topic
+	guild.TopicSet = false
+	if guild.MXID != "" {
+		_, err := guild.bridge.Bot.SetRoomTopic(guild.MXID, guild.Topic)
+		if err != nil {
+			guild.log.Warnln("Failed to update room topic:", err)
+		} else {
+			guild.TopicSet = true
+		}
+	}
+	return true
+}
+
+// UpdateChannelDesignations stores which channels are the rules and system channels of the guild,
+// and updates the topics of the portals that gained or lost either designation.
+func (guild *Guild) UpdateChannelDesignations(source *User, meta *discordgo.Guild) bool {
+	if guild.RulesChannelID == meta.RulesChannelID && guild.SystemChannelID == meta.SystemChannelID {
+		return false
+	}
+	guild.log.Debugfln("Updating rules/system channels %q/%q -> %q/%q", guild.RulesChannelID, guild.SystemChannelID, meta.RulesChannelID, meta.SystemChannelID)
+	affected := map[string]struct{}{
+		guild.RulesChannelID:  {},
+		guild.SystemChannelID: {},
+		meta.RulesChannelID:   {},
+		meta.SystemChannelID:  {},
+	}
+	delete(affected, "")
+	guild.RulesChannelID = meta.RulesChannelID
+	guild.SystemChannelID = meta.SystemChannelID
+	for channelID := range affected {
+		portal := guild.bridge.GetExistingPortalByID(database.NewPortalKey(channelID, ""))
+		if portal == nil || portal.MXID == "" {
+			continue
+		}
+		channel, err := source.Session.State.Channel(channelID)
+		if err != nil {
+			guild.log.Debugfln("Not updating topic of %s: %v", channelID, err)
+			continue
+		}
+		portal.UpdateInfo(source, channel)
+	}
+	return true
+}
+
+func (guild *Guild) RemoveMXID() {
+	guild.bridge.guildsLock.Lock()
+	defer guild.bridge.guildsLock.Unlock()
+	if guild.MXID == "" {
+		return
+	}
+	delete(guild.bridge.guildsByMXID, guild.MXID)
+	guild.MXID = ""
+	guild.NameSet = false
+	guild.AvatarSet = false
+	guild.TopicSet = false
+	guild.AutoBridgeChannels = false
+	guild.Update()
+}
+
+// archive disconnects the guild space from Discord while keeping the room and its children.
+func (guild *Guild) archive() {
+	if guild.MXID == "" {
+		return
+	}
+	archived := guild.bridge.DB.ArchivedRoom.New()
+	archived.MXID = guild.MXID
+	archived.DiscordID = guild.ID
+	archived.GuildID = guild.ID
+	archived.Name = guild.Name
+	archived.ArchivedAt = time.Now()
+	archived.Insert()
+
+	stateKey, _ := guild.getBridgeInfo()
+	_, err := guild.bridge.Bot.SendStateEvent(guild.MXID, event.StateBridge, stateKey, struct{}{})
+	if err != nil {
+		guild.log.Warnln("Failed to remove m.bridge:", err)
+	}
+	_, err = guild.bridge.Bot.SendStateEvent(guild.MXID, event.StateHalfShotBridge, stateKey, struct{}{})
+	if err != nil {
+		guild.log.Warnln("Failed to remove uk.half-shot.bridge:", err)
+	}
+	guild.RemoveMXID()
+}
+
+// updatePuppetPowerLevels applies a changed puppet power level to the puppets already in the guild's rooms.
+func (guild *Guild) updatePuppetPowerLevels(previous int) {
+	for _, portal := range guild.bridge.GetAllPortalsInGuild(guild.ID) {
+		if portal.MXID == "" {
+			continue
+		}
+		members, err := guild.bridge.Bot.JoinedMembers(portal.MXID)
+		if err != nil {
+			guild.log.Warnfln("Failed to get members of %s to update puppet power levels: %v", portal.MXID, err)
+			continue
+		}
+		userIDs := make([]id.UserID, 0, len(members.Joined))
+		for userID := range members.Joined {
+			userIDs = append(userIDs, userID)
+		}
+		portal.applyPuppetPowerLevel(userIDs, &previous)
+	}
+}
+
+// cleanup kicks everyone out of a former guild space and leaves it.
+func (guild *Guild) cleanup(spaceID id.RoomID) {
+	members, err := guild.bridge.Bot.JoinedMembers(spaceID)
+	if err != nil {
+		guild.log.Errorln("Failed to get space members for cleanup:", err)
+	} else {
+		for member := range members.Joined {
+			if member == guild.bridge.Bot.UserID {
+				continue
+			}
+			if puppet := guild.bridge.GetPuppetByMXID(member); puppet != nil {
+				_, err = puppet.DefaultIntent().LeaveRoom(spaceID)
+			} else {
+				_, err = guild.bridge.Bot.KickUser(spaceID, &mautrix.ReqKickUser{UserID: member, Reason: "Unbridging guild"})
+			}
+			if err != nil {
+				guild.log.Warnfln("Failed to remove %s from space: %v", member, err)
+			}
+		}
+	}
+	_, err = guild.bridge.Bot.LeaveRoom(spaceID)
+	if err != nil {
+		guild.log.Warnln("Failed to leave space while cleaning up:", err)
+	}
+}
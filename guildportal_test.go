@@ -0,0 +1,89 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+func TestGuildTopic(t *testing.T) {
+	assert.Equal(t, "", guildTopic(&discordgo.Guild{}))
+	assert.Equal(t, "Hello", guildTopic(&discordgo.Guild{Description: " Hello\n"}))
+	assert.Equal(t, "Hello\n\nInvite: https://discord.gg/example\n\nServer Boost level 2 (9 boosts)", guildTopic(&discordgo.Guild{
+		Description:              "Hello",
+		VanityURLCode:            "example",
+		PremiumTier:              discordgo.PremiumTier2,
+		PremiumSubscriptionCount: 9,
+	}))
+	assert.Equal(t, "Server Boost level 1 (1 boost)", guildTopic(&discordgo.Guild{
+		PremiumTier:              discordgo.PremiumTier1,
+		PremiumSubscriptionCount: 1,
+	}))
+	// Boosts that aren't enough for the first level yet
+	assert.Equal(t, "Server Boosts: 1 boost, no boost level yet", guildTopic(&discordgo.Guild{PremiumSubscriptionCount: 1}))
+}
+
+func TestHasGuildPermission(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		permissions int64
+		expected    bool
+	}{
+		{"Role permission", discordgo.PermissionManageChannels, true},
+		{"Administrator", discordgo.PermissionAdministrator, true},
+		{"Missing permission", discordgo.PermissionSendMessages, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			user := newTestGuildMember(t, test.permissions)
+			allowed, err := user.hasGuildPermission("guild", discordgo.PermissionManageChannels)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, allowed)
+		})
+	}
+	_, err := (&User{User: &database.User{}}).hasGuildPermission("guild", discordgo.PermissionManageChannels)
+	assert.ErrorIs(t, err, ErrNotConnected)
+}
+
+func TestArchivedRoomsOfGuild(t *testing.T) {
+	br, _ := newTestBridge(t)
+	for i, roomID := range []string{"!space:example.com", "!channel:example.com", "!other:example.com"} {
+		archived := br.DB.ArchivedRoom.New()
+		archived.MXID = id.RoomID(roomID)
+		archived.DiscordID = roomID
+		archived.GuildID = "guild"
+		if i == 2 {
+			archived.GuildID = "other"
+		}
+		archived.Name = roomID
+		archived.ArchivedAt = time.UnixMilli(int64(1000 - i))
+		archived.Insert()
+	}
+	rooms := br.DB.ArchivedRoom.GetAllByGuildID("guild")
+	if assert.Len(t, rooms, 2) {
+		assert.Equal(t, id.RoomID("!channel:example.com"), rooms[0].MXID, "older archived rooms must come first")
+		assert.Equal(t, id.RoomID("!space:example.com"), rooms[1].MXID)
+		assert.Equal(t, int64(1000), rooms[1].ArchivedAt.UnixMilli())
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+const healthCheckDBTimeout = 5 * time.Second
+
+type HealthCheckAPI struct {
+	bridge *DiscordBridge
+	log    log.Logger
+	server *http.Server
+
+	started int32
+}
+
+func newHealthCheckAPI(br *DiscordBridge) *HealthCheckAPI {
+	h := &HealthCheckAPI{
+		bridge: br,
+		log:    br.Log.Sub("HealthCheck"),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", h.health)
+	mux.HandleFunc("/ready", h.ready)
+	h.server = &http.Server{
+		Addr:    br.Config.Bridge.HealthCheck.Address,
+		Handler: mux,
+	}
+	return h
+}
+
+func (h *HealthCheckAPI) Start() {
+	h.log.Infoln("Starting health check server on", h.server.Addr)
+	go func() {
+		err := h.server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			h.log.Errorln("Health check server failed:", err)
+		}
+	}()
+}
+
+func (h *HealthCheckAPI) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := h.server.Shutdown(ctx)
+	if err != nil {
+		h.log.Warnln("Failed to stop health check server:", err)
+	}
+}
+
+// MarkStarted makes the /ready endpoint start reporting success once the database is reachable.
+func (h *HealthCheckAPI) MarkStarted() {
+	atomic.StoreInt32(&h.started, 1)
+}
+
+func (h *HealthCheckAPI) checkDatabase(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckDBTimeout)
+	defer cancel()
+	var one int
+	return h.bridge.DB.RawDB.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
+func (h *HealthCheckAPI) health(w http.ResponseWriter, r *http.Request) {
+	if err := h.checkDatabase(r.Context()); err != nil {
+		h.log.Warnln("Health check failed to reach database:", err)
+		jsonResponse(w, http.StatusServiceUnavailable, Response{false, "database unreachable"})
+		return
+	}
+	jsonResponse(w, http.StatusOK, Response{true, "ok"})
+}
+
+func (h *HealthCheckAPI) ready(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&h.started) == 0 {
+		jsonResponse(w, http.StatusServiceUnavailable, Response{false, "bridge is starting"})
+		return
+	}
+	h.health(w, r)
+}
@@ -22,6 +22,7 @@ import (
 
 	"maunium.net/go/mautrix/bridge"
 	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/util/configupgrade"
 
@@ -47,6 +48,7 @@ type DiscordBridge struct {
 	DB     *database.Database
 
 	provisioning *ProvisioningAPI
+	healthCheck  *HealthCheckAPI
 
 	usersByMXID map[id.UserID]*User
 	usersByID   map[string]*User
@@ -71,6 +73,9 @@ type DiscordBridge struct {
 	puppets             map[string]*Puppet
 	puppetsByCustomMXID map[id.UserID]*Puppet
 	puppetsLock         sync.Mutex
+
+	forumChannels     map[string]cachedForumChannel
+	forumChannelsLock sync.Mutex
 }
 
 func (br *DiscordBridge) GetExampleConfig() string {
@@ -86,21 +91,35 @@ func (br *DiscordBridge) GetConfigPtr() interface{} {
 }
 
 func (br *DiscordBridge) Init() {
-	br.CommandProcessor = commands.NewProcessor(&br.Bridge)
+	br.CommandProcessor = &commandProcessor{commands.NewProcessor(&br.Bridge)}
 	br.RegisterCommands()
+	br.EventProcessor.On(event.StatePinnedEvents, br.MatrixHandler.HandleRoomMetadata)
 
 	br.DB = database.New(br.Bridge.DB, br.Log.Sub("Database"))
 	discordLog = br.Log.Sub("Discord")
+	br.validatePuppetNamespace()
 }
 
 func (br *DiscordBridge) Start() {
 	if br.Config.Bridge.Provisioning.SharedSecret != "disable" {
 		br.provisioning = newProvisioningAPI(br)
 	}
-	go br.startUsers()
+	if br.Config.Bridge.HealthCheck.Address != "" {
+		br.healthCheck = newHealthCheckAPI(br)
+		br.healthCheck.Start()
+	}
+	go func() {
+		br.startUsers()
+		if br.healthCheck != nil {
+			br.healthCheck.MarkStarted()
+		}
+	}()
 }
 
 func (br *DiscordBridge) Stop() {
+	if br.healthCheck != nil {
+		br.healthCheck.Stop()
+	}
 	for _, user := range br.usersByMXID {
 		if user.Session == nil {
 			continue
@@ -163,6 +182,8 @@ func main() {
 
 		puppets:             make(map[string]*Puppet),
 		puppetsByCustomMXID: make(map[id.UserID]*Puppet),
+
+		forumChannels: make(map[string]cachedForumChannel),
 	}
 	br.Bridge = bridge.Bridge{
 		Name:         "mautrix-discord",
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var errMassMentionRateLimited = errors.New("Discord is rate limiting @everyone and @here mentions")
+
+// pingsEveryone checks whether a message will actually ping @everyone or @here when it's sent to Discord.
+func (portal *Portal) pingsEveryone(sendReq *discordgo.MessageSend) bool {
+	return portal.GuildID != "" && sendReq.AllowedMentions == nil && massMentionRegex.MatchString(sendReq.Content)
+}
+
+// sessionWithoutRateLimitRetry returns a copy of the user's session for making REST requests that return
+// rate limits as errors instead of sleeping until they're over. It shares the HTTP client and rate limit buckets.
+func (user *User) sessionWithoutRateLimitRetry() *discordgo.Session {
+	session := user.Session
+	return &discordgo.Session{
+		Token:          session.Token,
+		IsUser:         session.IsUser,
+		UserAgent:      session.UserAgent,
+		Client:         session.Client,
+		Ratelimiter:    session.Ratelimiter,
+		MaxRestRetries: session.MaxRestRetries,
+		LogLevel:       session.LogLevel,
+	}
+}
+
+// isRouteRateLimit checks whether a rate limit response was caused by the regular limit of the route rather
+// than a separate limit like the one for mass mentions. The response body is the same for both, but the
+// route's bucket still has requests left after a response from a separate limit.
+func isRouteRateLimit(rl *discordgo.RateLimiter, bucketKey string) bool {
+	bucket := rl.GetBucket(bucketKey)
+	bucket.Lock()
+	defer bucket.Unlock()
+	return bucket.Remaining <= 0
+}
+
+// rewindFiles seeks the file readers of a message back to the start after they were consumed by a failed send.
+func rewindFiles(files []*discordgo.File) {
+	for _, file := range files {
+		if seeker, ok := file.Reader.(io.Seeker); ok {
+			_, _ = seeker.Seek(0, io.SeekStart)
+		}
+	}
+}
+
+// sendMassMentionMessage sends a message that pings @everyone or @here. Mass mention cooldowns can be long,
+// so short ones are waited out once and longer ones fail the message with an error that says when it can be
+// sent again, rather than having the message show up on Discord much later. Normal route rate limits are
+// waited out like discordgo would.
+func (portal *Portal) sendMassMentionMessage(sender *User, channelID string, sendReq *discordgo.MessageSend) (*discordgo.Message, error) {
+	maxWait := time.Duration(portal.bridge.Config.Bridge.MassMentionMaxWait) * time.Second
+	session := sender.sessionWithoutRateLimitRetry()
+	endpoint := discordgo.EndpointChannelMessages(channelID)
+	waited := false
+	for {
+		msg, err := sendMessageEnforceNonce(session, channelID, sendReq)
+		var rateLimit *discordgo.RateLimitError
+		if !errors.As(err, &rateLimit) {
+			return msg, err
+		}
+		sender.rateLimitHandler(nil, rateLimit.RateLimit)
+		if isRouteRateLimit(session.Ratelimiter, endpoint) {
+			portal.log.Debugfln("Sending mass mention by %s hit the route rate limit, retrying in %s", sender.DiscordID, rateLimit.RetryAfter)
+		} else if !waited && rateLimit.RetryAfter <= maxWait {
+			portal.log.Debugfln("Mass mention by %s is rate limited, retrying in %s", sender.DiscordID, rateLimit.RetryAfter)
+			waited = true
+		} else {
+			retryAfter := rateLimit.RetryAfter.Round(time.Second)
+			if retryAfter < time.Second {
+				retryAfter = time.Second
+			}
+			portal.log.Debugfln("Mass mention by %s is rate limited for %s: %s", sender.DiscordID, rateLimit.RetryAfter, rateLimit.Message)
+			return nil, fmt.Errorf("%w, try again in %s", errMassMentionRateLimited, retryAfter)
+		}
+		time.Sleep(rateLimit.RetryAfter)
+		rewindFiles(sendReq.Files)
+	}
+}
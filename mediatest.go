@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+)
+
+// makeTestImage generates a small PNG for the test-media command.
+func makeTestImage() ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 16; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 16), G: uint8(y * 16), B: 0x80, A: 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), err
+}
+
+func formatMediaTestStep(name string, start time.Time, err error, details string) string {
+	duration := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		return fmt.Sprintf("* %s: **failed** after %s: %v", name, duration, err)
+	} else if details != "" {
+		return fmt.Sprintf("* %s: OK in %s (%s)", name, duration, details)
+	}
+	return fmt.Sprintf("* %s: OK in %s", name, duration)
+}
+
+var cmdTestMedia = &commands.FullHandler{
+	Func: wrapCommand(fnTestMedia),
+	Name: "test-media",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Check that media can be uploaded to and downloaded from Matrix, and downloaded from the Discord CDN",
+	},
+	RequiresAdmin: true,
+}
+
+func fnTestMedia(ce *WrappedCommandEvent) {
+	portal := ce.Portal
+	if portal == nil {
+		// Outside portals, test with the bridge bot and without encryption
+		portal = &Portal{Portal: ce.Bridge.DB.Portal.New(), bridge: ce.Bridge, log: ce.Bridge.Log.Sub("MediaTest")}
+	}
+	data, err := makeTestImage()
+	if err != nil {
+		ce.Reply("Failed to generate test image: %v", err)
+		return
+	}
+	results := []string{"Media test results:"}
+
+	content := &event.MessageEventContent{
+		MsgType: event.MsgImage,
+		Body:    "test.png",
+		Info:    &event.FileInfo{MimeType: "image/png"},
+	}
+	start := time.Now()
+	// Uploading encrypts the data in place in encrypted rooms
+	err = portal.uploadMatrixAttachment(portal.MainIntent(), append([]byte(nil), data...), content)
+	var uploadDetails string
+	if err == nil {
+		uploadDetails = string(content.URL)
+		if content.File != nil {
+			uploadDetails = string(content.File.URL) + ", encrypted"
+		}
+	}
+	results = append(results, formatMediaTestStep("Matrix upload", start, err, uploadDetails))
+	if err == nil {
+		start = time.Now()
+		var downloaded []byte
+		downloaded, err = portal.downloadMatrixAttachment(content)
+		if err == nil && !bytes.Equal(downloaded, data) {
+			err = fmt.Errorf("downloaded %d bytes, but they don't match the %d uploaded bytes", len(downloaded), len(data))
+		}
+		results = append(results, formatMediaTestStep("Matrix download", start, err, fmt.Sprintf("%d bytes", len(downloaded))))
+	} else {
+		results = append(results, "* Matrix download: skipped as the upload failed")
+	}
+
+	cdnURL := discordgo.EndpointDefaultUserAvatar("0")
+	if ce.User.Session != nil && ce.User.Session.State.User != nil && ce.User.Session.State.User.Avatar != "" {
+		cdnURL = ce.User.Session.State.User.AvatarURL("64")
+	}
+	start = time.Now()
+	downloaded, _, err := portal.downloadDiscordURL(cdnURL)
+	results = append(results, formatMediaTestStep("Discord CDN download", start, err, fmt.Sprintf("%d bytes from %s", len(downloaded), cdnURL)))
+
+	ce.Reply("%s", strings.Join(results, "\n"))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// maxRoleMentionUsers is how many role members are mentioned individually before a role mention
+// is bridged as a room mention instead.
+const maxRoleMentionUsers = 50
+
+type matrixMentions struct {
+	UserIDs []id.UserID `json:"user_ids,omitempty"`
+	Room    bool        `json:"room,omitempty"`
+}
+
+type mentionSet struct {
+	mentions matrixMentions
+	seen     map[id.UserID]struct{}
+}
+
+func (ms *mentionSet) add(userID id.UserID) {
+	if _, ok := ms.seen[userID]; !ok {
+		ms.seen[userID] = struct{}{}
+		ms.mentions.UserIDs = append(ms.mentions.UserIDs, userID)
+	}
+}
+
+// mentionedRoles returns the IDs of the roles in the message that can actually be mentioned.
+// Messages from users with the Mention Everyone permission can ping other roles too, but those are skipped.
+func (portal *Portal) mentionedRoles(msg *discordgo.Message) map[string]struct{} {
+	roles := make(map[string]struct{}, len(msg.MentionRoles))
+	for _, roleID := range msg.MentionRoles {
+		role := portal.bridge.DB.Role.GetByID(portal.GuildID, roleID)
+		if role != nil && role.Mentionable {
+			roles[roleID] = struct{}{}
+		}
+	}
+	return roles
+}
+
+// addRoleMentions mentions the Matrix users in the room whose Discord accounts have one of the given roles.
+// Role membership is read from the gateway state cache, so members that haven't been seen aren't mentioned.
+func (portal *Portal) addRoleMentions(source *User, ms *mentionSet, roles map[string]struct{}) {
+	var count int
+	// Logged-in users may be in the room as both their puppet and their real account
+	checked := make(map[string]struct{})
+	for userID := range portal.bridge.StateStore.GetRoomMembers(portal.MXID) {
+		var user *User
+		if discordID, isPuppet := portal.bridge.ParsePuppetMXID(userID); isPuppet {
+			user = portal.bridge.GetUserByID(discordID)
+		} else {
+			user = portal.bridge.GetExistingUserByMXID(userID)
+		}
+		if user == nil || user.DiscordID == "" || !portal.bridge.StateStore.IsInRoom(portal.MXID, user.MXID) {
+			continue
+		} else if _, ok := checked[user.DiscordID]; ok {
+			continue
+		}
+		checked[user.DiscordID] = struct{}{}
+		member, err := source.Session.State.Member(portal.GuildID, user.DiscordID)
+		if err != nil {
+			continue
+		}
+		for _, roleID := range member.Roles {
+			if _, ok := roles[roleID]; ok {
+				count++
+				if count > maxRoleMentionUsers {
+					portal.log.Debugfln("Role mention matched over %d users, mentioning the room instead", maxRoleMentionUsers)
+					ms.mentions.Room = true
+					return
+				}
+				ms.add(user.MXID)
+				break
+			}
+		}
+	}
+}
+
+// convertDiscordMentions makes the m.mentions content of a Discord message, so that Matrix users are notified
+// of user and role mentions without relying on their name being in the message body.
+func (portal *Portal) convertDiscordMentions(source *User, msg *discordgo.Message) map[string]interface{} {
+	if len(msg.Mentions) == 0 && len(msg.MentionRoles) == 0 && !msg.MentionEveryone {
+		return nil
+	}
+	ms := &mentionSet{seen: make(map[id.UserID]struct{})}
+	ms.mentions.Room = msg.MentionEveryone
+	for _, mentioned := range msg.Mentions {
+		if user := portal.bridge.GetUserByID(mentioned.ID); user != nil {
+			ms.add(user.MXID)
+		}
+	}
+	if roles := portal.mentionedRoles(msg); len(roles) > 0 && portal.GuildID != "" && !ms.mentions.Room {
+		portal.addRoleMentions(source, ms, roles)
+	}
+	return map[string]interface{}{
+		"m.mentions": &ms.mentions,
+	}
+}
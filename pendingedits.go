@@ -0,0 +1,79 @@
+package main
+
+import (
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+type pendingEdit struct {
+	user     *User
+	msg      *discordgo.Message
+	thread   *Thread
+	received time.Time
+}
+
+// pendingEditQueue holds MESSAGE_UPDATEs that arrived before the message itself was bridged. Events from
+// different users' connections all go through the same portal, so an edit seen by one user can be handled
+// before the create seen by another. Only accessed from the message loop, so there's no lock.
+type pendingEditQueue struct {
+	edits   map[string]pendingEdit
+	maxWait time.Duration
+	now     func() time.Time
+}
+
+func newPendingEditQueue(maxWait time.Duration) *pendingEditQueue {
+	return &pendingEditQueue{
+		edits:   make(map[string]pendingEdit),
+		maxWait: maxWait,
+		now:     time.Now,
+	}
+}
+
+// Add stores an edit of an unknown message. Updates contain the full message, so only the newest one is kept.
+// Returns false if deferring edits is disabled.
+func (pq *pendingEditQueue) Add(user *User, msg *discordgo.Message, thread *Thread) bool {
+	if pq.maxWait <= 0 {
+		return false
+	}
+	now := pq.now()
+	for messageID, edit := range pq.edits {
+		if now.Sub(edit.received) > pq.maxWait {
+			delete(pq.edits, messageID)
+		}
+	}
+	pq.edits[msg.ID] = pendingEdit{user: user, msg: msg, thread: thread, received: now}
+	return true
+}
+
+// Pop returns the deferred edit of a message that has now been bridged and forgets it.
+// Edits that have waited for longer than the limit are dropped.
+func (pq *pendingEditQueue) Pop(messageID string) (pendingEdit, bool) {
+	edit, ok := pq.edits[messageID]
+	if !ok {
+		return edit, false
+	}
+	delete(pq.edits, messageID)
+	if pq.now().Sub(edit.received) > pq.maxWait {
+		return edit, false
+	}
+	return edit, true
+}
+
+// Discard forgets the deferred edit of a message, e.g. because the message was deleted.
+func (pq *pendingEditQueue) Discard(messageID string) {
+	delete(pq.edits, messageID)
+}
+
+// applyPendingEdit bridges the edit that arrived before the message with the given ID was bridged, if any.
+func (portal *Portal) applyPendingEdit(messageID string) {
+	edit, ok := portal.pendingEdits.Pop(messageID)
+	if !ok {
+		return
+	} else if portal.bridge.DB.Message.GetByDiscordID(portal.Key, messageID) == nil {
+		portal.log.Debugfln("Dropping deferred edit of %s as the message wasn't bridged", messageID)
+		return
+	}
+	portal.log.Debugfln("Applying edit of %s that arrived before the message", messageID)
+	portal.handleDiscordMessageUpdate(edit.user, edit.msg, edit.thread)
+}
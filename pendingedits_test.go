@@ -0,0 +1,137 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+func TestPendingEditAppliedAfterCreate(t *testing.T) {
+	pq := newPendingEditQueue(10 * time.Second)
+
+	// The edit arrives first, so it's held until the create has been bridged
+	edit := &discordgo.Message{ID: "1234", Content: "edited"}
+	assert.True(t, pq.Add(nil, edit, nil))
+
+	// Creates of other messages don't pick it up
+	_, ok := pq.Pop("5678")
+	assert.False(t, ok)
+
+	pending, ok := pq.Pop("1234")
+	assert.True(t, ok)
+	assert.Equal(t, "edited", pending.msg.Content)
+
+	// The edit is only applied once
+	_, ok = pq.Pop("1234")
+	assert.False(t, ok)
+}
+
+func TestPendingEditKeepsNewest(t *testing.T) {
+	pq := newPendingEditQueue(10 * time.Second)
+	pq.Add(nil, &discordgo.Message{ID: "1234", Content: "first edit"}, nil)
+	pq.Add(nil, &discordgo.Message{ID: "1234", Content: "second edit"}, nil)
+
+	pending, ok := pq.Pop("1234")
+	assert.True(t, ok)
+	assert.Equal(t, "second edit", pending.msg.Content)
+}
+
+func TestPendingEditExpiry(t *testing.T) {
+	now := time.Now()
+	pq := newPendingEditQueue(10 * time.Second)
+	pq.now = func() time.Time { return now }
+	pq.Add(nil, &discordgo.Message{ID: "1234", Content: "edited"}, nil)
+
+	// The create never arrived in time, so the edit is dropped
+	now = now.Add(11 * time.Second)
+	_, ok := pq.Pop("1234")
+	assert.False(t, ok)
+
+	// Expired edits are also cleaned up when new ones are added
+	pq.Add(nil, &discordgo.Message{ID: "5678"}, nil)
+	now = now.Add(11 * time.Second)
+	pq.Add(nil, &discordgo.Message{ID: "9012"}, nil)
+	assert.Len(t, pq.edits, 1)
+}
+
+func TestPendingEditDiscardAndDisable(t *testing.T) {
+	pq := newPendingEditQueue(10 * time.Second)
+	pq.Add(nil, &discordgo.Message{ID: "1234"}, nil)
+	// Deleting the message before it's bridged forgets the edit
+	pq.Discard("1234")
+	_, ok := pq.Pop("1234")
+	assert.False(t, ok)
+
+	disabled := newPendingEditQueue(0)
+	assert.False(t, disabled.Add(nil, &discordgo.Message{ID: "1234"}, nil))
+	assert.Empty(t, disabled.edits)
+}
+
+func TestPortalAppliesEditAfterCreate(t *testing.T) {
+	br, events := newTestBridge(t)
+	portal := newTestPortal(br, "100")
+	user := &User{User: &database.User{}, bridge: br}
+	author := &discordgo.User{ID: "200", Username: "author", Discriminator: "0001"}
+
+	portal.handleDiscordMessages(portalDiscordMessage{user: user, msg: &discordgo.MessageUpdate{
+		Message: &discordgo.Message{ID: "1001", ChannelID: "100", Author: author, Content: "edited"},
+	}})
+	assert.Nil(t, portal.bridge.DB.Message.GetByDiscordID(portal.Key, "1001"), "the edit mustn't be bridged on its own")
+
+	portal.handleDiscordMessages(portalDiscordMessage{user: user, msg: &discordgo.MessageCreate{
+		Message: &discordgo.Message{ID: "1001", ChannelID: "100", Author: author, Content: "original"},
+	}})
+	created := nextMatrixEvent(t, events)
+	assert.Equal(t, "original", created.Content["body"])
+	edit := nextMatrixEvent(t, events)
+	assert.Equal(t, map[string]interface{}{"body": "edited", "msgtype": "m.text"}, edit.Content["m.new_content"])
+	assert.Len(t, portal.bridge.DB.Message.GetByDiscordID(portal.Key, "1001"), 1)
+}
+
+func TestPortalBridgesDeferredResponseOnce(t *testing.T) {
+	br, events := newTestBridge(t)
+	portal := newTestPortal(br, "100")
+	user := &User{User: &database.User{}, bridge: br}
+	bot := &discordgo.User{ID: "300", Username: "bot", Discriminator: "0002", Bot: true}
+	loading := &discordgo.Message{ID: "1002", ChannelID: "100", Author: bot, Flags: discordgo.MessageFlagsLoading}
+
+	portal.handleDiscordMessages(portalDiscordMessage{user: user, msg: &discordgo.MessageCreate{Message: loading}})
+	// Loading updates only keep the response deferred, they aren't held as edits
+	portal.handleDiscordMessages(portalDiscordMessage{user: user, msg: &discordgo.MessageUpdate{Message: loading}})
+	_, pending := portal.pendingEdits.Pop("1002")
+	assert.False(t, pending)
+
+	portal.handleDiscordMessages(portalDiscordMessage{user: user, msg: &discordgo.MessageUpdate{
+		Message: &discordgo.Message{ID: "1002", ChannelID: "100", Author: bot, Content: "response"},
+	}})
+	created := nextMatrixEvent(t, events)
+	assert.Equal(t, "response", created.Content["body"])
+	assert.Nil(t, created.Content["m.new_content"])
+	assert.NotContains(t, portal.deferredResponses, "1002")
+	assert.Len(t, portal.bridge.DB.Message.GetByDiscordID(portal.Key, "1002"), 1)
+	select {
+	case evt := <-events:
+		t.Errorf("Unexpected %s event %v", evt.Type, evt.Content)
+	default:
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+// messageTypePollResult is the type of the system message Discord sends when a poll ends.
+// The message references the poll and has the final results in a poll_result embed.
+const messageTypePollResult discordgo.MessageType = 46
+
+type pollMedia struct {
+	Text  string           `json:"text"`
+	Emoji *discordgo.Emoji `json:"emoji,omitempty"`
+}
+
+type pollAnswer struct {
+	AnswerID  int       `json:"answer_id"`
+	PollMedia pollMedia `json:"poll_media"`
+}
+
+type pollAnswerCount struct {
+	ID    int `json:"id"`
+	Count int `json:"count"`
+}
+
+type pollResults struct {
+	IsFinalized  bool              `json:"is_finalized"`
+	AnswerCounts []pollAnswerCount `json:"answer_counts"`
+}
+
+type discordPoll struct {
+	Question         pollMedia    `json:"question"`
+	Answers          []pollAnswer `json:"answers"`
+	Expiry           *time.Time   `json:"expiry"`
+	AllowMultiselect bool         `json:"allow_multiselect"`
+	Results          *pollResults `json:"results"`
+}
+
+// pollVote is a MESSAGE_POLL_VOTE_ADD or MESSAGE_POLL_VOTE_REMOVE event.
+type pollVote struct {
+	UserID    string `json:"user_id"`
+	ChannelID string `json:"channel_id"`
+	MessageID string `json:"message_id"`
+	GuildID   string `json:"guild_id"`
+	AnswerID  int    `json:"answer_id"`
+}
+
+// parseMessagePoll extracts the poll from a raw message payload, as discordgo.Message doesn't include it.
+func parseMessagePoll(data json.RawMessage) *discordPoll {
+	var payload struct {
+		Poll *discordPoll `json:"poll"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil
+	}
+	return payload.Poll
+}
+
+func (poll *discordPoll) isFinalized() bool {
+	return poll.Results != nil && poll.Results.IsFinalized
+}
+
+func (poll *discordPoll) votes(answerID int) int {
+	if poll.Results == nil {
+		return 0
+	}
+	for _, count := range poll.Results.AnswerCounts {
+		if count.ID == answerID {
+			return count.Count
+		}
+	}
+	return 0
+}
+
+// winners returns the answers with the most votes, which is more than one answer if there's a tie.
+func (poll *discordPoll) winners() ([]pollAnswer, int) {
+	var winners []pollAnswer
+	var maxVotes int
+	for _, answer := range poll.Answers {
+		votes := poll.votes(answer.AnswerID)
+		if votes == 0 || votes < maxVotes {
+			continue
+		} else if votes > maxVotes {
+			winners = winners[:0]
+			maxVotes = votes
+		}
+		winners = append(winners, answer)
+	}
+	return winners, maxVotes
+}
+
+func (media pollMedia) String() string {
+	if media.Emoji == nil || media.Emoji.Name == "" {
+		return media.Text
+	}
+	emoji := media.Emoji.Name
+	if media.Emoji.ID != "" {
+		emoji = fmt.Sprintf(":%s:", media.Emoji.Name)
+	}
+	if media.Text == "" {
+		return emoji
+	}
+	return emoji + " " + media.Text
+}
+
+func formatVoteCount(votes int) string {
+	if votes == 1 {
+		return "1 vote"
+	}
+	return fmt.Sprintf("%d votes", votes)
+}
+
+// pollOutcome describes the result of a finished poll.
+func (poll *discordPoll) pollOutcome() string {
+	winners, votes := poll.winners()
+	switch len(winners) {
+	case 0:
+		return "The poll ended without any votes"
+	case 1:
+		return fmt.Sprintf("The poll ended, the winning answer is %s with %s", winners[0].PollMedia, formatVoteCount(votes))
+	default:
+		names := make([]string, len(winners))
+		for i, winner := range winners {
+			names[i] = winner.PollMedia.String()
+		}
+		last := len(names) - 1
+		return fmt.Sprintf("The poll ended in a tie between %s and %s with %s each", strings.Join(names[:last], ", "), names[last], formatVoteCount(votes))
+	}
+}
+
+// renderDiscordPoll converts a poll into a Matrix message. Open polls link to Discord for voting,
+// while finished polls show the outcome instead.
+func renderDiscordPoll(poll *discordPoll, link string) *event.MessageEventContent {
+	var body, formatted strings.Builder
+	question := poll.Question.String()
+	_, _ = fmt.Fprintf(&body, "Poll: %s\n", question)
+	_, _ = fmt.Fprintf(&formatted, "<p><strong>Poll: %s</strong></p><ul>", html.EscapeString(question))
+	for _, answer := range poll.Answers {
+		line := fmt.Sprintf("%s (%s)", answer.PollMedia, formatVoteCount(poll.votes(answer.AnswerID)))
+		_, _ = fmt.Fprintf(&body, "* %s\n", line)
+		_, _ = fmt.Fprintf(&formatted, "<li>%s</li>", html.EscapeString(line))
+	}
+	formatted.WriteString("</ul>")
+	if poll.isFinalized() {
+		outcome := poll.pollOutcome()
+		body.WriteString(outcome)
+		_, _ = fmt.Fprintf(&formatted, "<p>%s</p>", html.EscapeString(outcome))
+	} else {
+		var multiselect string
+		if poll.AllowMultiselect {
+			multiselect = " (multiple answers allowed)"
+		}
+		_, _ = fmt.Fprintf(&body, "Vote on Discord%s: %s", multiselect, link)
+		_, _ = fmt.Fprintf(&formatted, `<p><a href="%s">Vote on Discord</a>%s</p>`, html.EscapeString(link), multiselect)
+	}
+	return &event.MessageEventContent{
+		MsgType:       event.MsgText,
+		Body:          body.String(),
+		Format:        event.FormatHTML,
+		FormattedBody: formatted.String(),
+	}
+}
+
+func (user *User) pollVoteHandler(evt *discordgo.Event) {
+	var vote pollVote
+	if err := json.Unmarshal(evt.RawData, &vote); err != nil {
+		user.log.Warnln("Failed to parse poll vote:", err)
+		return
+	}
+	user.pushPortalMessage(&vote, "poll vote", vote.ChannelID, vote.GuildID)
+}
+
+// fetchPollMessage fetches a message directly from the API, as the poll is lost when discordgo parses the message.
+func (user *User) fetchPollMessage(channelID, messageID string) (*discordgo.Message, *discordPoll, error) {
+	if user.Session == nil {
+		return nil, nil, ErrNotConnected
+	}
+	body, err := user.Session.RequestWithBucketID(http.MethodGet, discordgo.EndpointChannelMessage(channelID, messageID), nil, discordgo.EndpointChannelMessage(channelID, ""))
+	if err != nil {
+		return nil, nil, err
+	}
+	var msg discordgo.Message
+	if err = json.Unmarshal(body, &msg); err != nil {
+		return nil, nil, err
+	}
+	poll := parseMessagePoll(body)
+	if poll == nil {
+		return nil, nil, fmt.Errorf("message %s doesn't have a poll", messageID)
+	}
+	return &msg, poll, nil
+}
+
+func (portal *Portal) discordPollLink(msg *discordgo.Message) string {
+	guildID := portal.GuildID
+	if guildID == "" {
+		guildID = "@me"
+	}
+	return fmt.Sprintf("https://discord.com/channels/%s/%s/%s", guildID, msg.ChannelID, msg.ID)
+}
+
+func (portal *Portal) handleDiscordPoll(intent *appservice.IntentAPI, msg *discordgo.Message, poll *discordPoll, ts time.Time, threadID string, threadRelation *event.RelatesTo) {
+	content := renderDiscordPoll(poll, portal.discordPollLink(msg))
+	content.RelatesTo = threadRelation.Copy()
+	resp, err := portal.sendMatrixMessage(intent, event.EventMessage, content, nil, ts.UnixMilli())
+	if err != nil {
+		portal.log.Warnfln("Failed to send poll %s to Matrix: %v", msg.ID, err)
+		return
+	}
+	portal.markMessageHandled(msg.ID, 0, msg.Author.ID, ts, threadID, []database.MessagePart{{MXID: resp.EventID}})
+	go portal.sendDeliveryReceipt(resp.EventID)
+}
+
+// pollRefreshDelay is how long poll votes are batched for before the results are refetched.
+const pollRefreshDelay = 2 * time.Second
+
+// queuePollRefresh refetches the results of a poll after a vote. Votes are refetched rather than counted
+// from vote events, as every logged-in user in the guild receives the same vote events, so the refresh
+// is queued once per poll no matter how many votes or users the events came from.
+func (portal *Portal) queuePollRefresh(source *User, channelID, messageID string) {
+	if _, queued := portal.pollRefreshTimers[messageID]; queued {
+		return
+	} else if len(portal.bridge.DB.Message.GetByDiscordID(portal.Key, messageID)) == 0 {
+		portal.log.Debugfln("Dropping update of unknown poll %s", messageID)
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(pollRefreshDelay, func() {
+		msg, poll, err := source.fetchPollMessage(channelID, messageID)
+		portal.runInLoop(func() {
+			// The poll result message may have already refreshed the poll
+			if portal.pollRefreshTimers[messageID] != timer {
+				return
+			}
+			delete(portal.pollRefreshTimers, messageID)
+			if err != nil {
+				portal.log.Warnfln("Failed to fetch poll %s: %v", messageID, err)
+				return
+			}
+			portal.updateDiscordPoll(msg, poll, false)
+		})
+	})
+	portal.pollRefreshTimers[messageID] = timer
+}
+
+// refreshDiscordPoll fetches the current results of a poll and edits the bridged message to show them.
+func (portal *Portal) refreshDiscordPoll(source *User, channelID, messageID string, finalized bool) *discordPoll {
+	if timer, queued := portal.pollRefreshTimers[messageID]; queued {
+		timer.Stop()
+		delete(portal.pollRefreshTimers, messageID)
+	}
+	msg, poll, err := source.fetchPollMessage(channelID, messageID)
+	if err != nil {
+		portal.log.Warnfln("Failed to fetch poll %s: %v", messageID, err)
+		return nil
+	}
+	return portal.updateDiscordPoll(msg, poll, finalized)
+}
+
+// updateDiscordPoll edits the bridged message of a poll to show the fetched results.
+func (portal *Portal) updateDiscordPoll(msg *discordgo.Message, poll *discordPoll, finalized bool) *discordPoll {
+	existing := portal.bridge.DB.Message.GetByDiscordID(portal.Key, msg.ID)
+	if len(existing) == 0 {
+		portal.log.Debugfln("Dropping update of unknown poll %s", msg.ID)
+		return nil
+	} else if poll.Results == nil {
+		portal.log.Debugfln("Discord didn't include results of poll %s, not updating it", msg.ID)
+		return nil
+	}
+	if finalized {
+		poll.Results.IsFinalized = true
+	}
+	content := renderDiscordPoll(poll, portal.discordPollLink(msg))
+	prev, ok := portal.polls[msg.ID]
+	if poll.isFinalized() {
+		delete(portal.polls, msg.ID)
+	} else {
+		portal.polls[msg.ID] = poll
+	}
+	if ok && renderDiscordPoll(prev, portal.discordPollLink(msg)).Body == content.Body {
+		return poll
+	}
+	content.SetEdit(existing[0].MXID)
+	_, err := portal.sendMatrixMessage(portal.getMessageAuthor(msg).IntentFor(portal), event.EventMessage, content, nil, 0)
+	if err != nil {
+		portal.log.Warnfln("Failed to update poll %s on Matrix: %v", msg.ID, err)
+	}
+	return poll
+}
+
+func (portal *Portal) handleDiscordPollResult(source *User, intent *appservice.IntentAPI, msg *discordgo.Message, ts time.Time, threadID string, threadRelation *event.RelatesTo) {
+	if msg.MessageReference == nil || msg.MessageReference.MessageID == "" {
+		portal.log.Debugfln("Poll result %s doesn't reference the poll", msg.ID)
+		return
+	}
+	pollID := msg.MessageReference.MessageID
+	poll := portal.refreshDiscordPoll(source, msg.ChannelID, pollID, true)
+	if poll == nil {
+		return
+	}
+	content := &event.MessageEventContent{
+		MsgType:   event.MsgNotice,
+		Body:      poll.pollOutcome(),
+		RelatesTo: threadRelation.Copy(),
+	}
+	if pollMsg := portal.bridge.DB.Message.GetByDiscordID(portal.Key, pollID); len(pollMsg) > 0 {
+		if content.RelatesTo == nil {
+			content.RelatesTo = &event.RelatesTo{}
+		}
+		content.RelatesTo.SetReplyTo(pollMsg[0].MXID)
+	}
+	resp, err := portal.sendMatrixMessage(intent, event.EventMessage, content, nil, ts.UnixMilli())
+	if err != nil {
+		portal.log.Warnfln("Failed to send poll result %s to Matrix: %v", msg.ID, err)
+		return
+	}
+	portal.markMessageHandled(msg.ID, 0, msg.Author.ID, ts, threadID, []database.MessagePart{{MXID: resp.EventID}})
+}
@@ -0,0 +1,86 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+func testPoll(counts ...pollAnswerCount) *discordPoll {
+	return &discordPoll{
+		Question: pollMedia{Text: "Lunch?"},
+		Answers: []pollAnswer{
+			{AnswerID: 1, PollMedia: pollMedia{Text: "Pizza"}},
+			{AnswerID: 2, PollMedia: pollMedia{Text: "Sushi"}},
+			{AnswerID: 3, PollMedia: pollMedia{Text: "Tacos"}},
+		},
+		Results: &pollResults{IsFinalized: true, AnswerCounts: counts},
+	}
+}
+
+func TestParseMessagePoll(t *testing.T) {
+	poll := parseMessagePoll([]byte(`{"id":"1","poll":{"question":{"text":"Lunch?"},"answers":[{"answer_id":1,"poll_media":{"text":"Pizza"}}],"results":{"is_finalized":false,"answer_counts":[{"id":1,"count":2,"me_voted":true}]}}}`))
+	if assert.NotNil(t, poll) {
+		assert.Equal(t, "Lunch?", poll.Question.Text)
+		assert.Equal(t, 2, poll.votes(1))
+		assert.False(t, poll.isFinalized())
+	}
+	assert.Nil(t, parseMessagePoll([]byte(`{"id":"1"}`)))
+}
+
+func TestPollOutcome(t *testing.T) {
+	assert.Equal(t, "The poll ended without any votes", testPoll().pollOutcome())
+	assert.Equal(t, "The poll ended, the winning answer is Sushi with 1 vote",
+		testPoll(pollAnswerCount{ID: 2, Count: 1}).pollOutcome())
+	assert.Equal(t, "The poll ended in a tie between Pizza, Sushi and Tacos with 2 votes each",
+		testPoll(pollAnswerCount{ID: 1, Count: 2}, pollAnswerCount{ID: 2, Count: 2}, pollAnswerCount{ID: 3, Count: 2}).pollOutcome())
+}
+
+func TestRenderDiscordPollHidesVoteLinkWhenClosed(t *testing.T) {
+	link := "https://discord.com/channels/1/2/3"
+	poll := testPoll(pollAnswerCount{ID: 1, Count: 3})
+	assert.NotContains(t, renderDiscordPoll(poll, link).Body, link)
+	poll.Results.IsFinalized = false
+	assert.Contains(t, renderDiscordPoll(poll, link).Body, link)
+}
+
+func TestPollResultIsNotIntegrationNotice(t *testing.T) {
+	msg := &discordgo.Message{Type: messageTypePollResult, Author: &discordgo.User{ID: "1", Username: "Poll Bot", Bot: true}}
+	assert.Equal(t, "", integrationNoticeText(msg))
+	msg.Type = 99
+	assert.NotEqual(t, "", integrationNoticeText(msg))
+}
+
+func TestPollRefreshIsQueuedOncePerPoll(t *testing.T) {
+	br, _ := newTestBridge(t)
+	portal := newTestPortal(br, "channel")
+	portal.markMessageHandled("1001", 0, "author", time.Now(), "", []database.MessagePart{{MXID: "$poll"}})
+
+	portal.queuePollRefresh(&User{}, "channel", "1001")
+	portal.queuePollRefresh(&User{}, "channel", "1001")
+	portal.queuePollRefresh(&User{}, "channel", "1002")
+	assert.Len(t, portal.pollRefreshTimers, 1, "votes from any user must share one refresh, and unknown polls mustn't be refreshed")
+	for _, timer := range portal.pollRefreshTimers {
+		timer.Stop()
+	}
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -54,9 +57,43 @@ type Portal struct {
 
 	discordMessages chan portalDiscordMessage
 	matrixMessages  chan portalMatrixMessage
+	// Functions that need to run in the message loop, e.g. to store the results of sends made outside it.
+	loopTasks chan func()
 
 	currentlyTyping     []id.UserID
 	currentlyTypingLock sync.Mutex
+
+	// Deferred ("thinking...") interaction responses that will be bridged once they're edited.
+	// Only accessed from the message loop, so there's no lock.
+	deferredResponses map[string]struct{}
+	// Last known state of polls in the portal, also only accessed from the message loop.
+	polls map[string]*discordPoll
+	// Timers of pending poll result refreshes by Discord message ID. Only accessed from the message loop.
+	pollRefreshTimers map[string]*time.Timer
+	// When each user last sent a message from Matrix, for applying slow mode. Only accessed from the message loop.
+	slowmodeLastSend map[string]time.Time
+	// When the topic of a thread room was last updated with new message and member counts, and the counts
+	// that will be applied once enough time has passed since then. Only accessed from the message loop.
+	threadStatsUpdated time.Time
+	pendingThreadStats string
+	threadStatsTimer   *time.Timer
+	// Edits of messages that haven't been bridged yet.
+	pendingEdits *pendingEditQueue
+	// The forum tag state event that was last sent to the room. Only accessed from the message loop.
+	forumTags *ForumTagsEventContent
+	// Buttons of recent bot messages as they were last shown in the room. Only accessed from the message loop.
+	buttonMessages buttonMessageCache
+	// The call that notices were last sent for, and the kinds of notices sent for it. Only accessed from the message loop.
+	callNoticeCallID string
+	callNoticesSent  map[callNoticeKind]struct{}
+	// Timers of pending reactor list updates by Discord message ID. Only accessed from the message loop.
+	reactorListTimers map[string]*time.Timer
+	// Matrix messages that are waiting in a send queue, and the edits, reactions and redactions of them
+	// that arrived in the meantime. Only accessed from the message loop.
+	pendingSends map[id.EventID][]portalMatrixMessage
+
+	outgoingNonces    *nonceTracker
+	outgoingReactions *nonceTracker
 }
 
 var _ bridge.Portal = (*Portal)(nil)
@@ -78,7 +115,11 @@ func (portal *Portal) MarkEncrypted() {
 
 func (portal *Portal) ReceiveMatrixEvent(user bridge.User, evt *event.Event) {
 	if user.GetPermissionLevel() >= bridgeconfig.PermissionLevelUser /*|| portal.HasRelaybot()*/ {
-		portal.matrixMessages <- portalMatrixMessage{user: user.(*User), evt: evt}
+		if sender := user.(*User); portal.bridge.handleCustomPrefixCommand(sender, evt) {
+			return
+		} else if !sender.bufferMatrixEventIfNeeded(portal, evt) {
+			portal.matrixMessages <- portalMatrixMessage{user: sender, evt: evt}
+		}
 	}
 }
 
@@ -177,6 +218,10 @@ func (br *DiscordBridge) GetAllPortals() []*Portal {
 	return br.dbPortalsToPortals(br.DB.Portal.GetAll())
 }
 
+func (br *DiscordBridge) GetAllPortalsInGuild(guildID string) []*Portal {
+	return br.dbPortalsToPortals(br.DB.Portal.FindByGuild(guildID))
+}
+
 func (br *DiscordBridge) GetAllIPortals() (iportals []bridge.Portal) {
 	portals := br.GetAllPortals()
 	iportals = make([]bridge.Portal, len(portals))
@@ -219,6 +264,17 @@ func (br *DiscordBridge) NewPortal(dbPortal *database.Portal) *Portal {
 
 		discordMessages: make(chan portalDiscordMessage, br.Config.Bridge.PortalMessageBuffer),
 		matrixMessages:  make(chan portalMatrixMessage, br.Config.Bridge.PortalMessageBuffer),
+		loopTasks:       make(chan func(), br.Config.Bridge.PortalMessageBuffer),
+
+		deferredResponses: make(map[string]struct{}),
+		polls:             make(map[string]*discordPoll),
+		pollRefreshTimers: make(map[string]*time.Timer),
+		slowmodeLastSend:  make(map[string]time.Time),
+		reactorListTimers: make(map[string]*time.Timer),
+		pendingSends:      make(map[id.EventID][]portalMatrixMessage),
+		pendingEdits:      newPendingEditQueue(time.Duration(br.Config.Bridge.PendingEditMaxWait) * time.Second),
+		outgoingNonces:    newNonceTracker(outgoingNonceTTL),
+		outgoingReactions: newNonceTracker(outgoingNonceTTL),
 	}
 
 	go portal.messageLoop()
@@ -233,10 +289,24 @@ func (portal *Portal) messageLoop() {
 			portal.handleMatrixMessages(msg)
 		case msg := <-portal.discordMessages:
 			portal.handleDiscordMessages(msg)
+		case task := <-portal.loopTasks:
+			task()
 		}
 	}
 }
 
+// runInLoop runs the given function in the message loop, so that it can safely touch the state of the portal.
+// It never blocks, so it's safe to call from the loop itself.
+func (portal *Portal) runInLoop(task func()) {
+	select {
+	case portal.loopTasks <- task:
+	default:
+		go func() {
+			portal.loopTasks <- task
+		}()
+	}
+}
+
 func (portal *Portal) IsPrivateChat() bool {
 	return portal.Type == discordgo.ChannelTypeDM
 }
@@ -249,6 +319,33 @@ func (portal *Portal) MainIntent() *appservice.IntentAPI {
 	return portal.bridge.Bot
 }
 
+// botDisplayname returns the display name the bridge bot should have in this portal.
+func (portal *Portal) botDisplayname() string {
+	if portal.BotDisplayname != "" {
+		return portal.BotDisplayname
+	}
+	return portal.bridge.Config.AppService.Bot.Displayname
+}
+
+// updateBotDisplayname applies the per-portal display name of the bridge bot to its room member event.
+func (portal *Portal) updateBotDisplayname() error {
+	if portal.MXID == "" {
+		return nil
+	}
+	bot := portal.bridge.Bot
+	member := bot.Member(portal.MXID, bot.UserID)
+	if member == nil || member.Membership != event.MembershipJoin {
+		return errors.New("the bridge bot isn't in this room")
+	}
+	content := *member
+	content.Displayname = portal.botDisplayname()
+	if content.Displayname == member.Displayname {
+		return nil
+	}
+	_, err := bot.SendStateEvent(portal.MXID, event.StateMember, bot.UserID.String(), &content)
+	return err
+}
+
 func (portal *Portal) getBridgeInfo() (string, event.BridgeEventContent) {
 	bridgeInfo := event.BridgeEventContent{
 		BridgeBot: portal.bridge.Bot.UserID,
@@ -430,6 +527,12 @@ func (portal *Portal) CreateMatrixRoom(user *User, channel *discordgo.Channel) e
 		}
 	}
 
+	if portal.BotDisplayname != "" {
+		if err = portal.updateBotDisplayname(); err != nil {
+			portal.log.Warnfln("Failed to set bridge bot display name: %v", err)
+		}
+	}
+
 	if portal.GuildID == "" {
 		user.addPrivateChannelToSpace(portal)
 	} else {
@@ -458,10 +561,26 @@ func (portal *Portal) CreateMatrixRoom(user *User, channel *discordgo.Channel) e
 	return nil
 }
 
+// bridgeDirection returns the message bridging direction of the guild the portal is in.
+func (portal *Portal) bridgeDirection() database.BridgeDirection {
+	if portal.Guild == nil {
+		return database.BridgeDirectionBoth
+	}
+	return portal.Guild.BridgeDirection
+}
+
 func (portal *Portal) handleDiscordMessages(msg portalDiscordMessage) {
+	if portal.Paused {
+		portal.log.Debugfln("Dropping %T as bridging is paused in the portal", msg.msg)
+		return
+	} else if !portal.bridgeDirection().AllowsDiscordToMatrix() {
+		portal.log.Debugfln("Dropping %T as the guild only bridges messages from Matrix to Discord", msg.msg)
+		return
+	}
 	if portal.MXID == "" {
 		_, ok := msg.msg.(*discordgo.MessageCreate)
-		if !ok {
+		_, okWithNonce := msg.msg.(*messageCreateWithNonce)
+		if !ok && !okWithNonce {
 			portal.log.Warnln("Can't create Matrix room from non new message event")
 			return
 		}
@@ -475,15 +594,26 @@ func (portal *Portal) handleDiscordMessages(msg portalDiscordMessage) {
 
 	switch convertedMsg := msg.msg.(type) {
 	case *discordgo.MessageCreate:
-		portal.handleDiscordMessageCreate(msg.user, convertedMsg.Message, msg.thread)
+		portal.handleDiscordMessageCreate(msg.user, convertedMsg.Message, msg.thread, nil)
+		portal.applyPendingEdit(convertedMsg.ID)
+	case *messageCreateWithNonce:
+		if !portal.handleOwnEcho(convertedMsg.Message, convertedMsg.Nonce, msg.thread) {
+			if convertedMsg.Poll != nil {
+				portal.polls[convertedMsg.ID] = convertedMsg.Poll
+			}
+			portal.handleDiscordMessageCreate(msg.user, convertedMsg.Message, msg.thread, convertedMsg.AttachmentFlags)
+		}
+		portal.applyPendingEdit(convertedMsg.ID)
 	case *discordgo.MessageUpdate:
-		portal.handleDiscordMessageUpdate(msg.user, convertedMsg.Message)
+		portal.handleDiscordMessageUpdate(msg.user, convertedMsg.Message, msg.thread)
 	case *discordgo.MessageDelete:
 		portal.handleDiscordMessageDelete(msg.user, convertedMsg.Message)
 	case *discordgo.MessageReactionAdd:
 		portal.handleDiscordReaction(msg.user, convertedMsg.MessageReaction, true, msg.thread)
 	case *discordgo.MessageReactionRemove:
 		portal.handleDiscordReaction(msg.user, convertedMsg.MessageReaction, false, msg.thread)
+	case *pollVote:
+		portal.queuePollRefresh(msg.user, convertedMsg.ChannelID, convertedMsg.MessageID)
 	default:
 		portal.log.Warnln("unknown message type")
 	}
@@ -518,8 +648,8 @@ func (portal *Portal) sendMediaFailedMessage(intent *appservice.IntentAPI, bridg
 
 const DiscordStickerSize = 160
 
-func (portal *Portal) handleDiscordFile(typeName string, intent *appservice.IntentAPI, id, url string, content *event.MessageEventContent, ts time.Time, threadRelation *event.RelatesTo) *database.MessagePart {
-	data, err := portal.downloadDiscordAttachment(url)
+func (portal *Portal) handleDiscordFile(source *User, typeName string, intent *appservice.IntentAPI, id, url string, content *event.MessageEventContent, ts time.Time, threadRelation *event.RelatesTo) *database.MessagePart {
+	data, err := portal.downloadDiscordAttachment(source, url)
 	if err != nil {
 		portal.sendMediaFailedMessage(intent, err)
 		return nil
@@ -563,7 +693,7 @@ func (portal *Portal) handleDiscordFile(typeName string, intent *appservice.Inte
 	}
 }
 
-func (portal *Portal) handleDiscordSticker(intent *appservice.IntentAPI, sticker *discordgo.Sticker, ts time.Time, threadRelation *event.RelatesTo) *database.MessagePart {
+func (portal *Portal) handleDiscordSticker(source *User, intent *appservice.IntentAPI, sticker *discordgo.Sticker, ts time.Time, threadRelation *event.RelatesTo) *database.MessagePart {
 	var mime string
 	switch sticker.FormatType {
 	case discordgo.StickerFormatTypePNG:
@@ -580,10 +710,10 @@ func (portal *Portal) handleDiscordSticker(intent *appservice.IntentAPI, sticker
 		},
 		RelatesTo: threadRelation,
 	}
-	return portal.handleDiscordFile("sticker", intent, sticker.ID, sticker.URL(), content, ts, threadRelation)
+	return portal.handleDiscordFile(source, "sticker", intent, sticker.ID, sticker.URL(), content, ts, threadRelation)
 }
 
-func (portal *Portal) handleDiscordAttachment(intent *appservice.IntentAPI, att *discordgo.MessageAttachment, ts time.Time, threadRelation *event.RelatesTo) *database.MessagePart {
+func (portal *Portal) handleDiscordAttachment(source *User, intent *appservice.IntentAPI, att *discordgo.MessageAttachment, flags int, ts time.Time, threadRelation *event.RelatesTo) *database.MessagePart {
 	// var captionContent *event.MessageEventContent
 
 	// if att.Description != "" {
@@ -594,71 +724,35 @@ func (portal *Portal) handleDiscordAttachment(intent *appservice.IntentAPI, att
 	// }
 	// portal.Log.Debugfln("captionContent: %#v", captionContent)
 
-	content := &event.MessageEventContent{
-		Body: att.Filename,
-		Info: &event.FileInfo{
-			Height:   att.Height,
-			MimeType: att.ContentType,
-			Width:    att.Width,
-
-			// This gets overwritten later after the file is uploaded to the homeserver
-			Size: att.Size,
-		},
-		RelatesTo: threadRelation,
-	}
-
-	switch strings.ToLower(strings.Split(att.ContentType, "/")[0]) {
-	case "audio":
-		content.MsgType = event.MsgAudio
-	case "image":
-		content.MsgType = event.MsgImage
-	case "video":
-		content.MsgType = event.MsgVideo
-	default:
-		content.MsgType = event.MsgFile
-	}
-	return portal.handleDiscordFile("attachment", intent, att.ID, att.URL, content, ts, threadRelation)
+	content := discordAttachmentToMatrixContent(att)
+	annotateDiscordAttachment(content, flags)
+	content.RelatesTo = threadRelation
+	return portal.handleDiscordFile(source, "attachment", intent, att.ID, att.URL, content, ts, threadRelation)
 }
 
-func (portal *Portal) handleDiscordMessageCreate(user *User, msg *discordgo.Message, thread *Thread) {
+// handleDiscordMessageCreate bridges a new Discord message. The attachment flags are parsed from the raw
+// message by attachment ID, as discordgo.MessageAttachment doesn't include them, and may be nil.
+func (portal *Portal) handleDiscordMessageCreate(user *User, msg *discordgo.Message, thread *Thread, attachmentFlags map[string]int) {
 	if portal.MXID == "" {
 		portal.log.Warnln("handle message called without a valid portal")
 
 		return
 	}
 
-	// Handle room name changes
-	if msg.Type == discordgo.MessageTypeChannelNameChange {
-		//channel, err := user.Session.Channel(msg.ChannelID)
-		//if err != nil {
-		//	portal.log.Errorf("Failed to find the channel for portal %s", portal.Key)
-		//	return
-		//}
-		//
-		//name, err := portal.bridge.Config.Bridge.FormatChannelname(channel, user.Session)
-		//if err != nil {
-		//	portal.log.Errorf("Failed to format name for portal %s", portal.Key)
-		//	return
-		//}
-		//
-		//portal.Name = name
-		//portal.Update()
-		//
-		//portal.MainIntent().SetRoomName(portal.MXID, name)
-
-		return
-	}
-
 	// Handle normal message
 	existing := portal.bridge.DB.Message.GetByDiscordID(portal.Key, msg.ID)
 	if existing != nil {
 		portal.log.Debugln("Dropping duplicate message", msg.ID)
 		return
 	}
+	if msg.Flags&discordgo.MessageFlagsLoading != 0 {
+		portal.log.Debugfln("Not bridging deferred interaction response %s until it's edited with the real content", msg.ID)
+		portal.deferredResponses[msg.ID] = struct{}{}
+		return
+	}
 	portal.log.Debugfln("Starting handling of %s by %s", msg.ID, msg.Author.ID)
 
-	puppet := portal.bridge.GetPuppetByID(msg.Author.ID)
-	puppet.UpdateInfo(user, msg.Author)
+	puppet := portal.getMessageAuthorPuppet(user, msg)
 	intent := puppet.IntentFor(portal)
 
 	var threadRelation *event.RelatesTo
@@ -673,24 +767,52 @@ func (portal *Portal) handleDiscordMessageCreate(user *User, msg *discordgo.Mess
 		threadRelation = (&event.RelatesTo{}).SetThread(thread.RootMXID, lastEventID)
 	}
 
-	var parts []database.MessagePart
 	ts, _ := discordgo.SnowflakeTimestamp(msg.ID)
-	if msg.Content != "" {
-		content := portal.renderDiscordMarkdown(msg.Content)
+	if msg.Type == discordgo.MessageTypeChannelPinnedMessage {
+		portal.handleDiscordPinNotice(intent, puppet, msg, ts, threadID, threadRelation)
+		return
+	} else if portal.handleDiscordChannelSystemMessage(user, intent, msg, ts, threadID, threadRelation) {
+		return
+	} else if msg.Type == messageTypePollResult {
+		portal.handleDiscordPollResult(user, intent, msg, ts, threadID, threadRelation)
+		return
+	} else if noticeText := integrationNoticeText(msg); noticeText != "" {
+		portal.handleDiscordIntegrationNotice(intent, msg, noticeText, ts, threadID, threadRelation)
+		return
+	} else if poll := portal.polls[msg.ID]; poll != nil {
+		portal.handleDiscordPoll(intent, msg, poll, ts, threadID, threadRelation)
+		return
+	}
+
+	var parts []database.MessagePart
+	var replyTo *database.Message
+	text := msg.Content
+	if msg.MessageReference != nil {
+		var crossLink string
+		replyTo, crossLink = portal.getReplyTarget(msg.MessageReference)
+		if crossLink != "" && text != "" {
+			text = fmt.Sprintf("> [In reply to a message in another channel](%s)\n\n%s", crossLink, text)
+		}
+	}
+	text = portal.appendEmbedsAndComponents(msg, text)
+	portal.buttonMessages.update(msg)
+	if text != "" {
+		content := portal.renderDiscordMarkdown(text)
 		content.RelatesTo = threadRelation.Copy()
 
-		if msg.MessageReference != nil {
-			//key := database.PortalKey{msg.MessageReference.ChannelID, user.ID}
-			replyTo := portal.bridge.DB.Message.GetByDiscordID(portal.Key, msg.MessageReference.MessageID)
-			if len(replyTo) > 0 {
-				if content.RelatesTo == nil {
-					content.RelatesTo = &event.RelatesTo{}
-				}
-				content.RelatesTo.SetReplyTo(replyTo[0].MXID)
+		if replyTo != nil {
+			if content.RelatesTo == nil {
+				content.RelatesTo = &event.RelatesTo{}
+			}
+			content.RelatesTo.SetReplyTo(replyTo.MXID)
+			if replyTo.AttachmentID != "" && msg.ReferencedMessage != nil {
+				// There's no text event to quote, so the fallback would be empty without this
+				sender := portal.replyTargetSender(replyTo)
+				addAttachmentReplyFallback(&content, portal.MXID, replyTo.MXID, sender, describeAttachments(msg.ReferencedMessage))
 			}
 		}
 
-		resp, err := portal.sendMatrixMessage(intent, event.EventMessage, &content, nil, ts.UnixMilli())
+		resp, err := portal.sendMatrixMessage(intent, event.EventMessage, &content, portal.convertDiscordMentions(user, msg), ts.UnixMilli())
 		if err != nil {
 			portal.log.Warnfln("Failed to send message %s to matrix: %v", msg.ID, err)
 			return
@@ -704,13 +826,13 @@ func (portal *Portal) handleDiscordMessageCreate(user *User, msg *discordgo.Mess
 		go portal.sendDeliveryReceipt(resp.EventID)
 	}
 	for _, att := range msg.Attachments {
-		part := portal.handleDiscordAttachment(intent, att, ts, threadRelation)
+		part := portal.handleDiscordAttachment(user, intent, att, attachmentFlags[att.ID], ts, threadRelation)
 		if part != nil {
 			parts = append(parts, *part)
 		}
 	}
 	for _, sticker := range msg.StickerItems {
-		part := portal.handleDiscordSticker(intent, sticker, ts, threadRelation)
+		part := portal.handleDiscordSticker(user, intent, sticker, ts, threadRelation)
 		if part != nil {
 			parts = append(parts, *part)
 		}
@@ -722,6 +844,97 @@ func (portal *Portal) handleDiscordMessageCreate(user *User, msg *discordgo.Mess
 	}
 }
 
+// getReplyTarget finds the bridged message referenced by a Discord message. If the message is in
+// this portal, it's returned so that it can be used as a Matrix reply. Messages in other portals
+// can't be replied to across rooms, so a matrix.to permalink is returned instead.
+func (portal *Portal) getReplyTarget(ref *discordgo.MessageReference) (*database.Message, string) {
+	if ref.MessageID == "" {
+		return nil, ""
+	}
+	replyTo := portal.bridge.DB.Message.GetByDiscordID(portal.Key, ref.MessageID)
+	if len(replyTo) > 0 {
+		return replyTo[0], ""
+	}
+	crossReply := portal.bridge.DB.Message.GetFirstByDiscordIDInAnyChannel(ref.MessageID)
+	if crossReply == nil {
+		return nil, ""
+	}
+	otherPortal := portal.bridge.GetExistingPortalByID(crossReply.Channel)
+	if otherPortal == nil || otherPortal.MXID == "" {
+		return nil, ""
+	}
+	return nil, otherPortal.MXID.EventURI(crossReply.MXID, portal.bridge.AS.HomeserverDomain).MatrixToURL()
+}
+
+// describeAttachments describes the attachments and stickers of a message that has no text,
+// e.g. "Image: cat.png". An empty string is returned for messages with text.
+func describeAttachments(msg *discordgo.Message) string {
+	if strings.TrimSpace(msg.Content) != "" {
+		return ""
+	}
+	var items []string
+	for _, att := range msg.Attachments {
+		kind := "File"
+		switch {
+		case strings.HasPrefix(att.ContentType, "image/"):
+			kind = "Image"
+		case strings.HasPrefix(att.ContentType, "video/"):
+			kind = "Video"
+		case strings.HasPrefix(att.ContentType, "audio/"):
+			kind = "Audio"
+		}
+		items = append(items, fmt.Sprintf("%s: %s", kind, discordAttachmentFilename(att)))
+	}
+	for _, sticker := range msg.StickerItems {
+		items = append(items, fmt.Sprintf("Sticker: %s", sticker.Name))
+	}
+	if len(items) > 1 {
+		return fmt.Sprintf("%d attachments (%s)", len(items), strings.Join(items, ", "))
+	}
+	return strings.Join(items, "")
+}
+
+// addAttachmentReplyFallback adds a reply fallback quoting the description of an attachment-only message.
+// The relation of the content, including any thread, is kept as is.
+func addAttachmentReplyFallback(content *event.MessageEventContent, roomID id.RoomID, targetID id.EventID, sender id.UserID, description string) {
+	if description == "" {
+		return
+	}
+	relatesTo := content.RelatesTo
+	content.SetReply(&event.Event{
+		ID:      targetID,
+		RoomID:  roomID,
+		Sender:  sender,
+		Content: event.Content{Parsed: &event.MessageEventContent{MsgType: event.MsgText, Body: description}},
+	})
+	content.RelatesTo = relatesTo
+}
+
+func (portal *Portal) handleDiscordPinNotice(intent *appservice.IntentAPI, puppet *Puppet, msg *discordgo.Message, ts time.Time, threadID string, threadRelation *event.RelatesTo) {
+	content := &event.MessageEventContent{
+		MsgType:   event.MsgNotice,
+		Body:      fmt.Sprintf("%s pinned a message", puppet.Name),
+		RelatesTo: threadRelation.Copy(),
+	}
+	if msg.MessageReference != nil {
+		pinned := portal.bridge.DB.Message.GetByDiscordID(portal.Key, msg.MessageReference.MessageID)
+		if len(pinned) > 0 {
+			if content.RelatesTo == nil {
+				content.RelatesTo = &event.RelatesTo{}
+			}
+			content.RelatesTo.SetReplyTo(pinned[0].MXID)
+		} else {
+			portal.log.Debugfln("Pinned message %s in pin notice %s isn't bridged", msg.MessageReference.MessageID, msg.ID)
+		}
+	}
+	resp, err := portal.sendMatrixMessage(intent, event.EventMessage, content, nil, ts.UnixMilli())
+	if err != nil {
+		portal.log.Warnfln("Failed to send pin notice %s to Matrix: %v", msg.ID, err)
+		return
+	}
+	portal.markMessageHandled(msg.ID, 0, msg.Author.ID, ts, threadID, []database.MessagePart{{MXID: resp.EventID}})
+}
+
 const JoinThreadReaction = "join thread"
 
 func (portal *Portal) sendThreadCreationNotice(thread *Thread) {
@@ -764,7 +977,24 @@ func (portal *Portal) sendThreadCreationNotice(thread *Thread) {
 	}
 }
 
-func (portal *Portal) handleDiscordMessageUpdate(user *User, msg *discordgo.Message) {
+// appendEmbedsAndComponents adds the rendered embeds and buttons of a message to its text.
+func (portal *Portal) appendEmbedsAndComponents(msg *discordgo.Message, text string) string {
+	if embedText := portal.renderDiscordEmbeds(msg); embedText != "" {
+		if text != "" {
+			text += "\n\n"
+		}
+		text += embedText
+	}
+	if componentText := renderDiscordComponents(msg); componentText != "" {
+		if text != "" {
+			text += "\n\n"
+		}
+		text += componentText
+	}
+	return text
+}
+
+func (portal *Portal) handleDiscordMessageUpdate(user *User, msg *discordgo.Message, thread *Thread) {
 	if portal.MXID == "" {
 		portal.log.Warnln("handle message called without a valid portal")
 
@@ -773,7 +1003,18 @@ func (portal *Portal) handleDiscordMessageUpdate(user *User, msg *discordgo.Mess
 
 	existing := portal.bridge.DB.Message.GetByDiscordID(portal.Key, msg.ID)
 	if existing == nil {
-		portal.log.Warnfln("Dropping update of unknown message %s", msg.ID)
+		if _, deferred := portal.deferredResponses[msg.ID]; deferred && msg.Flags&discordgo.MessageFlagsLoading != 0 {
+			portal.log.Debugfln("Deferred interaction response %s is still loading", msg.ID)
+		} else if deferred && msg.Author != nil {
+			delete(portal.deferredResponses, msg.ID)
+			portal.log.Debugfln("Deferred interaction response %s got its real content, bridging it as a new message", msg.ID)
+			portal.handleDiscordMessageCreate(user, msg, thread, nil)
+		} else if msg.Author != nil && portal.pendingEdits.Add(user, msg, thread) {
+			// Updates without an author are embed previews, which aren't bridged anyway
+			portal.log.Debugfln("Deferring update of %s until the message itself is bridged", msg.ID)
+		} else {
+			portal.log.Warnfln("Dropping update of unknown message %s", msg.ID)
+		}
 		return
 	}
 
@@ -803,7 +1044,7 @@ func (portal *Portal) handleDiscordMessageUpdate(user *User, msg *discordgo.Mess
 		return
 	}
 
-	intent := portal.bridge.GetPuppetByID(msg.Author.ID).IntentFor(portal)
+	intent := portal.getMessageAuthor(msg).IntentFor(portal)
 
 	attachmentMap := map[string]*database.Message{}
 	for _, existingPart := range existing {
@@ -828,13 +1069,23 @@ func (portal *Portal) handleDiscordMessageUpdate(user *User, msg *discordgo.Mess
 		}
 		deletedAttachment.Delete()
 	}
+	remaining := make([]*database.Message, 0, len(existing))
+	for _, part := range existing {
+		if _, deleted := attachmentMap[part.AttachmentID]; !deleted {
+			remaining = append(remaining, part)
+		}
+	}
+	portal.handleDiscordAddedAttachments(user, intent, msg, existing, thread)
 
-	if msg.Content == "" || existing[0].AttachmentID != "" {
-		portal.log.Debugfln("Dropping non-text edit to %s (message on matrix: %t, text on discord: %t)", msg.ID, existing[0].AttachmentID == "", len(msg.Content) > 0)
+	text := portal.appendEmbedsAndComponents(msg, msg.Content)
+	if text == "" || len(remaining) == 0 || remaining[0].AttachmentID != "" {
+		portal.log.Debugfln("Dropping non-text edit to %s (message on matrix: %t, text on discord: %t)", msg.ID, len(remaining) > 0 && remaining[0].AttachmentID == "", len(text) > 0)
 		return
 	}
-	content := portal.renderDiscordMarkdown(msg.Content)
-	content.SetEdit(existing[0].MXID)
+	// The buttons are only renumbered once the edit that shows the new numbers is bridged
+	portal.buttonMessages.update(msg)
+	content := portal.renderDiscordMarkdown(text)
+	content.SetEdit(remaining[0].MXID)
 
 	var editTS int64
 	if msg.EditedTimestamp != nil {
@@ -853,7 +1104,46 @@ func (portal *Portal) handleDiscordMessageUpdate(user *User, msg *discordgo.Mess
 	//portal.markMessageHandled(existing, msg.ID, resp.EventID, msg.Author.ID, ts)
 }
 
+// handleDiscordAddedAttachments bridges attachments that were added to an already bridged message in an edit.
+func (portal *Portal) handleDiscordAddedAttachments(user *User, intent *appservice.IntentAPI, msg *discordgo.Message, existing []*database.Message, thread *Thread) {
+	known := make(map[string]struct{}, len(existing))
+	for _, part := range existing {
+		known[part.AttachmentID] = struct{}{}
+	}
+	var threadRelation *event.RelatesTo
+	if thread != nil {
+		lastEventID := thread.RootMXID
+		lastInThread := portal.bridge.DB.Message.GetLastInThread(portal.Key, thread.ID)
+		if lastInThread != nil {
+			lastEventID = lastInThread.MXID
+		}
+		threadRelation = (&event.RelatesTo{}).SetThread(thread.RootMXID, lastEventID)
+	}
+	var ts time.Time
+	if msg.EditedTimestamp != nil {
+		ts = *msg.EditedTimestamp
+	} else {
+		ts = time.Now()
+	}
+	var parts []database.MessagePart
+	for _, att := range msg.Attachments {
+		if _, found := known[att.ID]; found {
+			continue
+		}
+		part := portal.handleDiscordAttachment(user, intent, att, 0, ts, threadRelation)
+		if part != nil {
+			parts = append(parts, *part)
+		}
+	}
+	if len(parts) > 0 {
+		portal.log.Debugfln("Bridged %d attachments added to %s in an edit", len(parts), msg.ID)
+		portal.markMessageHandled(msg.ID, 0, existing[0].SenderID, existing[0].Timestamp, existing[0].ThreadID, parts)
+	}
+}
+
 func (portal *Portal) handleDiscordMessageDelete(user *User, msg *discordgo.Message) {
+	delete(portal.deferredResponses, msg.ID)
+	portal.pendingEdits.Discard(msg.ID)
 	existing := portal.bridge.DB.Message.GetByDiscordID(portal.Key, msg.ID)
 	intent := portal.MainIntent()
 	var lastResp id.EventID
@@ -882,13 +1172,69 @@ func (portal *Portal) syncParticipants(source *User, participants []*discordgo.U
 		}
 
 		if user == nil || !puppet.IntentFor(portal).IsCustomPuppet {
-			if err := puppet.IntentFor(portal).EnsureJoined(portal.MXID); err != nil {
+			intent := puppet.IntentFor(portal)
+			joined := portal.bridge.AS.StateStore.IsInRoom(portal.MXID, intent.UserID)
+			if err := intent.EnsureJoined(portal.MXID); err != nil {
 				portal.log.Warnfln("Failed to make puppet of %s join %s: %v", participant.ID, portal.MXID, err)
+			} else if !joined {
+				portal.applyPuppetPowerLevel([]id.UserID{intent.UserID}, nil)
 			}
 		}
 	}
 }
 
+// copyPowerLevels makes a copy of power levels that can be changed without touching the cached copy in the state store.
+func copyPowerLevels(levels *event.PowerLevelsEventContent) (*event.PowerLevelsEventContent, error) {
+	data, err := json.Marshal(levels)
+	if err != nil {
+		return nil, err
+	}
+	var copied event.PowerLevelsEventContent
+	err = json.Unmarshal(data, &copied)
+	return &copied, err
+}
+
+// applyPuppetPowerLevel gives puppets the puppet power level of the portal's guild. It's applied when puppets join
+// and when the setting changes. Puppets with their own entry in the power levels are left alone, as Matrix admins
+// may have changed them on purpose, unless the entry is the previous setting, which was applied by the bridge.
+func (portal *Portal) applyPuppetPowerLevel(userIDs []id.UserID, previous *int) {
+	if portal.Guild == nil || portal.MXID == "" || (portal.Guild.PuppetPowerLevel == 0 && previous == nil) {
+		return
+	}
+	cached, err := portal.MainIntent().PowerLevels(portal.MXID)
+	if err != nil {
+		portal.log.Warnfln("Failed to get power levels to apply the puppet power level: %v", err)
+		return
+	}
+	levels, err := copyPowerLevels(cached)
+	if err != nil {
+		portal.log.Warnfln("Failed to copy power levels: %v", err)
+		return
+	}
+	level := portal.Guild.PuppetPowerLevel
+	if level == 0 {
+		level = levels.UsersDefault
+	}
+	changed := false
+	for _, userID := range userIDs {
+		if !portal.bridge.IsGhost(userID) {
+			continue
+		}
+		current, explicit := levels.Users[userID]
+		if (!explicit || (previous != nil && current == *previous)) && levels.GetUserLevel(userID) != level {
+			levels.SetUserLevel(userID, level)
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	_, err = portal.MainIntent().SetPowerLevels(portal.MXID, levels)
+	if err != nil {
+		portal.log.Warnfln("Failed to set the power level of puppets to %d: %v", level, err)
+	}
+}
+
 func (portal *Portal) encrypt(intent *appservice.IntentAPI, content *event.Content, eventType event.Type) (event.Type, error) {
 	if !portal.Encrypted || portal.bridge.Crypto == nil {
 		return eventType, nil
@@ -912,15 +1258,35 @@ func (portal *Portal) sendMatrixMessage(intent *appservice.IntentAPI, eventType
 		return nil, err
 	}
 
+	// Sending makes the puppet join the room if it isn't there yet
+	joined := intent.IsCustomPuppet || portal.bridge.AS.StateStore.IsInRoom(portal.MXID, intent.UserID)
 	_, _ = intent.UserTyping(portal.MXID, false, 0)
+	var resp *mautrix.RespSendEvent
 	if timestamp == 0 {
-		return intent.SendMessageEvent(portal.MXID, eventType, &wrappedContent)
+		resp, err = intent.SendMessageEvent(portal.MXID, eventType, &wrappedContent)
 	} else {
-		return intent.SendMassagedMessageEvent(portal.MXID, eventType, &wrappedContent, timestamp)
+		resp, err = intent.SendMassagedMessageEvent(portal.MXID, eventType, &wrappedContent, timestamp)
 	}
+	if err == nil && !joined {
+		portal.applyPuppetPowerLevel([]id.UserID{intent.UserID}, nil)
+	}
+	return resp, err
 }
 
 func (portal *Portal) handleMatrixMessages(msg portalMatrixMessage) {
+	if portal.Paused {
+		go portal.sendMessageMetrics(msg.evt, errPortalPaused, "Ignoring")
+		return
+	} else if !portal.bridgeDirection().AllowsMatrixToDiscord() {
+		go portal.sendMessageMetrics(msg.evt, errBridgeDirectionDisabled, "Ignoring")
+		return
+	} else if target := matrixEventTarget(msg.evt); target != "" {
+		if deferred, pending := portal.pendingSends[target]; pending {
+			portal.log.Debugfln("Deferring %s until %s has been sent to Discord", msg.evt.ID, target)
+			portal.pendingSends[target] = append(deferred, msg)
+			return
+		}
+	}
 	switch msg.evt.Type {
 	case event.EventMessage:
 		portal.handleMatrixMessage(msg.user, msg.evt)
@@ -928,11 +1294,36 @@ func (portal *Portal) handleMatrixMessages(msg portalMatrixMessage) {
 		portal.handleMatrixRedaction(msg.user, msg.evt)
 	case event.EventReaction:
 		portal.handleMatrixReaction(msg.user, msg.evt)
+	case event.StatePinnedEvents:
+		portal.handleMatrixPins(msg.user, msg.evt)
 	default:
 		portal.log.Debugln("unknown event type", msg.evt.Type)
 	}
 }
 
+// matrixEventTarget returns the ID of the message that an edit, reaction or redaction applies to.
+func matrixEventTarget(evt *event.Event) id.EventID {
+	switch evt.Type {
+	case event.EventMessage:
+		return evt.Content.AsMessage().GetRelatesTo().GetReplaceID()
+	case event.EventReaction:
+		return evt.Content.AsReaction().RelatesTo.EventID
+	case event.EventRedaction:
+		return evt.Redacts
+	}
+	return ""
+}
+
+// handleDeferredMatrixEvents handles the events that were waiting for a message to be sent to Discord.
+// It must be called from the loop once the send has finished, whether it succeeded or not.
+func (portal *Portal) handleDeferredMatrixEvents(sentID id.EventID) {
+	deferred := portal.pendingSends[sentID]
+	delete(portal.pendingSends, sentID)
+	for _, msg := range deferred {
+		portal.handleMatrixMessages(msg)
+	}
+}
+
 const discordEpoch = 1420070400000
 
 func generateNonce() string {
@@ -941,6 +1332,17 @@ func generateNonce() string {
 	return strconv.FormatInt(snowflake, 10)
 }
 
+// replyTargetSender finds the Matrix sender of a bridged message. The original event is checked, as messages
+// sent from Matrix have the Discord ID of the logged-in user or webhook, not of a puppet that sent them.
+func (portal *Portal) replyTargetSender(target *database.Message) id.UserID {
+	evt, err := portal.getEvent(target.MXID)
+	if err != nil {
+		portal.log.Debugfln("Failed to get reply target %s, guessing the sender from the Discord author: %v", target.MXID, err)
+		return portal.bridge.GetPuppetByID(target.SenderID).MXID
+	}
+	return evt.Sender
+}
+
 func (portal *Portal) getEvent(mxid id.EventID) (*event.Event, error) {
 	evt, err := portal.MainIntent().GetEvent(portal.MXID, mxid)
 	if err != nil {
@@ -994,8 +1396,9 @@ func (portal *Portal) startThreadFromMatrix(sender *User, threadRoot id.EventID)
 	} else {
 		var ch *discordgo.Channel
 		ch, err = sender.Session.MessageThreadStartComplex(portal.Key.ChannelID, existingMsg.DiscordID, &discordgo.ThreadStart{
-			Name:                threadName,
-			AutoArchiveDuration: 24 * 60,
+			Name: threadName,
+			// Zero is omitted from the request, which makes Discord use the channel's default
+			AutoArchiveDuration: portal.ThreadArchiveDuration,
 			Type:                discordgo.ChannelTypeGuildPublicThread,
 			Location:            "Message",
 		})
@@ -1035,6 +1438,10 @@ var (
 	errUnknownRelationType         = errors.New("unknown relation type")
 	errTargetNotFound              = errors.New("target event not found")
 	errUnknownEmoji                = errors.New("unknown emoji")
+	errNoPinPermission             = errors.New("you don't have the Manage Messages permission in this channel")
+	errSendRetriesExhausted        = errors.New("giving up")
+	errBridgeDirectionDisabled     = errors.New("this guild is only bridged from Discord to Matrix")
+	errPortalPaused                = errors.New("bridging is paused in this room")
 )
 
 func errorToStatusReason(err error) (reason event.MessageStatusReason, status event.MessageStatus, isCertain, sendNotice bool, humanMessage string) {
@@ -1053,10 +1460,25 @@ func errorToStatusReason(err error) (reason event.MessageStatusReason, status ev
 		return event.MessageStatusUndecryptable, event.MessageStatusFail, true, true, ""
 	case errors.Is(err, errUserNotReceiver):
 		return event.MessageStatusNoPermission, event.MessageStatusFail, true, false, ""
+	case errors.Is(err, errBridgeDirectionDisabled):
+		return event.MessageStatusNoPermission, event.MessageStatusFail, true, true, ""
+	case errors.Is(err, errPortalPaused):
+		return event.MessageStatusNoPermission, event.MessageStatusFail, true, false, ""
+	case errors.Is(err, errButtonDisabled),
+		errors.Is(err, errInteractionNotFound),
+		errors.Is(err, errInteractionFailed),
+		errors.Is(err, errInteractionTimeout):
+		return event.MessageStatusGenericError, event.MessageStatusFail, true, true, ""
 	case errors.Is(err, errUnknownEditTarget):
 		return event.MessageStatusGenericError, event.MessageStatusFail, true, false, ""
 	case errors.Is(err, errTargetNotFound):
 		return event.MessageStatusGenericError, event.MessageStatusFail, true, false, ""
+	case errors.Is(err, errSendRetriesExhausted),
+		errors.Is(err, errMassMentionRateLimited),
+		errors.Is(err, errSlowmodeActive),
+		errors.Is(err, errSendBufferFull),
+		errors.Is(err, errSendBufferExpired):
+		return event.MessageStatusGenericError, event.MessageStatusFail, true, true, ""
 	default:
 		return event.MessageStatusGenericError, event.MessageStatusRetriable, false, true, ""
 	}
@@ -1115,6 +1537,12 @@ func (portal *Portal) sendMessageMetrics(evt *event.Event, err error, part strin
 			level = log.LevelDebug
 		}
 		portal.log.Logfln(level, "%s %s %s from %s: %v", part, msgType, evtDescription, evt.Sender, err)
+		if sender := portal.bridge.GetUserByMXID(evt.Sender); sender != nil && part != "Ignoring" {
+			sender.logError("send", fmt.Sprintf("%s %s %s in %s: %v", part, msgType, evt.ID, portal.MXID, err))
+			if isInvalidTokenError(err) {
+				sender.handleInvalidToken(err)
+			}
+		}
 		reason, statusCode, isCertain, sendNotice, _ := errorToStatusReason(err)
 		checkpointStatus := status.ReasonToCheckpointStatus(reason, statusCode)
 		portal.bridge.SendMessageCheckpoint(evt, status.MsgStepRemote, err, checkpointStatus, 0)
@@ -1144,6 +1572,8 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 
 	channelID := portal.Key.ChannelID
 	var threadID string
+	// The thread root to reply to when Matrix threads are sent as replies instead of Discord threads
+	var threadRootReply id.EventID
 
 	if editMXID := content.GetRelatesTo().GetReplaceID(); editMXID != "" && content.NewContent != nil {
 		edits := portal.bridge.DB.Message.GetByMXID(portal.Key, editMXID)
@@ -1160,6 +1590,8 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 		existingThread := portal.bridge.DB.Thread.GetByMatrixRootMsg(threadRoot)
 		if existingThread != nil {
 			threadID = existingThread.ID
+		} else if portal.bridge.Config.Bridge.ThreadsAsReplies {
+			threadRootReply = threadRoot
 		} else {
 			var err error
 			threadID, err = portal.startThreadFromMatrix(sender, threadRoot)
@@ -1170,6 +1602,9 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 	}
 	if threadID != "" {
 		channelID = threadID
+	} else if err := portal.checkSlowmode(sender); err != nil {
+		go portal.sendMessageMetrics(evt, err, "Error sending")
+		return
 	}
 
 	var sendReq discordgo.MessageSend
@@ -1194,22 +1629,55 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 		}
 
 		sendReq.Files = []*discordgo.File{{
-			Name:        content.Body,
+			Name:        matrixContentFileName(content),
 			ContentType: content.Info.MimeType,
 			Reader:      bytes.NewReader(data),
 		}}
 		if content.FileName != "" && content.FileName != content.Body {
-			sendReq.Files[0].Name = content.FileName
 			sendReq.Content = portal.parseMatrixHTML(sender, content)
 		}
 	default:
 		go portal.sendMessageMetrics(evt, fmt.Errorf("%w %q", errUnknownMsgType, content.MsgType), "Ignoring")
 		return
 	}
+	if sendReq.Reference == nil && threadRootReply != "" {
+		if rootMsg := portal.bridge.DB.Message.GetByMXID(portal.Key, threadRootReply); rootMsg != nil && rootMsg.ThreadID == "" {
+			sendReq.Reference = &discordgo.MessageReference{
+				ChannelID: channelID,
+				MessageID: rootMsg.DiscordID,
+			}
+		}
+	}
+	sendReq.AllowedMentions = portal.restrictMassMentions(sender, sendReq.Content)
 	sendReq.Nonce = generateNonce()
-	msg, err := sender.Session.ChannelMessageSendComplex(channelID, &sendReq)
+	portal.outgoingNonces.Add(sendReq.Nonce, evt.ID)
+	// Sends may have to wait for the rate cap or retries, so they're made in the sender's queue
+	// to keep the other messages in the room flowing. Events that target the message wait until it's sent.
+	portal.pendingSends[evt.ID] = nil
+	sender.sendQueue.push(func() {
+		msg, err := portal.sendDiscordMessageWithRetry(sender, evt, content, channelID, &sendReq)
+		portal.runInLoop(func() {
+			portal.finishMatrixMessage(sender, evt, &sendReq, threadID, msg, err)
+			portal.handleDeferredMatrixEvents(evt.ID)
+		})
+	})
+}
+
+// finishMatrixMessage stores the result of sending a Matrix message to Discord.
+func (portal *Portal) finishMatrixMessage(sender *User, evt *event.Event, sendReq *discordgo.MessageSend, threadID string, msg *discordgo.Message, err error) {
 	go portal.sendMessageMetrics(evt, err, "Error sending")
 	if msg != nil {
+		portal.outgoingNonces.Pop(sendReq.Nonce)
+		if threadID == "" {
+			portal.slowmodeLastSend[sender.DiscordID] = time.Now()
+		}
+		if sendReq.AllowedMentions != nil {
+			portal.sendMassMentionNotice()
+		}
+		if portal.bridge.DB.Message.GetByDiscordID(portal.Key, msg.ID) != nil {
+			// The gateway echo was already handled
+			return
+		}
 		dbMsg := portal.bridge.DB.Message.New()
 		dbMsg.Channel = portal.Key
 		dbMsg.DiscordID = msg.ID
@@ -1224,6 +1692,62 @@ func (portal *Portal) handleMatrixMessage(sender *User, evt *event.Event) {
 	}
 }
 
+// sendDiscordMessageWithRetry sends a message to Discord, retrying temporary failures up to
+// the configured number of times. Messages that can't be delivered are saved as dead letters.
+// This is called from the sender's send queue, so waiting between attempts doesn't block the portal.
+func (portal *Portal) sendDiscordMessageWithRetry(sender *User, evt *event.Event, content *event.MessageEventContent, channelID string, sendReq *discordgo.MessageSend) (*discordgo.Message, error) {
+	maxRetries := portal.bridge.Config.Bridge.MaxSendRetries
+	if wait := sender.waitForSendSlot(); wait > 0 {
+		portal.log.Debugfln("Delayed sending %s by %s to stay under the outgoing message rate cap", evt.ID, wait)
+	}
+	if sender.Session == nil {
+		// The user may have been disconnected while the message was queued
+		return nil, ErrNotConnected
+	}
+	// Only track the route once the request has created its bucket
+	defer sender.trackRoute(discordgo.EndpointChannelMessages(channelID))
+	attempts := 0
+	for {
+		attempts++
+		var msg *discordgo.Message
+		var err error
+		if portal.pingsEveryone(sendReq) {
+			msg, err = portal.sendMassMentionMessage(sender, channelID, sendReq)
+		} else {
+			msg, err = sendMessageEnforceNonce(sender.Session, channelID, sendReq)
+		}
+		if err == nil {
+			return msg, nil
+		} else if errors.Is(err, errMassMentionRateLimited) || !isRetriableDiscordError(err) {
+			return nil, err
+		} else if attempts > maxRetries {
+			portal.saveDeadLetter(evt, content, channelID, attempts, err)
+			return nil, fmt.Errorf("%w after %d attempts: %v", errSendRetriesExhausted, attempts, err)
+		}
+		backoff := time.Duration(attempts) * 2 * time.Second
+		portal.log.Debugfln("Failed to send %s (attempt %d/%d), retrying in %s: %v", evt.ID, attempts, maxRetries+1, backoff, err)
+		time.Sleep(backoff)
+		rewindFiles(sendReq.Files)
+	}
+}
+
+func (portal *Portal) saveDeadLetter(evt *event.Event, content *event.MessageEventContent, channelID string, attempts int, reason error) {
+	body := content.Body
+	if runes := []rune(body); len(runes) > 200 {
+		body = string(runes[:200]) + "…"
+	}
+	letter := portal.bridge.DB.DeadLetter.New()
+	letter.MXID = evt.ID
+	letter.RoomID = evt.RoomID
+	letter.Sender = evt.Sender
+	letter.ChannelID = channelID
+	letter.Body = body
+	letter.Attempts = attempts
+	letter.Reason = reason.Error()
+	letter.Timestamp = time.Now()
+	letter.Insert()
+}
+
 func (portal *Portal) sendDeliveryReceipt(eventID id.EventID) {
 	if portal.bridge.Config.Bridge.DeliveryReceipts {
 		err := portal.bridge.Bot.MarkRead(portal.MXID, eventID)
@@ -1341,6 +1865,38 @@ func (portal *Portal) cleanup(puppetsOnly bool) {
 	}
 }
 
+// archive disconnects the portal room from Discord without cleaning it up,
+// so the bridged history stays available in Matrix.
+func (portal *Portal) archive() {
+	if portal.MXID != "" {
+		archived := portal.bridge.DB.ArchivedRoom.New()
+		archived.MXID = portal.MXID
+		archived.DiscordID = portal.Key.ChannelID
+		archived.GuildID = portal.GuildID
+		archived.Name = portal.Name
+		archived.ArchivedAt = time.Now()
+		archived.Insert()
+
+		stateKey, _ := portal.getBridgeInfo()
+		_, err := portal.MainIntent().SendStateEvent(portal.MXID, event.StateBridge, stateKey, struct{}{})
+		if err != nil {
+			portal.log.Warnln("Failed to remove m.bridge:", err)
+		}
+		_, err = portal.MainIntent().SendStateEvent(portal.MXID, event.StateHalfShotBridge, stateKey, struct{}{})
+		if err != nil {
+			portal.log.Warnln("Failed to remove uk.half-shot.bridge:", err)
+		}
+		_, err = portal.sendMatrixMessage(portal.MainIntent(), event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    "This room has been disconnected from Discord. The history is kept, but new messages won't be bridged.",
+		}, nil, 0)
+		if err != nil {
+			portal.log.Warnln("Failed to send unbridge notice:", err)
+		}
+	}
+	portal.Delete()
+}
+
 func (portal *Portal) getMatrixUsers() ([]id.UserID, error) {
 	members, err := portal.MainIntent().JoinedMembers(portal.MXID)
 	if err != nil {
@@ -1386,6 +1942,15 @@ func (portal *Portal) handleMatrixReaction(sender *User, evt *event.Event) {
 		return
 	}
 
+	if index := buttonReactionIndex(reaction.RelatesTo.Key); index >= 0 && portal.handleMatrixButtonClick(sender, evt, msg, index) {
+		return
+	}
+	portal.sendMatrixReaction(sender, evt, msg)
+}
+
+// sendMatrixReaction sends a Matrix reaction to the Discord message it reacts to.
+func (portal *Portal) sendMatrixReaction(sender *User, evt *event.Event, msg *database.Message) {
+	reaction := evt.Content.AsReaction()
 	firstMsg := msg
 	if msg.AttachmentID != "" {
 		firstMsg = portal.bridge.DB.Message.GetFirstByDiscordID(portal.Key, msg.DiscordID)
@@ -1394,6 +1959,7 @@ func (portal *Portal) handleMatrixReaction(sender *User, evt *event.Event) {
 
 	// Figure out if this is a custom emoji or not.
 	emojiID := reaction.RelatesTo.Key
+	var echoEmoji discordgo.Emoji
 	if strings.HasPrefix(emojiID, "mxc://") {
 		uri, _ := id.ParseContentURI(emojiID)
 		emoji := portal.bridge.DB.Emoji.GetByMatrixURL(uri)
@@ -1403,8 +1969,10 @@ func (portal *Portal) handleMatrixReaction(sender *User, evt *event.Event) {
 		}
 
 		emojiID = emoji.APIName()
+		echoEmoji.ID = emoji.DiscordID
 	} else {
 		emojiID = variationselector.Remove(emojiID)
+		echoEmoji.Name = emojiID
 	}
 
 	existing := portal.bridge.DB.Reaction.GetByDiscordID(portal.Key, msg.DiscordID, sender.DiscordID, emojiID)
@@ -1414,9 +1982,12 @@ func (portal *Portal) handleMatrixReaction(sender *User, evt *event.Event) {
 		return
 	}
 
+	echoKey := reactionEchoKey(msg.DiscordID, sender.DiscordID, &echoEmoji)
+	portal.outgoingReactions.Add(echoKey, evt.ID)
 	err := sender.Session.MessageReactionAdd(msg.DiscordProtoChannelID(), msg.DiscordID, emojiID)
 	go portal.sendMessageMetrics(evt, err, "Error sending")
 	if err == nil {
+		portal.outgoingReactions.Pop(echoKey)
 		dbReaction := portal.bridge.DB.Reaction.New()
 		dbReaction.Channel = portal.Key
 		dbReaction.MessageID = msg.DiscordID
@@ -1426,10 +1997,12 @@ func (portal *Portal) handleMatrixReaction(sender *User, evt *event.Event) {
 		dbReaction.ThreadID = msg.ThreadID
 		dbReaction.MXID = evt.ID
 		dbReaction.Insert()
+		portal.queueReactorListUpdate(dbReaction.MessageID)
 	}
 }
 
 func (portal *Portal) handleDiscordReaction(user *User, reaction *discordgo.MessageReaction, add bool, thread *Thread) {
+	// Reactions of the logged-in user from other clients are sent with their double puppet if it's available.
 	intent := portal.bridge.GetPuppetByID(reaction.UserID).IntentFor(portal)
 
 	var discordID string
@@ -1455,7 +2028,7 @@ func (portal *Portal) handleDiscordReaction(user *User, reaction *discordgo.Mess
 	}
 
 	// Lookup an existing reaction
-	existing := portal.bridge.DB.Reaction.GetByDiscordID(portal.Key, message[0].DiscordID, reaction.UserID, discordID)
+	existing := portal.getExistingReaction(message[0].DiscordID, reaction.UserID, &reaction.Emoji)
 	if !add {
 		if existing == nil {
 			portal.log.Debugln("Failed to remove reaction for unknown message", reaction.MessageID)
@@ -1468,11 +2041,14 @@ func (portal *Portal) handleDiscordReaction(user *User, reaction *discordgo.Mess
 		}
 
 		existing.Delete()
+		portal.queueReactorListUpdate(existing.MessageID)
 		go portal.sendDeliveryReceipt(resp.EventID)
 		return
 	} else if existing != nil {
 		portal.log.Debugfln("Ignoring duplicate reaction %s from %s to %s", discordID, reaction.UserID, message[0].DiscordID)
 		return
+	} else if portal.handleOwnReactionEcho(reaction, message[0], thread) {
+		return
 	}
 
 	content := event.ReactionEventContent{
@@ -1501,10 +2077,256 @@ func (portal *Portal) handleDiscordReaction(user *User, reaction *discordgo.Mess
 			dbReaction.ThreadID = thread.ID
 		}
 		dbReaction.Insert()
+		portal.queueReactorListUpdate(dbReaction.MessageID)
 		portal.sendDeliveryReceipt(dbReaction.MXID)
 	}
 }
 
+func (portal *Portal) HandleMatrixMeta(brSender bridge.User, evt *event.Event) {
+	if evt.Type != event.StatePinnedEvents {
+		return
+	}
+	portal.ReceiveMatrixEvent(brSender, evt)
+}
+
+// userHasPermission checks whether the user has the given permission in the Discord channel of this portal.
+func (portal *Portal) userHasPermission(sender *User, permission int64) (bool, error) {
+	perms, err := sender.Session.UserChannelPermissions(sender.DiscordID, portal.Key.ChannelID)
+	if err != nil {
+		return false, err
+	}
+	return perms&permission == permission, nil
+}
+
+var massMentionRegex = regexp.MustCompile(`@(everyone|here)\b`)
+
+// restrictMassMentions returns allowed mentions that make Discord render @everyone and @here as plain text
+// if the message contains them and the sender doesn't have the Mention Everyone permission.
+// Otherwise nil is returned and Discord's default mention parsing is used.
+func (portal *Portal) restrictMassMentions(sender *User, content string) *discordgo.MessageAllowedMentions {
+	if portal.GuildID == "" || !massMentionRegex.MatchString(content) {
+		return nil
+	}
+	allowed, err := portal.userHasPermission(sender, discordgo.PermissionMentionEveryone)
+	if err != nil {
+		portal.log.Warnfln("Failed to check if %s can mention everyone: %v", sender.DiscordID, err)
+		return nil
+	} else if allowed {
+		return nil
+	}
+	return &discordgo.MessageAllowedMentions{
+		Parse:       []discordgo.AllowedMentionType{discordgo.AllowedMentionTypeUsers, discordgo.AllowedMentionTypeRoles},
+		RepliedUser: true,
+	}
+}
+
+func (portal *Portal) sendMassMentionNotice() {
+	if !portal.bridge.Config.Bridge.MessageErrorNotices {
+		return
+	}
+	_, err := portal.sendMatrixMessage(portal.MainIntent(), event.EventMessage, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    "\u26a0 You don't have permission to mention @everyone or @here in this channel, so your message was sent without pinging anyone",
+	}, nil, 0)
+	if err != nil {
+		portal.log.Warnln("Failed to send mass mention notice:", err)
+	}
+}
+
+func (portal *Portal) canManageMessages(sender *User) (bool, error) {
+	if portal.IsPrivateChat() || portal.GuildID == "" {
+		// Anyone can pin messages in DMs and group DMs
+		return true, nil
+	}
+	return portal.userHasPermission(sender, discordgo.PermissionManageMessages)
+}
+
+// editDiscordChannel sends a partial channel modification to Discord. discordgo.ChannelEdit always
+// includes the position field, so a plain map is used to only change the fields that are set.
+func (portal *Portal) editDiscordChannel(sender *User, data map[string]interface{}) (*discordgo.Channel, error) {
+	endpoint := discordgo.EndpointChannel(portal.Key.ChannelID)
+	resp, err := sender.Session.RequestWithBucketID(http.MethodPatch, endpoint, data, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	var channel discordgo.Channel
+	err = json.Unmarshal(resp, &channel)
+	if err != nil {
+		return nil, err
+	}
+	return &channel, nil
+}
+
+func diffPinnedEvents(prev, cur []id.EventID) (added, removed []id.EventID) {
+	prevSet := make(map[id.EventID]struct{}, len(prev))
+	for _, evtID := range prev {
+		prevSet[evtID] = struct{}{}
+	}
+	curSet := make(map[id.EventID]struct{}, len(cur))
+	for _, evtID := range cur {
+		curSet[evtID] = struct{}{}
+		if _, ok := prevSet[evtID]; !ok {
+			added = append(added, evtID)
+		}
+	}
+	for _, evtID := range prev {
+		if _, ok := curSet[evtID]; !ok {
+			removed = append(removed, evtID)
+		}
+	}
+	return
+}
+
+func humanizePinError(err error) string {
+	switch discordErrorCode(err) {
+	case discordgo.ErrCodeMaximumPinsReached:
+		return "this channel already has the maximum of 50 pinned messages on Discord"
+	case discordgo.ErrCodeCannotExecuteActionOnSystemMessage:
+		return "system messages can't be pinned on Discord"
+	case discordgo.ErrCodeMissingPermissions:
+		return errNoPinPermission.Error()
+	default:
+		return err.Error()
+	}
+}
+
+func (portal *Portal) handleMatrixPins(sender *User, evt *event.Event) {
+	if sender.Session == nil {
+		portal.log.Debugfln("Ignoring pin change %s from %s: not connected to Discord", evt.ID, evt.Sender)
+		return
+	}
+	var prev []id.EventID
+	if evt.Unsigned.PrevContent != nil {
+		_ = evt.Unsigned.PrevContent.ParseRaw(evt.Type)
+		prev = evt.Unsigned.PrevContent.AsPinnedEvents().Pinned
+	}
+	added, removed := diffPinnedEvents(prev, evt.Content.AsPinnedEvents().Pinned)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	allowed, err := portal.canManageMessages(sender)
+	if err != nil {
+		portal.log.Warnfln("Failed to check pin permissions of %s: %v", sender.DiscordID, err)
+	} else if !allowed {
+		portal.log.Debugfln("Ignoring pin change %s from %s: %v", evt.ID, evt.Sender, errNoPinPermission)
+		if len(added) > 0 {
+			portal.sendErrorMessage("pin", errNoPinPermission.Error(), true)
+		}
+		if len(removed) > 0 {
+			portal.sendErrorMessage("unpin", errNoPinPermission.Error(), true)
+		}
+		return
+	}
+
+	changed := make(map[id.EventID]struct{}, len(added)+len(removed))
+	for _, evtID := range append(added, removed...) {
+		changed[evtID] = struct{}{}
+	}
+	prevMsgs := portal.getPinnedMessages(prev)
+	curMsgs := portal.getPinnedMessages(evt.Content.AsPinnedEvents().Pinned)
+	channels := make(map[string]struct{})
+	for _, msg := range append(prevMsgs, curMsgs...) {
+		if _, ok := changed[msg.MXID]; ok {
+			channels[msg.DiscordProtoChannelID()] = struct{}{}
+		}
+	}
+	toPin, toUnpin := reconcilePins(prevMsgs, curMsgs, portal.fetchDiscordPins(sender, channels))
+
+	for _, msg := range toPin {
+		err = sender.Session.ChannelMessagePin(msg.DiscordProtoChannelID(), msg.DiscordID)
+		if err != nil {
+			portal.log.Warnfln("Failed to pin %s on Discord: %v", msg.DiscordID, err)
+			portal.sendErrorMessage("pin", humanizePinError(err), true)
+		}
+	}
+	for _, msg := range toUnpin {
+		err = sender.Session.ChannelMessageUnpin(msg.DiscordProtoChannelID(), msg.DiscordID)
+		if discordErrorCode(err) == discordgo.ErrCodeUnknownMessage {
+			portal.log.Debugfln("Message %s was deleted on Discord, so there's no pin to remove", msg.DiscordID)
+		} else if err != nil {
+			portal.log.Warnfln("Failed to unpin %s on Discord: %v", msg.DiscordID, err)
+			portal.sendErrorMessage("unpin", humanizePinError(err), true)
+		}
+	}
+}
+
+// getPinnedMessages finds the bridged Discord messages of pinned Matrix events, skipping unknown events.
+func (portal *Portal) getPinnedMessages(evtIDs []id.EventID) []*database.Message {
+	msgs := make([]*database.Message, 0, len(evtIDs))
+	for _, evtID := range evtIDs {
+		if msg := portal.bridge.DB.Message.GetByMXID(portal.Key, evtID); msg != nil {
+			msgs = append(msgs, msg)
+		} else {
+			portal.log.Debugfln("Ignoring pin state of unknown event %s", evtID)
+		}
+	}
+	return msgs
+}
+
+// fetchDiscordPins returns the IDs of the messages currently pinned in the given channels on Discord,
+// or nil if they couldn't be fetched.
+func (portal *Portal) fetchDiscordPins(sender *User, channelIDs map[string]struct{}) map[string]struct{} {
+	pinned := make(map[string]struct{})
+	for channelID := range channelIDs {
+		msgs, err := sender.Session.ChannelMessagesPinned(channelID)
+		if err != nil {
+			portal.log.Warnfln("Failed to fetch pinned messages in %s, applying pin changes without checking them: %v", channelID, err)
+			return nil
+		}
+		for _, msg := range msgs {
+			pinned[msg.ID] = struct{}{}
+		}
+	}
+	return pinned
+}
+
+// reconcilePins works out which Discord messages need to be pinned or unpinned after the Matrix pin list changed.
+// Pins are compared per Discord message, so unpinning one part of a message while another part stays pinned
+// doesn't unpin it. discordPinned has the messages currently pinned on Discord, which skips changes that were
+// already made there (e.g. when the same message is unpinned on both sides at once). If it's nil, every change is applied.
+func reconcilePins(prev, cur []*database.Message, discordPinned map[string]struct{}) (pin, unpin []*database.Message) {
+	prevIDs := make(map[string]struct{}, len(prev))
+	for _, msg := range prev {
+		prevIDs[msg.DiscordID] = struct{}{}
+	}
+	curIDs := make(map[string]struct{}, len(cur))
+	for _, msg := range cur {
+		curIDs[msg.DiscordID] = struct{}{}
+	}
+	isPinned := func(discordID string) (pinned, known bool) {
+		if discordPinned == nil {
+			return false, false
+		}
+		_, pinned = discordPinned[discordID]
+		return pinned, true
+	}
+	seen := make(map[string]struct{})
+	for _, msg := range cur {
+		if _, ok := prevIDs[msg.DiscordID]; ok {
+			continue
+		} else if _, ok = seen[msg.DiscordID]; ok {
+			continue
+		}
+		seen[msg.DiscordID] = struct{}{}
+		if pinned, known := isPinned(msg.DiscordID); !known || !pinned {
+			pin = append(pin, msg)
+		}
+	}
+	for _, msg := range prev {
+		if _, ok := curIDs[msg.DiscordID]; ok {
+			continue
+		} else if _, ok = seen[msg.DiscordID]; ok {
+			continue
+		}
+		seen[msg.DiscordID] = struct{}{}
+		if pinned, known := isPinned(msg.DiscordID); !known || pinned {
+			unpin = append(unpin, msg)
+		}
+	}
+	return
+}
+
 func (portal *Portal) handleMatrixRedaction(sender *User, evt *event.Event) {
 	if portal.IsPrivateChat() && sender.DiscordID != portal.Key.Receiver {
 		go portal.sendMessageMetrics(evt, errUserNotReceiver, "Ignoring")
@@ -1530,6 +2352,7 @@ func (portal *Portal) handleMatrixRedaction(sender *User, evt *event.Event) {
 		go portal.sendMessageMetrics(evt, err, "Error sending")
 		if err == nil {
 			reaction.Delete()
+			portal.queueReactorListUpdate(reaction.MessageID)
 		}
 		return
 	}
@@ -1596,7 +2419,19 @@ OuterNew:
 	return
 }
 
+// typingNotificationsEnabled returns whether typing notifications should be bridged in the portal,
+// using the bridge-wide default unless the portal has its own setting.
+func (portal *Portal) typingNotificationsEnabled() bool {
+	if portal.TypingNotifications != nil {
+		return *portal.TypingNotifications
+	}
+	return portal.bridge.Config.Bridge.TypingNotifications
+}
+
 func (portal *Portal) HandleMatrixTyping(newTyping []id.UserID) {
+	if !portal.typingNotificationsEnabled() {
+		return
+	}
 	portal.currentlyTypingLock.Lock()
 	defer portal.currentlyTypingLock.Unlock()
 	startedTyping := typingDiff(portal.currentlyTyping, newTyping)
@@ -1699,6 +2534,30 @@ func (portal *Portal) updateRoomAvatar() {
 	}
 }
 
+// channelTopic adds a note to the topic of the Discord channel if it's the rules or system channel of its guild.
+func (portal *Portal) channelTopic(topic string) string {
+	if portal.Guild == nil {
+		return topic
+	}
+	var designation string
+	isRules := portal.Key.ChannelID == portal.Guild.RulesChannelID
+	isSystem := portal.Key.ChannelID == portal.Guild.SystemChannelID
+	switch {
+	case isRules && isSystem:
+		designation = "Rules and system messages channel"
+	case isRules:
+		designation = "Rules channel"
+	case isSystem:
+		designation = "System messages channel"
+	default:
+		return topic
+	}
+	if topic == "" {
+		return designation
+	}
+	return fmt.Sprintf("(%s) %s", designation, topic)
+}
+
 func (portal *Portal) UpdateTopic(topic string) bool {
 	if portal.Topic == topic && (portal.TopicSet || portal.MXID == "") {
 		return false
@@ -1852,8 +2711,16 @@ func (portal *Portal) UpdateInfo(source *User, meta *discordgo.Channel) *discord
 	default:
 		changed = portal.UpdateName(meta) || changed
 	}
-	changed = portal.UpdateTopic(meta.Topic) || changed
-	changed = portal.UpdateParent(meta.ParentID) || changed
+	if meta.IsThread() {
+		portal.queueThreadStats(meta)
+	} else {
+		changed = portal.UpdateTopic(portal.channelTopic(meta.Topic)) || changed
+	}
+	changed = portal.UpdateSlowmode(meta.RateLimitPerUser) || changed
+	// The parent of a thread is a normal channel rather than a category, so thread portals go directly in the guild space
+	if !meta.IsThread() {
+		changed = portal.UpdateParent(meta.ParentID) || changed
+	}
 	// Private channels are added to the space in User.handlePrivateChannel
 	if portal.GuildID != "" && portal.MXID != "" && portal.ExpectedSpaceID() != portal.InSpace {
 		changed = portal.updateSpace() || changed
@@ -0,0 +1,305 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+	log "maunium.net/go/maulogger/v2"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+
+	"go.mau.fi/mautrix-discord/config"
+	"go.mau.fi/mautrix-discord/database"
+)
+
+func pinTestMessage(discordID string, evtID id.EventID) *database.Message {
+	return &database.Message{
+		Channel:   database.PortalKey{ChannelID: "100"},
+		DiscordID: discordID,
+		MXID:      evtID,
+	}
+}
+
+func pinIDs(msgs []*database.Message) []string {
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.DiscordID
+	}
+	return ids
+}
+
+func discordPins(ids ...string) map[string]struct{} {
+	pins := make(map[string]struct{}, len(ids))
+	for _, discordID := range ids {
+		pins[discordID] = struct{}{}
+	}
+	return pins
+}
+
+func TestReconcilePins(t *testing.T) {
+	a := pinTestMessage("1", "$a")
+	b := pinTestMessage("2", "$b")
+	c := pinTestMessage("3", "$c")
+	// A second part (e.g. an attachment) of the same Discord message as a
+	aPart := pinTestMessage("1", "$a2")
+
+	tests := []struct {
+		name          string
+		prev, cur     []*database.Message
+		discordPinned map[string]struct{}
+		pin, unpin    []string
+	}{
+		{"Unpin", []*database.Message{a, b}, []*database.Message{a}, discordPins("1", "2"), []string{}, []string{"2"}},
+		{"Pin", []*database.Message{a}, []*database.Message{a, b}, discordPins("1"), []string{"2"}, []string{}},
+		{"Already unpinned on Discord", []*database.Message{a, b}, []*database.Message{a}, discordPins("1"), []string{}, []string{}},
+		{"Already pinned on Discord", []*database.Message{a}, []*database.Message{a, b}, discordPins("1", "2"), []string{}, []string{}},
+		{"Pinned on Discord while unpinning on Matrix", []*database.Message{a, b}, []*database.Message{a}, discordPins("1", "2", "3"), []string{}, []string{"2"}},
+		{"Unpinned on Discord while pinning on Matrix", []*database.Message{a}, []*database.Message{a, c}, discordPins(), []string{"3"}, []string{}},
+		{"Swap", []*database.Message{a, b}, []*database.Message{a, c}, discordPins("1", "2"), []string{"3"}, []string{"2"}},
+		{"Other part still pinned", []*database.Message{a, aPart}, []*database.Message{aPart}, discordPins("1"), []string{}, []string{}},
+		{"Pins unknown", []*database.Message{a, b}, []*database.Message{a, c}, nil, []string{"3"}, []string{"2"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pin, unpin := reconcilePins(test.prev, test.cur, test.discordPinned)
+			assert.Equal(t, test.pin, pinIDs(pin))
+			assert.Equal(t, test.unpin, pinIDs(unpin))
+		})
+	}
+}
+
+func TestDescribeAttachments(t *testing.T) {
+	image := &discordgo.MessageAttachment{Filename: "cat.png", ContentType: "image/png"}
+	file := &discordgo.MessageAttachment{Filename: "report.pdf", ContentType: "application/pdf"}
+
+	assert.Equal(t, "Image: cat.png", describeAttachments(&discordgo.Message{Attachments: []*discordgo.MessageAttachment{image}}))
+	assert.Equal(t, "File: report.pdf", describeAttachments(&discordgo.Message{Attachments: []*discordgo.MessageAttachment{file}}))
+	assert.Equal(t, "2 attachments (Image: cat.png, File: report.pdf)", describeAttachments(&discordgo.Message{
+		Attachments: []*discordgo.MessageAttachment{image, file},
+	}))
+	assert.Equal(t, "Sticker: Wave", describeAttachments(&discordgo.Message{StickerItems: []*discordgo.Sticker{{Name: "Wave"}}}))
+	// Messages with text are quoted normally
+	assert.Equal(t, "", describeAttachments(&discordgo.Message{Content: "look", Attachments: []*discordgo.MessageAttachment{image}}))
+}
+
+func TestReplyToImageOnlyMessage(t *testing.T) {
+	content := event.MessageEventContent{MsgType: event.MsgText, Body: "so cute"}
+	content.RelatesTo = (&event.RelatesTo{}).SetReplyTo("$image")
+	target := &discordgo.Message{Attachments: []*discordgo.MessageAttachment{{Filename: "cat.png", ContentType: "image/png"}}}
+
+	addAttachmentReplyFallback(&content, "!room:example.com", "$image", "@discord_1:example.com", describeAttachments(target))
+	assert.Equal(t, "> <@discord_1:example.com> Image: cat.png\n\nso cute", content.Body)
+	assert.Contains(t, content.FormattedBody, "<mx-reply>")
+	assert.Contains(t, content.FormattedBody, "https://matrix.to/#/!room:example.com/$image")
+	assert.Contains(t, content.FormattedBody, "Image: cat.png</blockquote></mx-reply>so cute")
+	assert.Equal(t, id.EventID("$image"), content.RelatesTo.GetReplyTo())
+}
+
+func TestReplyToFileOnlyMessageInThread(t *testing.T) {
+	content := event.MessageEventContent{MsgType: event.MsgText, Body: "thanks"}
+	content.RelatesTo = (&event.RelatesTo{}).SetThread("$root", "$last")
+	content.RelatesTo.SetReplyTo("$file")
+	target := &discordgo.Message{Attachments: []*discordgo.MessageAttachment{{Filename: "report.pdf", ContentType: "application/pdf"}}}
+
+	addAttachmentReplyFallback(&content, "!room:example.com", "$file", "@discord_1:example.com", describeAttachments(target))
+	assert.Equal(t, "> <@discord_1:example.com> File: report.pdf\n\nthanks", content.Body)
+	// The thread relation must survive adding the fallback
+	assert.Equal(t, id.EventID("$root"), content.RelatesTo.GetThreadParent())
+	assert.Equal(t, id.EventID("$file"), content.RelatesTo.GetReplyTo())
+}
+
+type recordingTransport struct {
+	bodies []string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, _ := io.ReadAll(req.Body)
+	rt.bodies = append(rt.bodies, string(body))
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader(`{"id":"123","channel_id":"1","content":"hi"}`)),
+		Request:    req,
+	}, nil
+}
+
+func TestSendMessageEnforcesNonce(t *testing.T) {
+	transport := &recordingTransport{}
+	session, _ := discordgo.New("token")
+	session.Client = &http.Client{Transport: transport}
+	msg, err := sendMessageEnforceNonce(session, "1", &discordgo.MessageSend{Content: "hi", Nonce: "456"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "123", msg.ID)
+	}
+	if assert.Len(t, transport.bodies, 1) {
+		assert.Contains(t, transport.bodies[0], `"nonce":"456"`)
+		assert.Contains(t, transport.bodies[0], `"enforce_nonce":true`)
+	}
+}
+
+func TestIsRetriableDiscordError(t *testing.T) {
+	restError := func(status int) error {
+		return &discordgo.RESTError{Response: &http.Response{StatusCode: status}}
+	}
+	assert.True(t, isRetriableDiscordError(restError(http.StatusBadGateway)))
+	assert.True(t, isRetriableDiscordError(restError(http.StatusServiceUnavailable)))
+	assert.True(t, isRetriableDiscordError(&url.Error{Op: "Post", URL: "https://discord.com", Err: errors.New("connection reset")}))
+	assert.False(t, isRetriableDiscordError(restError(http.StatusBadRequest)))
+	assert.False(t, isRetriableDiscordError(restError(http.StatusForbidden)))
+	assert.False(t, isRetriableDiscordError(discordgo.ErrJSONUnmarshal))
+	assert.False(t, isRetriableDiscordError(errors.New("failed to marshal request")))
+}
+
+func TestIsRouteRateLimit(t *testing.T) {
+	rl := discordgo.NewRatelimiter()
+	rl.GetBucket("route").Remaining = 0
+	assert.True(t, isRouteRateLimit(rl, "route"))
+	rl.GetBucket("route").Remaining = 4
+	assert.False(t, isRouteRateLimit(rl, "route"), "a rate limit with requests left on the route is a separate limit")
+}
+
+func TestIsRoomGoneError(t *testing.T) {
+	httpError := func(code string) error {
+		return fmt.Errorf("failed to ensure joined: %w", mautrix.HTTPError{
+			Response:  &http.Response{StatusCode: http.StatusForbidden},
+			RespError: &mautrix.RespError{ErrCode: code},
+		})
+	}
+	assert.True(t, isRoomGoneError(httpError("M_FORBIDDEN")))
+	assert.True(t, isRoomGoneError(httpError("M_NOT_FOUND")))
+	assert.False(t, isRoomGoneError(httpError("M_LIMIT_EXCEEDED")))
+	assert.False(t, isRoomGoneError(&url.Error{Op: "Post", URL: "https://matrix.example.com", Err: errors.New("connection refused")}))
+}
+
+type sentMatrixEvent struct {
+	Type    string
+	Content map[string]interface{}
+}
+
+// newTestBridge creates a bridge with an in-memory database and a fake homeserver that accepts every
+// request. The events sent to Matrix are returned through the channel in the order they were sent.
+func newTestBridge(t *testing.T) (*DiscordBridge, <-chan sentMatrixEvent) {
+	events := make(chan sentMatrixEvent, 100)
+	var eventCounter int64
+	homeserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		parts := strings.Split(r.URL.Path, "/")
+		if r.Method == http.MethodPut && len(parts) >= 3 && parts[len(parts)-3] == "send" {
+			var content map[string]interface{}
+			_ = json.NewDecoder(r.Body).Decode(&content)
+			events <- sentMatrixEvent{Type: parts[len(parts)-2], Content: content}
+			_, _ = fmt.Fprintf(w, `{"event_id": "$event%d"}`, atomic.AddInt64(&eventCounter, 1))
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	t.Cleanup(homeserver.Close)
+
+	var cfg config.Config
+	err := yaml.Unmarshal([]byte(fmt.Sprintf(`
+homeserver:
+  address: %s
+  domain: example.com
+appservice:
+  id: discord
+  as_token: as_token
+  bot:
+    username: discordbot
+bridge:
+  username_template: discord_{{.}}
+  displayname_template: '{{.Username}}'
+  portal_message_buffer: 16
+  pending_edit_max_wait: 10
+`, homeserver.URL)), &cfg)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	cfg.BaseConfig.Bridge = &cfg.Bridge
+
+	baseDB, err := dbutil.NewWithDialect(":memory:", "sqlite3")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	// Every connection to an in-memory database gets its own database
+	baseDB.RawDB.SetMaxOpenConns(1)
+	br := &DiscordBridge{
+		Config: &cfg,
+		DB:     database.New(baseDB, log.Sub("Database")),
+
+		usersByMXID:     make(map[id.UserID]*User),
+		usersByID:       make(map[string]*User),
+		managementRooms: make(map[id.RoomID]*User),
+		portalsByMXID:   make(map[id.RoomID]*Portal),
+		portalsByID:     make(map[database.PortalKey]*Portal),
+		threadsByID:     make(map[string]*Thread),
+		guildsByID:      make(map[string]*Guild),
+		guildsByMXID:    make(map[id.RoomID]*Guild),
+		puppets:         make(map[string]*Puppet),
+		forumChannels:   make(map[string]cachedForumChannel),
+
+		threadsByRootMXID:           make(map[id.EventID]*Thread),
+		threadsByCreationNoticeMXID: make(map[id.EventID]*Thread),
+		puppetsByCustomMXID:         make(map[id.UserID]*Puppet),
+	}
+	if !assert.NoError(t, br.DB.Upgrade()) {
+		t.FailNow()
+	}
+	br.Bridge.Config = *cfg.BaseConfig
+	br.Log = log.Sub("Bridge")
+	br.AS = cfg.MakeAppService()
+	_, _ = br.AS.Init()
+	br.Bot = br.AS.BotIntent()
+	return br, events
+}
+
+// newTestPortal creates a portal with a Matrix room in a bridge made by newTestBridge.
+func newTestPortal(br *DiscordBridge, channelID string) *Portal {
+	dbPortal := br.DB.Portal.New()
+	dbPortal.Key = database.PortalKey{ChannelID: channelID}
+	dbPortal.MXID = "!room:example.com"
+	dbPortal.Insert()
+	return br.NewPortal(dbPortal)
+}
+
+// nextMatrixEvent returns the next event sent to the fake homeserver, failing the test if none is sent.
+func nextMatrixEvent(t *testing.T, events <-chan sentMatrixEvent) sentMatrixEvent {
+	select {
+	case evt := <-events:
+		return evt
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for Matrix event")
+		return sentMatrixEvent{}
+	}
+}
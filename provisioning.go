@@ -10,10 +10,12 @@ import (
 	"strings"
 	"time"
 
+	"github.com/bwmarrin/discordgo"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	log "maunium.net/go/maulogger/v2"
 
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
 	"maunium.net/go/mautrix/id"
 
 	"go.mau.fi/mautrix-discord/remoteauth"
@@ -380,7 +382,7 @@ func (p *ProvisioningAPI) guildsBridge(w http.ResponseWriter, r *http.Request) {
 
 	guildID, _ := mux.Vars(r)["guildID"]
 
-	if err := user.bridgeGuild(guildID, false); err != nil {
+	if _, err := user.bridgeGuild(guildID, false); err != nil {
 		jsonResponse(w, http.StatusNotFound, Error{
 			Error:   err.Error(),
 			ErrCode: "M_NOT_FOUND",
@@ -395,7 +397,19 @@ func (p *ProvisioningAPI) guildsUnbridge(w http.ResponseWriter, r *http.Request)
 
 	guildID, _ := mux.Vars(r)["guildID"]
 
-	if err := user.unbridgeGuild(guildID); err != nil {
+	if user.GetPermissionLevel() < bridgeconfig.PermissionLevelAdmin {
+		if allowed, err := user.hasGuildPermission(guildID, discordgo.PermissionManageChannels); err != nil || !allowed {
+			jsonResponse(w, http.StatusForbidden, Error{
+				Error:   "Only bridge admins and users with the Manage Channels permission can unbridge guilds",
+				ErrCode: "M_FORBIDDEN",
+			})
+
+			return
+		}
+	}
+
+	keepRooms := r.URL.Query().Get("keep_rooms") == "true"
+	if _, err := user.unbridgeGuild(guildID, keepRooms); err != nil {
 		jsonResponse(w, http.StatusNotFound, Error{
 			Error:   err.Error(),
 			ErrCode: "M_NOT_FOUND",
@@ -412,7 +426,7 @@ func (p *ProvisioningAPI) guildsJoinEntire(w http.ResponseWriter, r *http.Reques
 
 	guildID, _ := mux.Vars(r)["guildID"]
 
-	if err := user.bridgeGuild(guildID, true); err != nil {
+	if _, err := user.bridgeGuild(guildID, true); err != nil {
 		jsonResponse(w, http.StatusNotFound, Error{
 			Error:   err.Error(),
 			ErrCode: "M_NOT_FOUND",
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
 	"sync"
@@ -49,11 +50,34 @@ func (br *DiscordBridge) NewPuppet(dbPuppet *database.Puppet) *Puppet {
 	}
 }
 
+// validatePuppetNamespace warns if puppet MXIDs generated from the username template aren't inside the
+// user namespace of the registration file. The registration is generated from the template, so a mismatch
+// usually means the template was changed afterwards, which would also give all existing puppets new MXIDs.
+func (br *DiscordBridge) validatePuppetNamespace() {
+	reg, err := appservice.LoadRegistration(br.RegistrationPath)
+	if err != nil {
+		br.Log.Warnfln("Failed to read registration file to validate username template: %v", err)
+		return
+	}
+	examplePuppet := br.FormatPuppetMXID("1234567890")
+	for _, ns := range reg.Namespaces.UserIDs {
+		nsRegex, err := regexp.Compile(ns.Regex)
+		if err != nil {
+			br.Log.Warnfln("Invalid user namespace regex %q in registration: %v", ns.Regex, err)
+		} else if nsRegex.MatchString(string(examplePuppet)) {
+			return
+		}
+	}
+	br.Log.Warnfln("Puppet user IDs generated from the username template (e.g. %s) don't match any user namespace in the registration, "+
+		"so the homeserver will reject them. If you changed the username template, regenerate the registration, "+
+		"but note that existing puppets will get new user IDs.", examplePuppet)
+}
+
 func (br *DiscordBridge) ParsePuppetMXID(mxid id.UserID) (string, bool) {
 	if userIDRegex == nil {
 		pattern := fmt.Sprintf(
 			"^@%s:%s$",
-			br.Config.Bridge.FormatUsername("([0-9]+)"),
+			br.Config.Bridge.FormatUsername("([0-9]+|"+webhookIdentityPuppetIDPattern+")"),
 			br.Config.Homeserver.Domain,
 		)
 
@@ -191,11 +215,19 @@ func (puppet *Puppet) updatePortalMeta(meta func(portal *Portal)) {
 }
 
 func (puppet *Puppet) UpdateName(info *discordgo.User) bool {
-	newName := puppet.bridge.Config.Bridge.FormatDisplayname(info)
-	if puppet.Name == newName && puppet.NameSet {
+	originalName := puppet.bridge.Config.Bridge.FormatDisplayname(info)
+	newName := puppet.bridge.Config.Bridge.DisplaynameSanitization.Sanitize(originalName)
+	if newName == "" {
+		newName = info.Username
+	}
+	if newName == originalName {
+		originalName = ""
+	}
+	if puppet.Name == newName && puppet.OriginalName == originalName && puppet.NameSet {
 		return false
 	}
 	puppet.Name = newName
+	puppet.OriginalName = originalName
 	puppet.NameSet = false
 	err := puppet.DefaultIntent().SetDisplayName(newName)
 	if err != nil {
@@ -275,3 +307,26 @@ func (puppet *Puppet) UpdateInfo(source *User, info *discordgo.User) {
 		puppet.Update()
 	}
 }
+
+// ForceResync fetches the profile of the user from Discord and reapplies it to Matrix,
+// even if the stored name and avatar hash suggest that nothing has changed.
+func (puppet *Puppet) ForceResync(source *User) error {
+	session := source.Session
+	if session == nil {
+		return ErrNotConnected
+	}
+	info, err := session.User(puppet.ID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch user info: %w", err)
+	}
+	puppet.syncLock.Lock()
+	puppet.NameSet = false
+	puppet.AvatarSet = false
+	puppet.AvatarURL = id.ContentURI{}
+	puppet.syncLock.Unlock()
+	puppet.UpdateInfo(source, info)
+	if !puppet.NameSet || (puppet.Avatar != "" && !puppet.AvatarSet) {
+		return errors.New("failed to update the Matrix profile, check the logs for details")
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/id"
+)
+
+// maxTrackedRoutes is how many rate limit buckets are remembered per user for the rate-limits command.
+const maxTrackedRoutes = 25
+
+// recentRoutes remembers which rate limit buckets a user's session used recently. discordgo doesn't expose
+// the list of its buckets, so the rate-limits command can only look up buckets it knows the keys of.
+// Looking up a bucket that doesn't exist creates an empty one, so only buckets that requests went through
+// are remembered, and they're forgotten when the session (and its rate limiter) is replaced.
+type recentRoutes struct {
+	lock        sync.Mutex
+	ratelimiter *discordgo.RateLimiter
+	lastUsed    map[string]time.Time
+}
+
+func (rr *recentRoutes) add(rl *discordgo.RateLimiter, bucketKey string, now time.Time) {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	if rr.lastUsed == nil || rr.ratelimiter != rl {
+		rr.ratelimiter = rl
+		rr.lastUsed = make(map[string]time.Time)
+	}
+	rr.lastUsed[bucketKey] = now
+	if len(rr.lastUsed) > maxTrackedRoutes {
+		var oldestKey string
+		var oldest time.Time
+		for key, ts := range rr.lastUsed {
+			if oldestKey == "" || ts.Before(oldest) {
+				oldestKey, oldest = key, ts
+			}
+		}
+		delete(rr.lastUsed, oldestKey)
+	}
+}
+
+// list returns the bucket keys that were used with the given rate limiter, most recently used first.
+func (rr *recentRoutes) list(rl *discordgo.RateLimiter) []string {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	if rr.ratelimiter != rl {
+		return nil
+	}
+	keys := make([]string, 0, len(rr.lastUsed))
+	for key := range rr.lastUsed {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return rr.lastUsed[keys[i]].After(rr.lastUsed[keys[j]])
+	})
+	return keys
+}
+
+func (rr *recentRoutes) lastUse(bucketKey string) time.Time {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	return rr.lastUsed[bucketKey]
+}
+
+type routeBudget struct {
+	Remaining int
+	ResetIn   time.Duration
+	InUse     bool
+}
+
+// getRouteBudget reads the state of a rate limit bucket. The remaining count is only updated from response
+// headers, so it's stale once the reset time has passed: the next request will get a full budget.
+func getRouteBudget(rl *discordgo.RateLimiter, bucketKey string) routeBudget {
+	bucket := rl.GetBucket(bucketKey)
+	// Buckets are locked for the duration of requests, don't wait for them
+	if !bucket.TryLock() {
+		return routeBudget{InUse: true}
+	}
+	defer bucket.Unlock()
+	// GetWaitTime returns the time until the reset if the remaining count is below the given minimum
+	return routeBudget{Remaining: bucket.Remaining, ResetIn: rl.GetWaitTime(bucket, math.MaxInt32)}
+}
+
+func (rb routeBudget) String() string {
+	if rb.InUse {
+		return "request in progress | -"
+	} else if rb.ResetIn <= 0 {
+		return "full | -"
+	}
+	return fmt.Sprintf("%d | %s", rb.Remaining, rb.ResetIn.Round(time.Millisecond))
+}
+
+// trackRoute remembers a bucket key for the rate-limits command. It must only be called after a request
+// went through the bucket.
+func (user *User) trackRoute(bucketKey string) {
+	if session := user.Session; session != nil {
+		user.routes.add(session.Ratelimiter, bucketKey, time.Now())
+	}
+}
+
+var (
+	messagesRouteRegex  = regexp.MustCompile(`^` + regexp.QuoteMeta(discordgo.EndpointChannels) + `[0-9]+/messages$`)
+	reactionsRouteRegex = regexp.MustCompile(`^` + regexp.QuoteMeta(discordgo.EndpointChannels) + `([0-9]+)/messages/[0-9]+/reactions/`)
+)
+
+// rateLimitBucketKey finds the discordgo bucket key of a rate limited request URL. Many routes use bucket
+// keys that can't be derived from the URL, so only the keys of message sends and reactions are returned.
+func rateLimitBucketKey(url string) (string, bool) {
+	if index := strings.IndexRune(url, '?'); index != -1 {
+		url = url[:index]
+	}
+	if messagesRouteRegex.MatchString(url) {
+		return url, true
+	} else if match := reactionsRouteRegex.FindStringSubmatch(url); match != nil {
+		return discordgo.EndpointMessageReaction(match[1], "", "", ""), true
+	}
+	return "", false
+}
+
+var cmdRateLimits = &commands.FullHandler{
+	Func: wrapCommand(fnRateLimits),
+	Name: "rate-limits",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Show the Discord rate limit budget of the routes a user's session used recently",
+		Args:        "[_Matrix user ID_]",
+	},
+	RequiresAdmin: true,
+}
+
+func fnRateLimits(ce *WrappedCommandEvent) {
+	user := ce.User
+	if len(ce.Args) > 0 {
+		userID := id.UserID(ce.Args[0])
+		if _, _, err := userID.Parse(); err != nil {
+			ce.Reply("%q is not a valid Matrix user ID", ce.Args[0])
+			return
+		}
+		user = ce.Bridge.GetExistingUserByMXID(userID)
+		if user == nil {
+			ce.Reply("%s is not a bridge user", userID)
+			return
+		}
+	}
+	session := user.Session
+	if session == nil {
+		ce.Reply("%s isn't connected to Discord", user.MXID)
+		return
+	}
+	routes := user.routes.list(session.Ratelimiter)
+	if len(routes) == 0 {
+		ce.Reply("There's no rate limit data for %s yet: they haven't sent any tracked requests to Discord since connecting", user.MXID)
+		return
+	}
+	var output strings.Builder
+	_, _ = fmt.Fprintf(&output, "Rate limit budgets of %s:\n\n", user.MXID)
+	output.WriteString("| Route | Remaining | Resets in | Last used |\n|---|---|---|---|\n")
+	for _, route := range routes {
+		lastUsed := time.Since(user.routes.lastUse(route)).Round(time.Second)
+		_, _ = fmt.Fprintf(&output, "| `%s` | %s | %s ago |\n", strings.TrimPrefix(route, discordgo.EndpointAPI), getRouteBudget(session.Ratelimiter, route), lastUsed)
+	}
+	// Any bucket works for the global limit, as it's only checked when the bucket itself has requests left
+	if global := session.Ratelimiter.GetWaitTime(session.Ratelimiter.GetBucket(routes[0]), math.MinInt32); global > 0 {
+		_, _ = fmt.Fprintf(&output, "\nThe global rate limit is active for another %s", global.Round(time.Millisecond))
+	}
+	ce.Reply("%s", output.String())
+}
@@ -0,0 +1,64 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecentRoutesEvictsOldest(t *testing.T) {
+	var rr recentRoutes
+	now := time.Now()
+	for i := 0; i < maxTrackedRoutes+5; i++ {
+		rr.add(nil, fmt.Sprintf("route-%d", i), now.Add(time.Duration(i)*time.Second))
+	}
+	rr.add(nil, "route-10", now.Add(time.Hour))
+	routes := rr.list(nil)
+	assert.Len(t, routes, maxTrackedRoutes)
+	assert.Equal(t, "route-10", routes[0])
+	assert.NotContains(t, routes, "route-0")
+}
+
+func TestRecentRoutesAreForgottenWithRateLimiter(t *testing.T) {
+	var rr recentRoutes
+	oldRL, newRL := discordgo.NewRatelimiter(), discordgo.NewRatelimiter()
+	rr.add(oldRL, "route-1", time.Now())
+	assert.Equal(t, []string{"route-1"}, rr.list(oldRL))
+	assert.Empty(t, rr.list(newRL))
+	rr.add(newRL, "route-2", time.Now())
+	assert.Equal(t, []string{"route-2"}, rr.list(newRL))
+}
+
+func TestRateLimitBucketKey(t *testing.T) {
+	key, ok := rateLimitBucketKey(discordgo.EndpointChannelMessages("123") + "?wait=true")
+	assert.True(t, ok)
+	assert.Equal(t, discordgo.EndpointChannelMessages("123"), key)
+
+	key, ok = rateLimitBucketKey(discordgo.EndpointMessageReaction("123", "456", "%F0%9F%91%8D", "@me"))
+	assert.True(t, ok)
+	assert.Equal(t, discordgo.EndpointMessageReaction("123", "", "", ""), key)
+
+	_, ok = rateLimitBucketKey(discordgo.EndpointChannelMessage("123", "456"))
+	assert.False(t, ok)
+	_, ok = rateLimitBucketKey(discordgo.EndpointGuildMembers("123"))
+	assert.False(t, ok)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// StateReactors is the state event that lists who reacted to a message. The state key is the event ID of the message.
+var StateReactors = event.Type{Type: "fi.mau.discord.reactors", Class: event.StateEventType}
+
+type ReactorInfo struct {
+	DiscordID string    `json:"discord_id"`
+	UserID    id.UserID `json:"user_id"`
+	Name      string    `json:"name"`
+}
+
+type ReactionReactors struct {
+	Key      string        `json:"key"`
+	Reactors []ReactorInfo `json:"reactors"`
+}
+
+type ReactorsEventContent struct {
+	MessageID string             `json:"message_id"`
+	Reactions []ReactionReactors `json:"reactions"`
+}
+
+// reactionDisplayKey makes a readable name for the emoji of a reaction. Custom emojis are stored as the emoji ID
+// for reactions from Discord and as name:ID for reactions from Matrix.
+func (portal *Portal) reactionDisplayKey(emojiName string) string {
+	if name, _, ok := strings.Cut(emojiName, ":"); ok {
+		return ":" + name + ":"
+	} else if emoji := portal.bridge.DB.Emoji.GetByDiscordID(emojiName); emoji != nil && emoji.DiscordName != "" {
+		return ":" + emoji.DiscordName + ":"
+	}
+	return emojiName
+}
+
+func (portal *Portal) reactorInfo(discordID string) ReactorInfo {
+	puppet := portal.bridge.GetPuppetByID(discordID)
+	info := ReactorInfo{DiscordID: discordID, UserID: puppet.MXID, Name: puppet.Name}
+	if user := portal.bridge.GetUserByID(discordID); user != nil {
+		info.UserID = user.MXID
+	}
+	return info
+}
+
+// reactorListDelay is how long reactor list updates of a message are batched for, as reactions often come in bursts.
+const reactorListDelay = 2 * time.Second
+
+// queueReactorListUpdate resends the reactor list state event of a message after its reactions changed.
+// The event is still sent when the last reaction is removed, so that the list doesn't go stale.
+func (portal *Portal) queueReactorListUpdate(discordMessageID string) {
+	if !portal.bridge.Config.Bridge.ReactorListState || portal.MXID == "" {
+		return
+	}
+	portal.runInLoop(func() {
+		if _, queued := portal.reactorListTimers[discordMessageID]; queued {
+			return
+		}
+		portal.reactorListTimers[discordMessageID] = time.AfterFunc(reactorListDelay, func() {
+			portal.runInLoop(func() {
+				delete(portal.reactorListTimers, discordMessageID)
+				portal.updateReactorList(discordMessageID)
+			})
+		})
+	})
+}
+
+type messageReactor struct {
+	Key     string
+	Reactor ReactorInfo
+}
+
+// buildReactorList groups reactors by emoji. The emojis with the most reactors come first,
+// and the reactors of each emoji are sorted by name.
+func buildReactorList(discordMessageID string, reactors []messageReactor) ReactorsEventContent {
+	byKey := make(map[string]*ReactionReactors)
+	content := ReactorsEventContent{MessageID: discordMessageID, Reactions: []ReactionReactors{}}
+	for _, reactor := range reactors {
+		reactions, ok := byKey[reactor.Key]
+		if !ok {
+			reactions = &ReactionReactors{Key: reactor.Key}
+			byKey[reactor.Key] = reactions
+		}
+		reactions.Reactors = append(reactions.Reactors, reactor.Reactor)
+	}
+	for _, reactions := range byKey {
+		sort.Slice(reactions.Reactors, func(i, j int) bool {
+			return reactions.Reactors[i].Name < reactions.Reactors[j].Name
+		})
+		content.Reactions = append(content.Reactions, *reactions)
+	}
+	sort.Slice(content.Reactions, func(i, j int) bool {
+		return len(content.Reactions[i].Reactors) > len(content.Reactions[j].Reactors) ||
+			(len(content.Reactions[i].Reactors) == len(content.Reactions[j].Reactors) && content.Reactions[i].Key < content.Reactions[j].Key)
+	})
+	return content
+}
+
+func (portal *Portal) updateReactorList(discordMessageID string) {
+	if portal.MXID == "" {
+		return
+	}
+	parts := portal.bridge.DB.Message.GetByDiscordID(portal.Key, discordMessageID)
+	if len(parts) == 0 {
+		return
+	}
+	var reactors []messageReactor
+	for _, reaction := range portal.bridge.DB.Reaction.GetAllForMessage(portal.Key, discordMessageID) {
+		reactors = append(reactors, messageReactor{
+			Key:     portal.reactionDisplayKey(reaction.EmojiName),
+			Reactor: portal.reactorInfo(reaction.Sender),
+		})
+	}
+	content := buildReactorList(discordMessageID, reactors)
+	_, err := portal.MainIntent().SendStateEvent(portal.MXID, StateReactors, parts[0].MXID.String(), &content)
+	if err != nil {
+		portal.log.Warnfln("Failed to update reactor list of %s: %v", discordMessageID, err)
+	}
+}
@@ -0,0 +1,53 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildReactorList(t *testing.T) {
+	alice := ReactorInfo{DiscordID: "1", UserID: "@discord_1:example.com", Name: "Alice"}
+	bob := ReactorInfo{DiscordID: "2", UserID: "@bob:example.com", Name: "Bob"}
+	carol := ReactorInfo{DiscordID: "3", UserID: "@discord_3:example.com", Name: "Carol"}
+	content := buildReactorList("1234", []messageReactor{
+		{Key: "👍", Reactor: carol},
+		{Key: ":party:", Reactor: bob},
+		{Key: "👍", Reactor: alice},
+		{Key: "❤️", Reactor: alice},
+		{Key: "👍", Reactor: bob},
+	})
+	assert.Equal(t, ReactorsEventContent{
+		MessageID: "1234",
+		Reactions: []ReactionReactors{
+			// Emojis with the most reactors come first and ties are sorted by the emoji
+			{Key: "👍", Reactors: []ReactorInfo{alice, bob, carol}},
+			{Key: ":party:", Reactors: []ReactorInfo{bob}},
+			{Key: "❤️", Reactors: []ReactorInfo{alice}},
+		},
+	}, content)
+}
+
+func TestBuildReactorListWithoutReactions(t *testing.T) {
+	// The list is still sent after the last reaction is removed, so it has to be empty rather than null
+	content := buildReactorList("1234", nil)
+	assert.Equal(t, "1234", content.MessageID)
+	assert.NotNil(t, content.Reactions)
+	assert.Empty(t, content.Reactions)
+}
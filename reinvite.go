@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+var errNoPortalRoom = errors.New("that channel isn't bridged to a Matrix room")
+
+// findPortalByArg finds a portal by a Discord channel ID, Matrix room ID or room alias.
+func (user *User) findPortalByArg(arg string) (*Portal, error) {
+	var portal *Portal
+	switch {
+	case strings.HasPrefix(arg, "!"):
+		portal = user.bridge.GetPortalByMXID(id.RoomID(arg))
+	case strings.HasPrefix(arg, "#"):
+		resp, err := user.bridge.Bot.ResolveAlias(id.RoomAlias(arg))
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve alias: %w", err)
+		}
+		portal = user.bridge.GetPortalByMXID(resp.RoomID)
+	default:
+		portal = user.bridge.GetExistingPortalByID(database.NewPortalKey(arg, user.DiscordID))
+	}
+	if portal == nil || portal.MXID == "" {
+		return nil, errNoPortalRoom
+	}
+	return portal, nil
+}
+
+// userCanAccess checks whether the user can see the Discord channel of the portal.
+func (portal *Portal) userCanAccess(user *User) bool {
+	if portal.Key.Receiver != "" {
+		return portal.Key.Receiver == user.DiscordID
+	} else if user.Session == nil {
+		return false
+	} else if portal.GuildID == "" {
+		_, err := user.Session.State.Channel(portal.Key.ChannelID)
+		return err == nil
+	}
+	allowed, err := portal.userHasPermission(user, discordgo.PermissionViewChannel)
+	return err == nil && allowed
+}
+
+// rejoinRoom makes the main intent of the portal join the room again. If it was kicked, the user's
+// double puppet is used to invite it back, as nobody else in the room may be able to.
+func (portal *Portal) rejoinRoom(intent *appservice.IntentAPI, user *User) error {
+	params := appservice.EnsureJoinedParams{IgnoreCache: true}
+	if customPuppet := portal.bridge.GetPuppetByCustomMXID(user.MXID); customPuppet != nil && customPuppet.CustomIntent() != nil {
+		params.BotOverride = customPuppet.CustomIntent().Client
+	}
+	return intent.EnsureJoined(portal.MXID, params)
+}
+
+var cmdReinvite = &commands.FullHandler{
+	Func: wrapCommand(fnReinvite),
+	Name: "reinvite",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "Get yourself and the bridge back into a portal room after being removed from it",
+		Args:        "<_channel ID, room ID or alias_>",
+	},
+	RequiresLogin: true,
+}
+
+func fnReinvite(ce *WrappedCommandEvent) {
+	if len(ce.Args) != 1 {
+		ce.Reply("**Usage**: `$cmdprefix reinvite <channel ID, room ID or alias>`")
+		return
+	}
+	portal, err := ce.User.findPortalByArg(ce.Args[0])
+	if err != nil {
+		ce.Reply("Failed to find portal: %v", err)
+		return
+	} else if !portal.userCanAccess(ce.User) && ce.User.GetPermissionLevel() < bridgeconfig.PermissionLevelAdmin {
+		ce.Reply("You don't have access to that channel on Discord")
+		return
+	}
+
+	intents := []*appservice.IntentAPI{portal.MainIntent()}
+	if portal.IsPrivateChat() && portal.Encrypted {
+		intents = append(intents, portal.bridge.Bot)
+	}
+	for _, intent := range intents {
+		err = portal.rejoinRoom(intent, ce.User)
+		if err != nil {
+			ce.Reply("Failed to get %s back into the room: %v", intent.UserID, err)
+			return
+		}
+	}
+	if !portal.ensureUserInvited(ce.User) {
+		ce.Reply("The bridge is in the room, but inviting you failed. Check the bridge logs for details")
+		return
+	}
+
+	portal.UpdateBridgeInfo()
+	if !portal.IsPrivateChat() {
+		if err = portal.updateBotDisplayname(); err != nil {
+			portal.log.Warnln("Failed to update bot displayname after reinvite:", err)
+		}
+	}
+	ce.Reply("Re-invited you to [%s](%s)", portal.Name, portal.MXID.URI(ce.Bridge.AS.HomeserverDomain).MatrixToURL())
+}
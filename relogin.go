@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/websocket"
+
+	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+)
+
+// isInvalidTokenError checks if an error means that Discord doesn't accept the token of the user anymore,
+// i.e. the gateway closed the connection with "authentication failed" or a REST request got HTTP 401.
+func isInvalidTokenError(err error) bool {
+	var closeErr *websocket.CloseError
+	var restErr *discordgo.RESTError
+	if errors.As(err, &closeErr) {
+		return closeErr.Code == 4004
+	} else if errors.As(err, &restErr) {
+		return restErr.Response != nil && restErr.Response.StatusCode == http.StatusUnauthorized
+	}
+	return false
+}
+
+// checkTokenAfterDisconnect asks Discord whether the token still works after the gateway disconnected.
+// discordgo keeps trying to reconnect forever, so an invalidated token would otherwise go unnoticed.
+func (user *User) checkTokenAfterDisconnect(session *discordgo.Session) {
+	if !atomic.CompareAndSwapInt32(&user.checkingToken, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&user.checkingToken, 0)
+	_, err := session.User("@me")
+	if isInvalidTokenError(err) {
+		user.handleInvalidToken(err)
+	}
+}
+
+// handleInvalidToken stops the connection, forgets the token and tells the user to log in again.
+// The user is only notified once until they log back in.
+func (user *User) handleInvalidToken(reason error) {
+	if !atomic.CompareAndSwapInt32(&user.reloginPrompted, 0, 1) {
+		return
+	}
+	user.log.Warnln("Discord token was invalidated:", reason)
+	user.logError("auth", fmt.Sprintf("Discord session was invalidated: %v", reason))
+	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateBadCredentials, Message: reason.Error()})
+
+	user.Lock()
+	if user.Session != nil {
+		user.Session.ShouldReconnectOnError = false
+		_ = user.Session.Close()
+		user.Session = nil
+	}
+	user.DiscordToken = ""
+	user.Update()
+	user.Unlock()
+
+	cfg := user.bridge.Config.Bridge.ReloginPrompt
+	if !cfg.Enabled || user.ManagementRoom == "" {
+		return
+	}
+	prefix := user.bridge.Config.Bridge.CommandPrefix
+	body := fmt.Sprintf("Your Discord session is no longer valid, so messages aren't being bridged. "+
+		"This usually happens when you change your password or log out of all devices. "+
+		"Use `%s login` to scan a QR code or `%s login-token` to log back in.", prefix, prefix)
+	if cfg.AutoQR {
+		body = "Your Discord session is no longer valid, so messages aren't being bridged. " +
+			"Scan the QR code below with the Discord mobile app to log back in."
+	}
+	content := format.RenderMarkdown(body, true, false)
+	content.MsgType = event.MsgNotice
+	_, err := user.bridge.Bot.SendMessageEvent(user.ManagementRoom, event.EventMessage, &content)
+	if err != nil {
+		user.log.Warnln("Failed to send re-login prompt:", err)
+		return
+	}
+	if cfg.AutoQR {
+		go fnLoginQR(&WrappedCommandEvent{
+			Event: &commands.Event{
+				Bot:       user.bridge.Bot,
+				Bridge:    &user.bridge.Bridge,
+				Processor: user.bridge.CommandProcessor.(*commandProcessor).Processor,
+				RoomID:    user.ManagementRoom,
+				User:      user,
+				Command:   "login-qr",
+				Log:       user.log,
+			},
+			Bridge: user.bridge,
+			User:   user,
+		})
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"sync"
 
@@ -15,6 +16,9 @@ import (
 	"github.com/bwmarrin/discordgo"
 )
 
+// ErrTimeout is returned by Result if the QR code wasn't scanned in time.
+var ErrTimeout = errors.New("login timed out")
+
 type Client struct {
 	sync.Mutex
 
@@ -22,6 +26,9 @@ type Client struct {
 
 	conn *websocket.Conn
 
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	qrChan   chan string
 	doneChan chan struct{}
 
@@ -49,7 +56,8 @@ func New() (*Client, error) {
 }
 
 // Dial will start the QRCode login process. ctx may be used to abandon the
-// process.
+// process, in which case the websocket is closed and doneChan is closed once
+// everything has been cleaned up.
 func (c *Client) Dial(ctx context.Context, qrChan chan string, doneChan chan struct{}) error {
 	c.Lock()
 	defer c.Unlock()
@@ -68,8 +76,14 @@ func (c *Client) Dial(ctx context.Context, qrChan chan string, doneChan chan str
 	}
 
 	c.conn = conn
+	c.ctx, c.cancel = context.WithCancel(ctx)
 
 	go c.processMessages()
+	go func() {
+		// Closing the connection interrupts the blocking read in processMessages.
+		<-c.ctx.Done()
+		_ = c.conn.Close()
+	}()
 
 	return nil
 }
@@ -95,12 +109,23 @@ func (c *Client) close() error {
 	)
 
 	c.closed = true
+	c.cancel()
 
 	defer close(c.doneChan)
 
 	return c.conn.Close()
 }
 
+// abort stops the login process with the given error.
+func (c *Client) abort(err error) {
+	c.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.Unlock()
+	c.cancel()
+}
+
 func (c *Client) write(p clientPacket) error {
 	c.Lock()
 	defer c.Unlock()
@@ -24,12 +24,20 @@ func (c *Client) processMessages() {
 	defer c.close()
 
 	for {
-		c.Lock()
+		// Only this goroutine reads from the connection, so the lock isn't held while blocking
+		// here. Otherwise the timeouts couldn't abort the login.
 		_, packet, err := c.conn.ReadMessage()
-		c.Unlock()
 
 		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure) {
+			if ctxErr := c.ctx.Err(); ctxErr != nil {
+				// The context is also cancelled when the login finishes normally and the
+				// connection is closed, which isn't an error.
+				c.Lock()
+				if c.err == nil && !c.closed {
+					c.err = ctxErr
+				}
+				c.Unlock()
+			} else if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure) {
 				c.Lock()
 				c.err = err
 				c.Unlock()
@@ -105,8 +113,8 @@ func (h *serverHello) process(client *Client) error {
 		defer ticker.Stop()
 		for {
 			select {
-			// case <-client.ctx.Done():
-			// 	return
+			case <-client.ctx.Done():
+				return
 			case <-ticker.C:
 				h := clientHeartbeat{}
 				if err := h.send(client); err != nil {
@@ -123,12 +131,11 @@ func (h *serverHello) process(client *Client) error {
 	go func() {
 		duration := time.Duration(h.Timeout) * time.Millisecond
 
-		<-time.After(duration)
-
-		client.Lock()
-		client.err = fmt.Errorf("Timed out after %s", duration)
-		client.close()
-		client.Unlock()
+		select {
+		case <-time.After(duration):
+			client.abort(fmt.Errorf("%w after %s", ErrTimeout, duration))
+		case <-client.ctx.Done():
+		}
 	}()
 
 	i := clientInit{}
@@ -180,7 +187,11 @@ type serverPendingRemoteInit struct {
 func (p *serverPendingRemoteInit) process(client *Client) error {
 	url := "https://discordapp.com/ra/" + p.Fingerprint
 
-	client.qrChan <- url
+	select {
+	case client.qrChan <- url:
+	case <-client.ctx.Done():
+		return client.ctx.Err()
+	}
 	close(client.qrChan)
 
 	return nil
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+)
+
+var (
+	errSendBufferFull    = errors.New("too many messages were waiting for the Discord connection")
+	errSendBufferExpired = errors.New("the Discord connection wasn't restored in time")
+)
+
+type bufferedMatrixEvent struct {
+	portal *Portal
+	evt    *event.Event
+	queued time.Time
+}
+
+// bufferMatrixEventIfNeeded buffers the event if Matrix events from this user should wait for the gateway
+// to reconnect instead of being sent to Discord right away, and returns whether the event was buffered.
+// Events keep being buffered until the buffer is flushed, so that they're sent in the same order they were received.
+func (user *User) bufferMatrixEventIfNeeded(portal *Portal, evt *event.Event) bool {
+	cfg := user.bridge.Config.Bridge.ReconnectBuffer
+	if cfg.MaxSize <= 0 {
+		return false
+	}
+	user.sendBufferLock.Lock()
+	defer user.sendBufferLock.Unlock()
+	pending := len(user.sendBuffer) > 0 || user.sendBufferFlushing
+	if !pending && (user.Session == nil || atomic.LoadInt32(&user.gatewayConnected) != 0) {
+		return false
+	} else if len(user.sendBuffer) >= cfg.MaxSize {
+		user.log.Warnfln("Not buffering %s until reconnect: buffer is full", evt.ID)
+		go portal.sendMessageMetrics(evt, errSendBufferFull, "Dropping")
+		return true
+	}
+	user.log.Debugfln("Buffering %s until the Discord connection is restored", evt.ID)
+	if len(user.sendBuffer) == 0 {
+		time.AfterFunc(time.Duration(cfg.MaxAge)*time.Second, user.expireBufferedMatrixEvents)
+	}
+	user.sendBuffer = append(user.sendBuffer, bufferedMatrixEvent{portal: portal, evt: evt, queued: time.Now()})
+	return true
+}
+
+// expireBufferedMatrixEvents fails buffered events that have waited longer than the configured maximum age.
+func (user *User) expireBufferedMatrixEvents() {
+	maxAge := time.Duration(user.bridge.Config.Bridge.ReconnectBuffer.MaxAge) * time.Second
+	user.sendBufferLock.Lock()
+	defer user.sendBufferLock.Unlock()
+	var expired int
+	for _, item := range user.sendBuffer {
+		if time.Since(item.queued) < maxAge {
+			break
+		}
+		go item.portal.sendMessageMetrics(item.evt, errSendBufferExpired, "Dropping")
+		expired++
+	}
+	user.sendBuffer = user.sendBuffer[expired:]
+	if len(user.sendBuffer) > 0 {
+		time.AfterFunc(maxAge-time.Since(user.sendBuffer[0].queued), user.expireBufferedMatrixEvents)
+	} else {
+		user.sendBuffer = nil
+	}
+}
+
+// flushBufferedMatrixEvents passes buffered events to their portals in the order they were received.
+// The lock isn't held while passing events, as portal channels may block. New events are buffered
+// until the flush is done, so that they don't get ahead of the ones being flushed.
+func (user *User) flushBufferedMatrixEvents() {
+	user.sendBufferLock.Lock()
+	if user.sendBufferFlushing {
+		user.sendBufferLock.Unlock()
+		return
+	}
+	user.sendBufferFlushing = true
+	for len(user.sendBuffer) > 0 {
+		items := user.sendBuffer
+		user.sendBuffer = nil
+		user.sendBufferLock.Unlock()
+		user.log.Debugfln("Connection restored, sending %d buffered Matrix events", len(items))
+		for _, item := range items {
+			item.portal.matrixMessages <- portalMatrixMessage{user: user, evt: item.evt}
+		}
+		user.sendBufferLock.Lock()
+	}
+	user.sendBufferFlushing = false
+	user.sendBufferLock.Unlock()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// sendRateLimiter spaces out the messages a user sends to Discord so that there are never more than the configured
+// number within the configured period. It's a lot stricter than Discord's own limits, as message bursts that stay
+// under those can still get user accounts flagged for spam.
+type sendRateLimiter struct {
+	lock sync.Mutex
+	// The times at which the recent and queued sends were allowed to go out, in ascending order.
+	slots []time.Time
+}
+
+// reserve reserves the next free send slot and returns how long the caller needs to wait before sending.
+func (sl *sendRateLimiter) reserve(now time.Time, limit int, period time.Duration) time.Duration {
+	if limit <= 0 || period <= 0 {
+		return 0
+	}
+	sl.lock.Lock()
+	defer sl.lock.Unlock()
+	var expired int
+	for expired < len(sl.slots) && !sl.slots[expired].After(now.Add(-period)) {
+		expired++
+	}
+	sl.slots = sl.slots[expired:]
+	slot := now
+	if len(sl.slots) >= limit {
+		if next := sl.slots[len(sl.slots)-limit].Add(period); next.After(slot) {
+			slot = next
+		}
+	}
+	sl.slots = append(sl.slots, slot)
+	return slot.Sub(now)
+}
+
+// sendQueue runs the message sends of a user one at a time, outside the portal message loops.
+// Jobs are kept in a slice rather than a channel, so that pushing never blocks a portal.
+type sendQueue struct {
+	lock    sync.Mutex
+	jobs    []func()
+	running bool
+}
+
+func (sq *sendQueue) push(job func()) {
+	sq.lock.Lock()
+	defer sq.lock.Unlock()
+	sq.jobs = append(sq.jobs, job)
+	if !sq.running {
+		sq.running = true
+		go sq.run()
+	}
+}
+
+func (sq *sendQueue) run() {
+	for {
+		sq.lock.Lock()
+		if len(sq.jobs) == 0 {
+			sq.running = false
+			sq.jobs = nil
+			sq.lock.Unlock()
+			return
+		}
+		job := sq.jobs[0]
+		sq.jobs = sq.jobs[1:]
+		sq.lock.Unlock()
+		job()
+	}
+}
+
+// waitForSendSlot blocks until the user is allowed to send another message under the configured rate cap.
+// Messages are queued rather than rejected, so a burst gets sent out gradually. This must only be called
+// from the user's send queue.
+func (user *User) waitForSendSlot() time.Duration {
+	cfg := user.bridge.Config.Bridge.SendRateLimit
+	wait := user.sendLimiter.reserve(time.Now(), cfg.Messages, time.Duration(cfg.Period)*time.Second)
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return wait
+}
+
+// describeSendRateLimit describes the effective outgoing message cap for the ping command.
+func (user *User) describeSendRateLimit() string {
+	cfg := user.bridge.Config.Bridge.SendRateLimit
+	if cfg.Messages <= 0 || cfg.Period <= 0 {
+		return "Outgoing messages aren't rate limited by the bridge"
+	}
+	return fmt.Sprintf("Outgoing messages are capped at %s per %s, extra messages are queued",
+		pluralize(cfg.Messages, "message"), formatSlowmode(cfg.Period))
+}
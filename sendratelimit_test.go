@@ -0,0 +1,116 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+func TestSendRateLimiterQueuesOverCap(t *testing.T) {
+	var sl sendRateLimiter
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.Zero(t, sl.reserve(now, 3, time.Minute))
+	}
+	// The fourth message has to wait until the first one is a period old
+	assert.Equal(t, time.Minute, sl.reserve(now, 3, time.Minute))
+	// Queued messages take up slots too, so the next ones wait even longer
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, 50*time.Second, sl.reserve(now, 3, time.Minute))
+}
+
+func TestSendRateLimiterWindowSlides(t *testing.T) {
+	var sl sendRateLimiter
+	now := time.Now()
+	sl.reserve(now, 2, time.Minute)
+	sl.reserve(now.Add(30*time.Second), 2, time.Minute)
+
+	now = now.Add(61 * time.Second)
+	assert.Zero(t, sl.reserve(now, 2, time.Minute))
+	assert.Equal(t, 29*time.Second, sl.reserve(now, 2, time.Minute))
+	assert.Len(t, sl.slots, 3)
+}
+
+func TestSendRateLimiterDisabled(t *testing.T) {
+	var sl sendRateLimiter
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		assert.Zero(t, sl.reserve(now, 0, time.Minute))
+	}
+	assert.Empty(t, sl.slots)
+}
+
+func TestSendQueueRunsJobsInOrder(t *testing.T) {
+	var sq sendQueue
+	var order []int
+	done := make(chan struct{})
+	block := make(chan struct{})
+	sq.push(func() { <-block })
+	for i := 0; i < 5; i++ {
+		i := i
+		sq.push(func() { order = append(order, i) })
+	}
+	sq.push(func() { close(done) })
+	close(block)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("send queue didn't finish in time")
+	}
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, order)
+}
+
+func TestMatrixEventsWaitForQueuedSend(t *testing.T) {
+	br, _ := newTestBridge(t)
+	portal := newTestPortal(br, "100")
+	user := &User{User: &database.User{}, bridge: br}
+	portal.pendingSends["$queued"] = nil
+
+	reaction := &event.Event{ID: "$reaction", Type: event.EventReaction, Content: event.Content{Parsed: &event.ReactionEventContent{
+		RelatesTo: event.RelatesTo{Type: event.RelAnnotation, EventID: "$queued", Key: "👍"},
+	}}}
+	edit := &event.Event{ID: "$edit", Type: event.EventMessage, Content: event.Content{Parsed: &event.MessageEventContent{
+		MsgType:    event.MsgText,
+		Body:       "* edited",
+		NewContent: &event.MessageEventContent{MsgType: event.MsgText, Body: "edited"},
+		RelatesTo:  (&event.RelatesTo{}).SetReplace("$queued"),
+	}}}
+	redaction := &event.Event{ID: "$redaction", Type: event.EventRedaction, Redacts: "$queued"}
+	for _, evt := range []*event.Event{reaction, edit, redaction} {
+		assert.Equal(t, id.EventID("$queued"), matrixEventTarget(evt))
+		portal.handleMatrixMessages(portalMatrixMessage{evt: evt, user: user})
+	}
+	deferred := portal.pendingSends["$queued"]
+	if assert.Len(t, deferred, 3) {
+		assert.Equal(t, id.EventID("$reaction"), deferred[0].evt.ID)
+		assert.Equal(t, id.EventID("$edit"), deferred[1].evt.ID)
+		assert.Equal(t, id.EventID("$redaction"), deferred[2].evt.ID)
+	}
+
+	portal.pendingSends["$other"] = nil
+	portal.handleDeferredMatrixEvents("$other")
+	assert.NotContains(t, portal.pendingSends, id.EventID("$other"))
+	assert.Empty(t, matrixEventTarget(&event.Event{Type: event.EventMessage, Content: event.Content{Parsed: &event.MessageEventContent{Body: "hi"}}}))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"maunium.net/go/mautrix/event"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+// slowmodeExemptPermissions are the permissions that make Discord ignore slow mode for a member.
+var slowmodeExemptPermissions = []int64{discordgo.PermissionManageMessages, discordgo.PermissionManageChannels}
+
+var errSlowmodeActive = errors.New("slow mode is enabled in this channel")
+
+func formatSlowmode(seconds int) string {
+	duration := time.Duration(seconds) * time.Second
+	switch {
+	case seconds%3600 == 0:
+		return pluralize(int(duration.Hours()), "hour")
+	case seconds%60 == 0:
+		return pluralize(int(duration.Minutes()), "minute")
+	default:
+		return pluralize(seconds, "second")
+	}
+}
+
+func pluralize(count int, unit string) string {
+	if count == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", count, unit)
+}
+
+// slowmodeExemptRoles returns the names of the guild roles whose members aren't affected by slow mode.
+// Channel permission overwrites aren't taken into account, so this only describes the guild-wide roles.
+func (portal *Portal) slowmodeExemptRoles() []string {
+	return slowmodeExemptRoleNames(portal.bridge.DB.Role.GetAll(portal.GuildID))
+}
+
+func slowmodeExemptRoleNames(roles []*database.Role) []string {
+	var names []string
+	for _, role := range roles {
+		if role.Name == "@everyone" {
+			continue
+		}
+		exempt := role.Permissions&discordgo.PermissionAdministrator != 0
+		for _, perm := range slowmodeExemptPermissions {
+			exempt = exempt || role.Permissions&perm != 0
+		}
+		if exempt {
+			names = append(names, role.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// slowmodeSeconds returns the slow mode interval of the channel, or 0 if it isn't known yet.
+func (portal *Portal) slowmodeSeconds() int {
+	if portal.Slowmode == nil {
+		return 0
+	}
+	return *portal.Slowmode
+}
+
+func (portal *Portal) slowmodeNotice() string {
+	if portal.slowmodeSeconds() == 0 {
+		return "Slow mode was turned off in this channel"
+	}
+	notice := fmt.Sprintf("Slow mode is on: members can send one message every %s. "+
+		"Members with the Manage Messages or Manage Channels permission are exempt", formatSlowmode(portal.slowmodeSeconds()))
+	if roles := portal.slowmodeExemptRoles(); len(roles) > 0 {
+		notice += fmt.Sprintf(", which includes the %s roles", strings.Join(roles, ", "))
+	}
+	return notice + "."
+}
+
+// UpdateSlowmode stores the slow mode interval of the channel and tells the room when it changes.
+// The first interval that's stored for a portal is seeded silently, as it isn't a change.
+func (portal *Portal) UpdateSlowmode(seconds int) bool {
+	known := portal.Slowmode != nil
+	if known && *portal.Slowmode == seconds {
+		return false
+	}
+	portal.log.Debugfln("Updating slow mode %d -> %d", portal.slowmodeSeconds(), seconds)
+	portal.Slowmode = &seconds
+	if portal.MXID != "" && known {
+		_, err := portal.sendMatrixMessage(portal.MainIntent(), event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    portal.slowmodeNotice(),
+		}, nil, 0)
+		if err != nil {
+			portal.log.Warnln("Failed to send slow mode notice:", err)
+		}
+	}
+	return true
+}
+
+func (portal *Portal) isSlowmodeExempt(sender *User) bool {
+	for _, perm := range slowmodeExemptPermissions {
+		allowed, err := portal.userHasPermission(sender, perm)
+		if err != nil {
+			portal.log.Debugfln("Failed to check if %s is exempt from slow mode: %v", sender.DiscordID, err)
+			// Let Discord decide if the message can be sent
+			return true
+		} else if allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSlowmode rejects messages that Discord would refuse because of slow mode, so that the sender is told
+// how long to wait instead of getting a generic error. Exempt senders are never rate limited by the bridge.
+func (portal *Portal) checkSlowmode(sender *User) error {
+	slowmode := portal.slowmodeSeconds()
+	if slowmode == 0 || portal.GuildID == "" {
+		return nil
+	}
+	lastSend, ok := portal.slowmodeLastSend[sender.DiscordID]
+	if !ok {
+		return nil
+	}
+	wait := time.Until(lastSend.Add(time.Duration(slowmode) * time.Second))
+	if wait <= 0 || portal.isSlowmodeExempt(sender) {
+		return nil
+	}
+	waitSeconds := int(wait.Round(time.Second).Seconds())
+	if waitSeconds < 1 {
+		waitSeconds = 1
+	}
+	return fmt.Errorf("%w, you can send another message in %s", errSlowmodeActive, formatSlowmode(waitSeconds))
+}
@@ -0,0 +1,119 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	log "maunium.net/go/maulogger/v2"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+func TestFormatSlowmode(t *testing.T) {
+	assert.Equal(t, "1 second", formatSlowmode(1))
+	assert.Equal(t, "45 seconds", formatSlowmode(45))
+	assert.Equal(t, "1 minute", formatSlowmode(60))
+	assert.Equal(t, "90 seconds", formatSlowmode(90))
+	assert.Equal(t, "15 minutes", formatSlowmode(900))
+	assert.Equal(t, "1 hour", formatSlowmode(3600))
+	assert.Equal(t, "6 hours", formatSlowmode(21600))
+}
+
+func TestSlowmodeExemptRoleNames(t *testing.T) {
+	role := func(name string, permissions int64) *database.Role {
+		return &database.Role{Role: discordgo.Role{Name: name, Permissions: permissions}}
+	}
+	names := slowmodeExemptRoleNames([]*database.Role{
+		role("@everyone", discordgo.PermissionManageMessages),
+		role("Moderators", discordgo.PermissionManageMessages),
+		role("Members", discordgo.PermissionSendMessages),
+		role("Admins", discordgo.PermissionAdministrator),
+		role("Channel managers", discordgo.PermissionManageChannels|discordgo.PermissionSendMessages),
+	})
+	assert.Equal(t, []string{"Admins", "Channel managers", "Moderators"}, names)
+	assert.Empty(t, slowmodeExemptRoleNames(nil))
+}
+
+// newTestGuildMember creates a user whose session state has them in a guild with a role that has the given permissions.
+func newTestGuildMember(t *testing.T, rolePermissions int64) *User {
+	session, err := discordgo.New("")
+	assert.NoError(t, err)
+	assert.NoError(t, session.State.GuildAdd(&discordgo.Guild{
+		ID:      "guild",
+		OwnerID: "owner",
+		Roles: []*discordgo.Role{
+			{ID: "guild", Name: "@everyone", Permissions: discordgo.PermissionSendMessages},
+			{ID: "role", Name: "Role", Permissions: rolePermissions},
+		},
+	}))
+	assert.NoError(t, session.State.ChannelAdd(&discordgo.Channel{ID: "channel", GuildID: "guild"}))
+	assert.NoError(t, session.State.MemberAdd(&discordgo.Member{
+		GuildID: "guild",
+		User:    &discordgo.User{ID: "sender"},
+		Roles:   []string{"role"},
+	}))
+	return &User{User: &database.User{DiscordID: "sender"}, Session: session}
+}
+
+func newSlowmodeTestPortal(seconds int) *Portal {
+	return &Portal{
+		Portal: &database.Portal{
+			Key:      database.PortalKey{ChannelID: "channel"},
+			GuildID:  "guild",
+			Slowmode: &seconds,
+		},
+		slowmodeLastSend: make(map[string]time.Time),
+	}
+}
+
+func TestCheckSlowmode(t *testing.T) {
+	sender := newTestGuildMember(t, discordgo.PermissionSendMessages)
+	portal := newSlowmodeTestPortal(60)
+	assert.NoError(t, portal.checkSlowmode(sender), "first message should be allowed")
+
+	portal.slowmodeLastSend[sender.DiscordID] = time.Now().Add(-45 * time.Second)
+	err := portal.checkSlowmode(sender)
+	assert.ErrorIs(t, err, errSlowmodeActive)
+	assert.Contains(t, err.Error(), "15 seconds")
+
+	portal.slowmodeLastSend[sender.DiscordID] = time.Now().Add(-61 * time.Second)
+	assert.NoError(t, portal.checkSlowmode(sender), "interval has passed")
+
+	portal.slowmodeLastSend[sender.DiscordID] = time.Now()
+	portal.Slowmode = nil
+	assert.NoError(t, portal.checkSlowmode(sender), "unknown slow mode shouldn't block messages")
+}
+
+func TestCheckSlowmodeExempt(t *testing.T) {
+	sender := newTestGuildMember(t, discordgo.PermissionManageMessages)
+	portal := newSlowmodeTestPortal(60)
+	portal.slowmodeLastSend[sender.DiscordID] = time.Now()
+	assert.NoError(t, portal.checkSlowmode(sender))
+}
+
+func TestUpdateSlowmodeSeedsUnknownValue(t *testing.T) {
+	portal := &Portal{Portal: &database.Portal{}, log: log.Sub("Portal")}
+	assert.True(t, portal.UpdateSlowmode(0))
+	assert.Equal(t, 0, portal.slowmodeSeconds())
+	assert.False(t, portal.UpdateSlowmode(0))
+	assert.True(t, portal.UpdateSlowmode(30))
+	assert.Equal(t, 30, portal.slowmodeSeconds())
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// StateImagePack is the state event used by MSC2545 (im.ponies) for room-level emote and sticker packs.
+var StateImagePack = event.Type{Type: "im.ponies.room_emotes", Class: event.StateEventType}
+
+// stickerPackStateKey is the state key the guild sticker pack is stored under in the guild space.
+const stickerPackStateKey = "fi.mau.discord.guild_stickers"
+
+type ImagePackImage struct {
+	URL   id.ContentURIString `json:"url"`
+	Body  string              `json:"body,omitempty"`
+	Info  *event.FileInfo     `json:"info,omitempty"`
+	Usage []string            `json:"usage,omitempty"`
+}
+
+type ImagePackMeta struct {
+	DisplayName string              `json:"display_name,omitempty"`
+	AvatarURL   id.ContentURIString `json:"avatar_url,omitempty"`
+	Usage       []string            `json:"usage,omitempty"`
+}
+
+type ImagePackEventContent struct {
+	Images map[string]*ImagePackImage `json:"images"`
+	Pack   ImagePackMeta              `json:"pack"`
+}
+
+// stickerPreviewURL returns a URL that serves the sticker as a Matrix-displayable image.
+// APNG and Lottie stickers are requested from the media proxy as a static PNG of the first frame.
+func stickerPreviewURL(sticker *discordgo.Sticker) (string, string) {
+	switch sticker.FormatType {
+	case discordgo.StickerFormatTypeAPNG, discordgo.StickerFormatTypeLottie:
+		return fmt.Sprintf("https://media.discordapp.net/stickers/%s.png?passthrough=false&size=320", sticker.ID), "image/png"
+	case StickerFormatTypeGIF:
+		return discordgo.EndpointCDNStickers + sticker.ID + ".gif", "image/gif"
+	default:
+		return discordgo.EndpointStickerImage(sticker.ID, sticker.FormatType), "image/png"
+	}
+}
+
+func downloadSticker(url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request: %w", err)
+	}
+	for key, value := range discordgo.DroidImageHeaders {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download sticker: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sticker data: %w", err)
+	}
+	return data, nil
+}
+
+// getGuildStickers returns the custom stickers of a guild, preferring the gateway state cache.
+func (user *User) getGuildStickers(guildID string) ([]*discordgo.Sticker, error) {
+	if user.Session == nil {
+		return nil, ErrNotConnected
+	}
+	if meta, err := user.Session.State.Guild(guildID); err == nil && meta.Stickers != nil {
+		return meta.Stickers, nil
+	}
+	var stickers []*discordgo.Sticker
+	endpoint := discordgo.EndpointGuildStickers(guildID)
+	body, err := user.Session.RequestWithBucketID(http.MethodGet, endpoint, nil, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(body, &stickers)
+	return stickers, err
+}
+
+func (guild *Guild) getStickerMXC(sticker *discordgo.Sticker) (id.ContentURI, string, error) {
+	dbEmoji := guild.bridge.DB.Emoji.GetByDiscordID(sticker.ID)
+	url, mimeType := stickerPreviewURL(sticker)
+	if dbEmoji != nil {
+		return dbEmoji.MatrixURL, mimeType, nil
+	}
+	data, err := downloadSticker(url)
+	if err != nil {
+		return id.ContentURI{}, "", err
+	}
+	mimeType = http.DetectContentType(data)
+	if !strings.HasPrefix(mimeType, "image/") {
+		return id.ContentURI{}, "", fmt.Errorf("got %s instead of an image", mimeType)
+	}
+	resp, err := guild.bridge.Bot.UploadBytes(data, mimeType)
+	if err != nil {
+		return id.ContentURI{}, "", fmt.Errorf("failed to upload sticker to Matrix: %w", err)
+	}
+	dbEmoji = guild.bridge.DB.Emoji.New()
+	dbEmoji.DiscordID = sticker.ID
+	dbEmoji.DiscordName = sticker.Name
+	dbEmoji.MatrixURL = resp.ContentURI
+	dbEmoji.Insert()
+	return dbEmoji.MatrixURL, mimeType, nil
+}
+
+// stickerShortcode makes a unique pack shortcode out of a sticker name.
+func stickerShortcode(name string, taken map[string]*ImagePackImage) string {
+	base := strings.ToLower(strings.Join(strings.Fields(name), "_"))
+	if base == "" {
+		base = "sticker"
+	}
+	shortcode := base
+	for i := 2; taken[shortcode] != nil; i++ {
+		shortcode = fmt.Sprintf("%s_%d", base, i)
+	}
+	return shortcode
+}
+
+// SyncStickers publishes the custom stickers of the guild as an image pack in the guild space.
+func (guild *Guild) SyncStickers(stickers []*discordgo.Sticker) (int, error) {
+	if guild.MXID == "" {
+		return 0, errors.New("guild space doesn't exist")
+	}
+	sorted := make([]*discordgo.Sticker, len(stickers))
+	copy(sorted, stickers)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+	content := ImagePackEventContent{
+		Images: make(map[string]*ImagePackImage, len(sorted)),
+		Pack: ImagePackMeta{
+			DisplayName: guild.Name,
+			AvatarURL:   guild.AvatarURL.CUString(),
+			Usage:       []string{"sticker"},
+		},
+	}
+	for _, sticker := range sorted {
+		mxc, mimeType, err := guild.getStickerMXC(sticker)
+		if err != nil {
+			guild.log.Warnfln("Failed to bridge sticker %s (%s): %v", sticker.ID, sticker.Name, err)
+			continue
+		}
+		body := sticker.Description
+		if body == "" {
+			body = sticker.Name
+		}
+		content.Images[stickerShortcode(sticker.Name, content.Images)] = &ImagePackImage{
+			URL:   mxc.CUString(),
+			Body:  body,
+			Info:  &event.FileInfo{MimeType: mimeType, Width: 320, Height: 320},
+			Usage: []string{"sticker"},
+		}
+	}
+	_, err := guild.bridge.Bot.SendStateEvent(guild.MXID, StateImagePack, stickerPackStateKey, &content)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send sticker pack: %w", err)
+	}
+	return len(content.Images), nil
+}
+
+func (user *User) syncGuildStickers(guild *Guild) (int, error) {
+	stickers, err := user.getGuildStickers(guild.ID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get guild stickers: %w", err)
+	}
+	return guild.SyncStickers(stickers)
+}
+
+type guildStickersUpdate struct {
+	GuildID  string               `json:"guild_id"`
+	Stickers []*discordgo.Sticker `json:"stickers"`
+}
+
+func (user *User) guildStickersUpdateHandler(evt *discordgo.Event) {
+	var update guildStickersUpdate
+	if err := json.Unmarshal(evt.RawData, &update); err != nil {
+		user.log.Warnln("Failed to parse guild stickers update:", err)
+		return
+	}
+	if meta, err := user.Session.State.Guild(update.GuildID); err == nil {
+		user.Session.State.Lock()
+		meta.Stickers = update.Stickers
+		user.Session.State.Unlock()
+	}
+	guild := user.bridge.GetGuildByID(update.GuildID, false)
+	if guild == nil || guild.MXID == "" {
+		return
+	}
+	count, err := guild.SyncStickers(update.Stickers)
+	if err != nil {
+		user.log.Warnfln("Failed to sync stickers of guild %s: %v", guild.ID, err)
+	} else {
+		user.log.Debugfln("Synced %d stickers of guild %s", count, guild.ID)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+// Message types that discordgo doesn't have constants for yet.
+const (
+	messageTypeAutoModerationAction                discordgo.MessageType = 24
+	messageTypeGuildApplicationPremiumSubscription discordgo.MessageType = 32
+)
+
+// messageApplicationName returns the name of the app that caused a system message.
+func messageApplicationName(msg *discordgo.Message) string {
+	if msg.Application != nil && msg.Application.Name != "" {
+		return msg.Application.Name
+	} else if msg.Author != nil {
+		return msg.Author.Username
+	}
+	return "An app"
+}
+
+// integrationNoticeText returns the notice text for system messages about apps and integrations,
+// or an empty string if the message isn't one.
+func integrationNoticeText(msg *discordgo.Message) string {
+	switch msg.Type {
+	case discordgo.MessageTypeGuildMemberJoin:
+		if msg.Author == nil || !msg.Author.Bot {
+			return ""
+		}
+		return fmt.Sprintf("The app %s was added to the server", messageApplicationName(msg))
+	case discordgo.MessageTypeChannelFollowAdd:
+		return fmt.Sprintf("%s added %s to this channel, so its announcements will show up here", msg.Author.Username, msg.Content)
+	case messageTypeGuildApplicationPremiumSubscription:
+		return fmt.Sprintf("%s upgraded the app %s", msg.Author.Username, messageApplicationName(msg))
+	case messageTypeAutoModerationAction:
+		return fmt.Sprintf("AutoMod blocked a message from %s", msg.Author.Username)
+	case discordgo.MessageTypeDefault, discordgo.MessageTypeReply, discordgo.MessageTypeChatInputCommand,
+		discordgo.MessageTypeContextMenuCommand, discordgo.MessageTypeThreadStarterMessage, messageTypePollResult:
+		return ""
+	}
+	if msg.Type > discordgo.MessageTypeThreadStarterMessage && (msg.Application != nil || (msg.Author != nil && msg.Author.Bot)) {
+		return fmt.Sprintf("%s posted an unsupported integration event (type %d)", messageApplicationName(msg), msg.Type)
+	}
+	return ""
+}
+
+// handleDiscordIntegrationNotice bridges an integration system message as a notice, either in the
+// portal room or in the integration notice room if one is configured.
+func (portal *Portal) handleDiscordIntegrationNotice(intent *appservice.IntentAPI, msg *discordgo.Message, text string, ts time.Time, threadID string, threadRelation *event.RelatesTo) {
+	if noticeRoom := id.RoomID(portal.bridge.Config.Bridge.IntegrationNoticeRoom); noticeRoom != "" {
+		body := fmt.Sprintf("%s (in %s)", text, portal.Name)
+		if guild := portal.bridge.GetGuildByID(portal.GuildID, false); guild != nil {
+			body = fmt.Sprintf("%s (in %s / %s)", text, guild.Name, portal.Name)
+		}
+		resp, err := portal.bridge.Bot.SendMessageEvent(noticeRoom, event.EventMessage, &event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    body,
+		})
+		if err == nil {
+			// Mark the message as handled so that other users' connections don't send the notice again
+			portal.markMessageHandled(msg.ID, 0, msg.Author.ID, ts, threadID, []database.MessagePart{{MXID: resp.EventID}})
+			return
+		}
+		portal.log.Warnfln("Failed to send integration notice %s to %s, sending to portal instead: %v", msg.ID, noticeRoom, err)
+	}
+	resp, err := portal.sendMatrixMessage(intent, event.EventMessage, &event.MessageEventContent{
+		MsgType:   event.MsgNotice,
+		Body:      text,
+		RelatesTo: threadRelation.Copy(),
+	}, nil, ts.UnixMilli())
+	if err != nil {
+		portal.log.Warnfln("Failed to send integration notice %s to Matrix: %v", msg.ID, err)
+		return
+	}
+	portal.markMessageHandled(msg.ID, 0, msg.Author.ID, ts, threadID, []database.MessagePart{{MXID: resp.EventID}})
+}
+
+// handleDiscordChannelSystemMessage bridges system messages about changes to the channel itself,
+// which are mostly sent in group DMs. Group DM portals are also updated to match the change.
+// It returns false if the message isn't one of those system messages.
+func (portal *Portal) handleDiscordChannelSystemMessage(source *User, intent *appservice.IntentAPI, msg *discordgo.Message, ts time.Time, threadID string, threadRelation *event.RelatesTo) bool {
+	updateRoom := threadID == "" && portal.Type == discordgo.ChannelTypeGroupDM
+	var text string
+	switch msg.Type {
+	case discordgo.MessageTypeRecipientAdd, discordgo.MessageTypeRecipientRemove:
+		if len(msg.Mentions) == 0 {
+			return false
+		}
+		target := msg.Mentions[0]
+		targetPuppet := portal.bridge.GetPuppetByID(target.ID)
+		targetPuppet.UpdateInfo(source, target)
+		if msg.Type == discordgo.MessageTypeRecipientAdd {
+			text = fmt.Sprintf("%s added %s to the group", msg.Author.Username, target.Username)
+		} else if target.ID == msg.Author.ID {
+			text = fmt.Sprintf("%s left the group", target.Username)
+		} else {
+			text = fmt.Sprintf("%s removed %s from the group", msg.Author.Username, target.Username)
+		}
+		if updateRoom {
+			portal.updateGroupDMMembership(targetPuppet, msg.Type == discordgo.MessageTypeRecipientAdd, text)
+		}
+	case discordgo.MessageTypeChannelNameChange:
+		text = fmt.Sprintf("%s changed the channel name to %s", msg.Author.Username, msg.Content)
+		if updateRoom && portal.UpdateName(&discordgo.Channel{Name: msg.Content, Type: portal.Type}) {
+			portal.UpdateBridgeInfo()
+			portal.Update()
+		}
+	case discordgo.MessageTypeChannelIconChange:
+		text = fmt.Sprintf("%s changed the channel icon", msg.Author.Username)
+		if updateRoom {
+			// The message doesn't include the new icon, so refresh the channel info
+			portal.UpdateInfo(source, nil)
+		}
+	default:
+		return false
+	}
+	resp, err := portal.sendMatrixMessage(intent, event.EventMessage, &event.MessageEventContent{
+		MsgType:   event.MsgNotice,
+		Body:      text,
+		RelatesTo: threadRelation.Copy(),
+	}, nil, ts.UnixMilli())
+	if err != nil {
+		portal.log.Warnfln("Failed to send system message %s to Matrix: %v", msg.ID, err)
+	} else {
+		portal.markMessageHandled(msg.ID, 0, msg.Author.ID, ts, threadID, []database.MessagePart{{MXID: resp.EventID}})
+	}
+	return true
+}
+
+func (portal *Portal) updateGroupDMMembership(puppet *Puppet, added bool, reason string) {
+	user := portal.bridge.GetUserByID(puppet.ID)
+	if added {
+		if user != nil {
+			portal.ensureUserInvited(user)
+		}
+		if err := puppet.IntentFor(portal).EnsureJoined(portal.MXID); err != nil {
+			portal.log.Warnfln("Failed to make puppet of %s join %s: %v", puppet.ID, portal.MXID, err)
+		}
+		return
+	}
+	_, err := puppet.DefaultIntent().LeaveRoom(portal.MXID)
+	if err != nil {
+		portal.log.Warnfln("Failed to make puppet of %s leave %s: %v", puppet.ID, portal.MXID, err)
+	}
+	if user != nil {
+		_, err = portal.MainIntent().KickUser(portal.MXID, &mautrix.ReqKickUser{UserID: user.MXID, Reason: reason})
+		if err != nil {
+			portal.log.Warnfln("Failed to kick %s from %s: %v", user.MXID, portal.MXID, err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+func TestIntegrationNoticeRoomMessageIsMarkedHandled(t *testing.T) {
+	br, events := newTestBridge(t)
+	br.Config.Bridge.IntegrationNoticeRoom = "!notices:example.com"
+	portal := newTestPortal(br, "100")
+	portal.Name = "general"
+	user := &User{User: &database.User{}, bridge: br}
+	msg := &discordgo.Message{
+		ID:        "1003",
+		ChannelID: "100",
+		Type:      messageTypeAutoModerationAction,
+		Author:    &discordgo.User{ID: "200", Username: "author", Discriminator: "0001"},
+	}
+
+	// The same message is received through the connections of two users
+	portal.handleDiscordMessages(portalDiscordMessage{user: user, msg: &discordgo.MessageCreate{Message: msg}})
+	portal.handleDiscordMessages(portalDiscordMessage{user: user, msg: &discordgo.MessageCreate{Message: msg}})
+	notice := nextMatrixEvent(t, events)
+	assert.Equal(t, "AutoMod blocked a message from author (in general)", notice.Content["body"])
+	assert.Len(t, br.DB.Message.GetByDiscordID(portal.Key, "1003"), 1)
+	select {
+	case evt := <-events:
+		t.Errorf("Unexpected %s event %v", evt.Type, evt.Content)
+	default:
+	}
+}
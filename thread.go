@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"sync"
 	"time"
 
@@ -75,18 +76,80 @@ func (br *DiscordBridge) loadThread(dbThread *database.Thread, id string, root *
 }
 
 func (thread *Thread) Join(user *User) {
-	if user.IsInPortal(thread.ID) {
+	user.joinThreadPortal(thread.ID, thread.ParentID)
+}
+
+func (user *User) joinThreadPortal(threadID, parentID string) {
+	if user.IsInPortal(threadID) {
 		return
 	}
-	user.log.Debugfln("Joining thread %s@%s", thread.ID, thread.ParentID)
-	err := user.Session.ThreadJoinWithLocation(thread.ID, discordgo.ThreadJoinLocationContextMenu)
+	user.log.Debugfln("Joining thread %s@%s", threadID, parentID)
+	err := user.Session.ThreadJoinWithLocation(threadID, discordgo.ThreadJoinLocationContextMenu)
 	if err != nil {
-		user.log.Errorfln("Error joining thread %s@%s: %v", thread.ID, thread.ParentID, err)
+		user.log.Errorfln("Error joining thread %s@%s: %v", threadID, parentID, err)
 	} else {
 		user.MarkInPortal(database.UserPortal{
-			DiscordID: thread.ID,
+			DiscordID: threadID,
 			Type:      database.UserPortalTypeThread,
 			Timestamp: time.Now(),
 		})
 	}
 }
+
+// threadStatsInterval is the minimum time between topic updates of thread rooms caused by new activity.
+const threadStatsInterval = 10 * time.Minute
+
+// threadMemberCountCap is where Discord stops counting thread members.
+const threadMemberCountCap = 50
+
+// threadStats describes the activity of a thread, or returns an empty string if Discord didn't include the counts.
+func threadStats(meta *discordgo.Channel) string {
+	if meta.MessageCount == 0 && meta.MemberCount == 0 {
+		return ""
+	}
+	members := pluralize(meta.MemberCount, "member")
+	if meta.MemberCount >= threadMemberCountCap {
+		members = fmt.Sprintf("%d+ members", threadMemberCountCap)
+	}
+	return fmt.Sprintf("Thread activity: %s, %s", pluralize(meta.MessageCount, "message"), members)
+}
+
+// queueThreadStats updates the topic of a thread bridged as its own room from the message loop. Threads don't
+// have topics on Discord, so the topic shows the message and member counts instead.
+func (portal *Portal) queueThreadStats(meta *discordgo.Channel) {
+	stats := threadStats(meta)
+	if stats == "" {
+		return
+	}
+	portal.runInLoop(func() {
+		portal.updateThreadStats(stats)
+	})
+}
+
+// updateThreadStats applies new thread activity counts to the topic. Updates are throttled, as the counts change
+// with every message, but the latest counts are applied once the interval has passed. It must be called from the loop.
+func (portal *Portal) updateThreadStats(stats string) {
+	if portal.Topic == "" || time.Since(portal.threadStatsUpdated) >= threadStatsInterval {
+		portal.applyThreadStats(stats)
+		return
+	}
+	portal.pendingThreadStats = stats
+	if portal.threadStatsTimer == nil {
+		portal.threadStatsTimer = time.AfterFunc(threadStatsInterval-time.Since(portal.threadStatsUpdated), func() {
+			portal.runInLoop(func() {
+				portal.threadStatsTimer = nil
+				if portal.pendingThreadStats != "" {
+					portal.applyThreadStats(portal.pendingThreadStats)
+				}
+			})
+		})
+	}
+}
+
+func (portal *Portal) applyThreadStats(stats string) {
+	portal.threadStatsUpdated = time.Now()
+	portal.pendingThreadStats = ""
+	if portal.UpdateTopic(stats) {
+		portal.Update()
+	}
+}
@@ -0,0 +1,65 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+
+	"go.mau.fi/mautrix-discord/database"
+)
+
+func TestThreadStats(t *testing.T) {
+	assert.Equal(t, "Thread activity: 12 messages, 3 members", threadStats(&discordgo.Channel{MessageCount: 12, MemberCount: 3}))
+	assert.Equal(t, "Thread activity: 1 message, 1 member", threadStats(&discordgo.Channel{MessageCount: 1, MemberCount: 1}))
+	// Discord stops counting members at 50
+	assert.Equal(t, "Thread activity: 300 messages, 50+ members", threadStats(&discordgo.Channel{MessageCount: 300, MemberCount: 50}))
+	// Counts aren't included in every channel object
+	assert.Equal(t, "", threadStats(&discordgo.Channel{}))
+}
+
+func TestCachedForumChannel(t *testing.T) {
+	br := &DiscordBridge{forumChannels: map[string]cachedForumChannel{
+		"forum": {channel: &forumChannel{ID: "forum", Type: ChannelTypeGuildForum}, fetched: time.Now()},
+		"text":  {fetched: time.Now()},
+		"stale": {channel: &forumChannel{ID: "stale", Type: ChannelTypeGuildForum}, fetched: time.Now().Add(-2 * forumChannelCacheTTL)},
+	}}
+	user := &User{bridge: br}
+
+	forum, err := user.getCachedForumChannel("forum")
+	assert.NoError(t, err)
+	assert.NotNil(t, forum)
+	assert.True(t, user.isForumChannel("forum"))
+	assert.False(t, user.isForumChannel("text"))
+	// Stale entries are fetched again, which fails without a connection
+	_, err = user.getCachedForumChannel("stale")
+	assert.ErrorIs(t, err, ErrNotConnected)
+}
+
+func TestThreadStatsAreDeferredWhileThrottled(t *testing.T) {
+	portal := &Portal{Portal: &database.Portal{Topic: "Thread activity: 1 message, 1 member"}, threadStatsUpdated: time.Now()}
+	portal.updateThreadStats("Thread activity: 2 messages, 1 member")
+	portal.updateThreadStats("Thread activity: 3 messages, 2 members")
+	if assert.NotNil(t, portal.threadStatsTimer) {
+		portal.threadStatsTimer.Stop()
+	}
+	assert.Equal(t, "Thread activity: 1 message, 1 member", portal.Topic)
+	assert.Equal(t, "Thread activity: 3 messages, 2 members", portal.pendingThreadStats)
+}
@@ -4,10 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -23,6 +25,7 @@ import (
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 
+	"go.mau.fi/mautrix-discord/config"
 	"go.mau.fi/mautrix-discord/database"
 )
 
@@ -51,6 +54,31 @@ type User struct {
 
 	markedOpened     map[string]time.Time
 	markedOpenedLock sync.Mutex
+
+	memberRequests     map[string]*guildMemberRequest
+	memberRequestsLock sync.Mutex
+
+	gatewayConnected int32
+	reloginPrompted  int32
+	checkingToken    int32
+	sendBuffer       []bufferedMatrixEvent
+	sendBufferLock   sync.Mutex
+	// Whether buffered events are being passed to portals, during which new events are buffered too
+	sendBufferFlushing bool
+
+	calls     map[string]*dmCall
+	callsLock sync.Mutex
+
+	interactions     map[string]chan error
+	interactionsLock sync.Mutex
+
+	friendPresences     map[string]discordgo.Status
+	friendPresencesLock sync.Mutex
+
+	errorLog    userErrorLog
+	sendLimiter sendRateLimiter
+	sendQueue   sendQueue
+	routes      recentRoutes
 }
 
 func (user *User) GetRemoteID() string {
@@ -169,6 +197,21 @@ func (br *DiscordBridge) GetUserByMXID(userID id.UserID) *User {
 	return user
 }
 
+// GetExistingUserByMXID is like GetUserByMXID, but returns nil instead of creating the user if it doesn't exist.
+func (br *DiscordBridge) GetExistingUserByMXID(userID id.UserID) *User {
+	if userID == br.Bot.UserID || br.IsGhost(userID) {
+		return nil
+	}
+	br.usersLock.Lock()
+	defer br.usersLock.Unlock()
+
+	user, ok := br.usersByMXID[userID]
+	if !ok {
+		return br.loadUser(br.DB.User.GetByMXID(userID), nil)
+	}
+	return user
+}
+
 func (br *DiscordBridge) GetUserByID(id string) *User {
 	br.usersLock.Lock()
 	defer br.usersLock.Unlock()
@@ -187,6 +230,10 @@ func (br *DiscordBridge) NewUser(dbUser *database.User) *User {
 		log:    br.Log.Sub("User").Sub(string(dbUser.MXID)),
 
 		markedOpened:    make(map[string]time.Time),
+		memberRequests:  make(map[string]*guildMemberRequest),
+		calls:           make(map[string]*dmCall),
+		interactions:    make(map[string]chan error),
+		friendPresences: make(map[string]discordgo.Status),
 		PermissionLevel: br.Config.Bridge.Permissions.Get(dbUser.MXID),
 	}
 	user.BridgeState = br.NewBridgeStateQueue(user, user.log)
@@ -214,16 +261,17 @@ func (br *DiscordBridge) startUsers() {
 	br.Log.Debugln("Starting users")
 
 	usersWithToken := br.getAllUsersWithToken()
+	var wg sync.WaitGroup
+	wg.Add(len(usersWithToken))
 	for _, u := range usersWithToken {
 		go func(user *User) {
+			defer wg.Done()
 			user.BridgeState.Send(status.BridgeState{StateEvent: status.StateConnecting})
 			err := user.Connect()
 			if err != nil {
 				user.log.Errorfln("Error connecting: %v", err)
-				if closeErr := (&websocket.CloseError{}); errors.As(err, &closeErr) && closeErr.Code == 4004 {
-					user.BridgeState.Send(status.BridgeState{StateEvent: status.StateBadCredentials, Message: err.Error()})
-					user.DiscordToken = ""
-					user.Update()
+				if isInvalidTokenError(err) {
+					user.handleInvalidToken(err)
 				} else {
 					user.BridgeState.Send(status.BridgeState{StateEvent: status.StateUnknownError, Message: err.Error()})
 				}
@@ -244,6 +292,7 @@ func (br *DiscordBridge) startUsers() {
 			}
 		}(customPuppet)
 	}
+	wg.Wait()
 }
 
 func (user *User) SetManagementRoom(roomID id.RoomID) {
@@ -255,6 +304,9 @@ func (user *User) SetManagementRoom(roomID id.RoomID) {
 		existing.ManagementRoom = ""
 		existing.Update()
 	}
+	if user.ManagementRoom != "" && user.bridge.managementRooms[user.ManagementRoom] == user {
+		delete(user.bridge.managementRooms, user.ManagementRoom)
+	}
 
 	user.ManagementRoom = roomID
 	user.bridge.managementRooms[user.ManagementRoom] = user
@@ -470,11 +522,19 @@ func (user *User) Connect() error {
 		session.LogLevel = discordgo.LogDebug
 	}
 
+	if user.Proxy != "" {
+		err = applySessionProxy(session, user.Proxy)
+		if err != nil {
+			return err
+		}
+	}
+
 	user.Session = session
 
 	user.Session.AddHandler(user.readyHandler)
 	user.Session.AddHandler(user.connectedHandler)
 	user.Session.AddHandler(user.disconnectedHandler)
+	user.Session.AddHandler(user.rateLimitHandler)
 
 	user.Session.AddHandler(user.guildCreateHandler)
 	user.Session.AddHandler(user.guildDeleteHandler)
@@ -482,25 +542,62 @@ func (user *User) Connect() error {
 	user.Session.AddHandler(user.guildRoleCreateHandler)
 	user.Session.AddHandler(user.guildRoleUpdateHandler)
 	user.Session.AddHandler(user.guildRoleDeleteHandler)
+	user.Session.AddHandler(user.guildMembersChunkHandler)
 
 	user.Session.AddHandler(user.channelCreateHandler)
 	user.Session.AddHandler(user.channelDeleteHandler)
 	user.Session.AddHandler(user.channelPinsUpdateHandler)
 	user.Session.AddHandler(user.channelUpdateHandler)
 
-	user.Session.AddHandler(user.messageCreateHandler)
 	user.Session.AddHandler(user.messageDeleteHandler)
 	user.Session.AddHandler(user.messageUpdateHandler)
 	user.Session.AddHandler(user.reactionAddHandler)
 	user.Session.AddHandler(user.reactionRemoveHandler)
 	user.Session.AddHandler(user.messageAckHandler)
 	user.Session.AddHandler(user.typingStartHandler)
+	user.Session.AddHandler(user.presenceUpdateHandler)
+	user.Session.AddHandler(user.relationshipAddHandler)
+	user.Session.AddHandler(user.rawEventHandler)
 
 	user.Session.Identify.Presence.Status = "online"
 
 	return user.Session.Open()
 }
 
+// parseProxyURL validates a user-provided proxy URL. Both HTTP(S) and SOCKS5 proxies are supported.
+func parseProxyURL(rawURL string) (*url.URL, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch parsed.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", parsed.Scheme)
+	}
+	if parsed.Host == "" {
+		return nil, fmt.Errorf("proxy URL is missing a host")
+	}
+	return parsed, nil
+}
+
+func applySessionProxy(session *discordgo.Session, rawURL string) error {
+	proxyURL, err := parseProxyURL(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	session.Client = &http.Client{
+		Transport: transport,
+		Timeout:   session.Client.Timeout,
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.Proxy = http.ProxyURL(proxyURL)
+	session.Dialer = &dialer
+	return nil
+}
+
 func (user *User) Disconnect() error {
 	user.Lock()
 	defer user.Unlock()
@@ -525,12 +622,19 @@ func (user *User) bridgeMessage(guildID string) bool {
 
 func (user *User) readyHandler(_ *discordgo.Session, r *discordgo.Ready) {
 	user.log.Debugln("Discord connection ready")
+	atomic.StoreInt32(&user.reloginPrompted, 0)
 
 	if user.DiscordID != r.User.ID {
 		user.DiscordID = r.User.ID
 		user.Update()
 	}
 	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateBackfilling})
+	user.setFriendPresences(r.Presences)
+	if user.ActivityName != "" {
+		if err := user.applyActivity(); err != nil {
+			user.log.Warnln("Failed to restore activity:", err)
+		}
+	}
 
 	updateTS := time.Now()
 	portalsInSpace := make(map[string]bool)
@@ -686,7 +790,7 @@ func (user *User) handleGuild(meta *discordgo.Guild, timestamp time.Time, isInSp
 	if len(meta.Channels) > 0 {
 		for _, ch := range meta.Channels {
 			portal := user.GetPortalByMeta(ch)
-			if (guild.AutoBridgeChannels && channelIsBridgeable(ch)) && portal.MXID == "" {
+			if (guild.AutoBridgeChannels && user.bridge.channelIsBridgeable(ch)) && portal.MXID == "" {
 				err := portal.CreateMatrixRoom(user, ch)
 				if err != nil {
 					user.log.Errorfln("Failed to create portal for guild channel %s/%s in initial sync: %v", guild.ID, ch.ID, err)
@@ -704,6 +808,8 @@ func (user *User) handleGuild(meta *discordgo.Guild, timestamp time.Time, isInSp
 
 func (user *User) connectedHandler(_ *discordgo.Session, c *discordgo.Connect) {
 	user.log.Debugln("Connected to discord")
+	atomic.StoreInt32(&user.gatewayConnected, 1)
+	go user.flushBufferedMatrixEvents()
 
 	user.tryAutomaticDoublePuppeting()
 	// FIXME this check can fail if the previous event didn't get sent before reconnecting
@@ -712,9 +818,12 @@ func (user *User) connectedHandler(_ *discordgo.Session, c *discordgo.Connect) {
 	}
 }
 
-func (user *User) disconnectedHandler(_ *discordgo.Session, d *discordgo.Disconnect) {
+func (user *User) disconnectedHandler(session *discordgo.Session, d *discordgo.Disconnect) {
 	user.log.Debugln("Disconnected from discord")
+	atomic.StoreInt32(&user.gatewayConnected, 0)
+	user.logError("disconnect", "Disconnected from the Discord gateway")
 	user.BridgeState.Send(status.BridgeState{StateEvent: status.StateTransientDisconnect})
+	go user.checkTokenAfterDisconnect(session)
 }
 
 func (user *User) guildCreateHandler(_ *discordgo.Session, g *discordgo.GuildCreate) {
@@ -744,6 +853,8 @@ func (user *User) channelCreateHandler(_ *discordgo.Session, c *discordgo.Channe
 	}
 	if c.GuildID == "" {
 		user.handlePrivateChannel(portal, c.Channel, time.Now(), true, user.IsInSpace(portal.Key.String()))
+	} else if c.Type != discordgo.ChannelTypeGuildCategory && !user.bridge.channelIsBridgeable(c.Channel) {
+		user.log.Debugfln("Not creating room for %s: channel type %d is not bridged", c.ID, c.Type)
 	} else {
 		err := portal.CreateMatrixRoom(user, c.Channel)
 		if err != nil {
@@ -803,8 +914,24 @@ func (user *User) pushPortalMessage(msg interface{}, typeName, channelID, guildI
 	}
 }
 
-func (user *User) messageCreateHandler(_ *discordgo.Session, m *discordgo.MessageCreate) {
-	user.pushPortalMessage(m, "message create", m.ChannelID, m.GuildID)
+// rawEventHandler handles gateway events that need more data than discordgo's typed structs provide.
+func (user *User) rawEventHandler(_ *discordgo.Session, evt *discordgo.Event) {
+	switch evt.Type {
+	case "MESSAGE_CREATE":
+		user.messageCreateHandler(evt)
+	case "GUILD_STICKERS_UPDATE":
+		user.guildStickersUpdateHandler(evt)
+	case "THREAD_UPDATE":
+		user.threadUpdateHandler(evt)
+	case "CALL_CREATE", "CALL_UPDATE", "CALL_DELETE":
+		user.callEventHandler(evt)
+	case "VOICE_STATE_UPDATE":
+		user.callVoiceStateHandler(evt)
+	case "MESSAGE_POLL_VOTE_ADD", "MESSAGE_POLL_VOTE_REMOVE":
+		user.pollVoteHandler(evt)
+	case "INTERACTION_SUCCESS", "INTERACTION_FAILURE":
+		user.interactionResultHandler(evt)
+	}
 }
 
 func (user *User) messageDeleteHandler(_ *discordgo.Session, m *discordgo.MessageDelete) {
@@ -876,7 +1003,7 @@ func (user *User) messageAckHandler(_ *discordgo.Session, m *discordgo.MessageAc
 
 func (user *User) typingStartHandler(_ *discordgo.Session, t *discordgo.TypingStart) {
 	portal := user.GetExistingPortalByID(t.ChannelID)
-	if portal == nil || portal.MXID == "" {
+	if portal == nil || portal.MXID == "" || !portal.typingNotificationsEnabled() {
 		return
 	}
 	puppet := user.bridge.GetPuppetByID(t.UserID)
@@ -1005,67 +1132,136 @@ func (user *User) updateDirectChats(chats map[id.UserID][]id.RoomID) {
 	}
 }
 
-func (user *User) bridgeGuild(guildID string, everything bool) error {
+// bridgeGuild creates the space and category rooms of a guild, and portals for all channels if everything is true.
+// It returns the channels that were skipped because their type isn't enabled in the bridge.channel_types config.
+func (user *User) bridgeGuild(guildID string, everything bool) ([]*discordgo.Channel, error) {
 	guild := user.bridge.GetGuildByID(guildID, false)
 	if guild == nil {
-		return errors.New("guild not found")
+		return nil, errors.New("guild not found")
 	}
 	guild.AutoBridgeChannels = everything
 	meta, _ := user.Session.State.Guild(guildID)
 	err := guild.CreateMatrixRoom(user, meta)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	user.addGuildToSpace(guild, false, time.Now())
+	var skipped []*discordgo.Channel
 	for _, ch := range meta.Channels {
-		portal := user.GetPortalByMeta(ch)
-		if (everything && channelIsBridgeable(ch)) || ch.Type == discordgo.ChannelTypeGuildCategory {
+		bridgeable := user.bridge.channelIsBridgeable(ch)
+		if everything && !bridgeable && config.IsConfigurableChannelType(ch.Type) {
+			skipped = append(skipped, ch)
+		}
+		if (everything && bridgeable) || ch.Type == discordgo.ChannelTypeGuildCategory {
+			portal := user.GetPortalByMeta(ch)
 			err = portal.CreateMatrixRoom(user, ch)
 			if err != nil {
 				user.log.Warnfln("Error creating room for guild channel %s: %v", ch.ID, err)
 			}
 		}
 	}
+	go func() {
+		count, err := user.syncGuildStickers(guild)
+		if err != nil {
+			user.log.Warnfln("Failed to sync stickers of guild %s: %v", guild.ID, err)
+		} else {
+			user.log.Debugfln("Synced %d stickers of guild %s", count, guild.ID)
+		}
+	}()
+	if user.bridge.Config.Bridge.SyncGuildMembers {
+		go func() {
+			err := user.syncGuildMembers(guild)
+			if err != nil {
+				user.log.Warnfln("Failed to sync members of guild %s: %v", guild.ID, err)
+			}
+		}()
+	}
 
-	return nil
+	return skipped, nil
+}
+
+// unbridgeGuild removes the bridge between a guild and its Matrix rooms. If keepRooms is true,
+// the rooms are only disconnected and kept for their history, otherwise they're cleaned up.
+// It returns the number of channel rooms that were disconnected or deleted.
+// hasGuildPermission checks whether the user has a permission in a guild through their roles.
+// Channel permission overwrites aren't taken into account.
+func (user *User) hasGuildPermission(guildID string, permission int64) (bool, error) {
+	session := user.Session
+	if session == nil {
+		return false, ErrNotConnected
+	}
+	guild, err := session.State.Guild(guildID)
+	if err != nil {
+		if guild, err = session.Guild(guildID); err != nil {
+			return false, err
+		}
+	}
+	if guild.OwnerID == user.DiscordID {
+		return true, nil
+	}
+	member, err := session.State.Member(guildID, user.DiscordID)
+	if err != nil {
+		if member, err = session.GuildMember(guildID, user.DiscordID); err != nil {
+			return false, err
+		}
+	}
+	var perms int64
+	for _, role := range guild.Roles {
+		// The @everyone role has the same ID as the guild
+		if role.ID == guildID {
+			perms |= role.Permissions
+			continue
+		}
+		for _, roleID := range member.Roles {
+			if role.ID == roleID {
+				perms |= role.Permissions
+				break
+			}
+		}
+	}
+	return perms&discordgo.PermissionAdministrator != 0 || perms&permission == permission, nil
 }
 
-func (user *User) unbridgeGuild(guildID string) error {
-	//user.guildsLock.Lock()
-	//defer user.guildsLock.Unlock()
-	//
-	//guild, exists := user.guilds[guildID]
-	//if !exists {
-	//	return fmt.Errorf("guildID not found")
-	//}
-	//
-	//if !guild.Bridge {
-	//	return fmt.Errorf("guild not bridged")
-	//}
-	//
-	//// First update the guild so we don't have any other go routines recreating
-	//// channels we're about to destroy.
-	//guild.Bridge = false
-	//guild.Upsert()
-	//
-	//// Now run through the channels in the guild and remove any portals we
-	//// have for them.
-	//channels, err := user.Session.GuildChannels(guildID)
-	//if err != nil {
-	//	return err
-	//}
-	//
-	//for _, channel := range channels {
-	//	if channelIsBridgeable(channel) {
-	//		key := database.PortalKey{
-	//			ChannelID: channel.ID,
-	//			Receiver:  user.DiscordID,
-	//		}
-	//
-	//		portal := user.bridge.GetPortalByID(key)
-	//		portal.leave(user)
-	//	}
-	//}
-
-	return errors.New("unbridging is not currently supported")
+func (user *User) unbridgeGuild(guildID string, keepRooms bool) (int, error) {
+	guild := user.bridge.GetGuildByID(guildID, false)
+	if guild == nil || guild.MXID == "" {
+		return 0, errors.New("guild not bridged")
+	}
+	// Turn off auto-bridging first so that incoming events don't recreate the rooms
+	guild.AutoBridgeChannels = false
+	guild.Update()
+
+	var count int
+	var deleted []*Portal
+	for _, portal := range user.bridge.GetAllPortalsInGuild(guildID) {
+		if portal.MXID == "" {
+			portal.Delete()
+			continue
+		}
+		count++
+		if keepRooms {
+			portal.archive()
+		} else {
+			portal.Delete()
+			deleted = append(deleted, portal)
+		}
+	}
+
+	spaceID := guild.MXID
+	if keepRooms {
+		guild.archive()
+	} else {
+		_, err := user.bridge.Bot.SendStateEvent(user.GetSpaceRoom(), event.StateSpaceChild, spaceID.String(), struct{}{})
+		if err != nil {
+			user.log.Warnfln("Failed to remove guild space %s from user space: %v", spaceID, err)
+		}
+		guild.RemoveMXID()
+		go func() {
+			for _, portal := range deleted {
+				portal.cleanup(false)
+			}
+			guild.cleanup(spaceID)
+		}()
+	}
+	return count, nil
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"maunium.net/go/mautrix/bridge/commands"
+)
+
+// userErrorLogSize is how many errors are remembered per user. The log is only kept in memory.
+const userErrorLogSize = 50
+
+type userError struct {
+	Timestamp time.Time
+	Kind      string
+	Message   string
+}
+
+// userErrorLog is a ring buffer of the most recent errors the bridge ran into for a user.
+type userErrorLog struct {
+	lock    sync.Mutex
+	entries [userErrorLogSize]userError
+	next    int
+	count   int
+}
+
+func (el *userErrorLog) add(kind, message string) {
+	el.lock.Lock()
+	defer el.lock.Unlock()
+	el.entries[el.next] = userError{Timestamp: time.Now(), Kind: kind, Message: message}
+	el.next = (el.next + 1) % userErrorLogSize
+	if el.count < userErrorLogSize {
+		el.count++
+	}
+}
+
+// recent returns up to limit errors, newest first.
+func (el *userErrorLog) recent(limit int) []userError {
+	el.lock.Lock()
+	defer el.lock.Unlock()
+	if limit > el.count {
+		limit = el.count
+	}
+	errs := make([]userError, limit)
+	for i := range errs {
+		errs[i] = el.entries[(el.next-1-i+userErrorLogSize)%userErrorLogSize]
+	}
+	return errs
+}
+
+var (
+	urlQueryRegex    = regexp.MustCompile(`(https?://[^\s?"]+)\?[^\s"]*`)
+	webhookPathRegex = regexp.MustCompile(`(/webhooks/\d+/)[\w-]+`)
+)
+
+// redactErrorMessage removes things that shouldn't be shown to users from error messages, like tokens and
+// the signatures in CDN URLs. Errors are shown in Matrix rooms, so they may be copied around when asking for help.
+func (user *User) redactErrorMessage(message string) string {
+	if user.DiscordToken != "" {
+		message = strings.ReplaceAll(message, user.DiscordToken, "<token>")
+	}
+	message = urlQueryRegex.ReplaceAllString(message, "$1?<redacted>")
+	return webhookPathRegex.ReplaceAllString(message, "$1<token>")
+}
+
+func (user *User) logError(kind, message string) {
+	user.errorLog.add(kind, user.redactErrorMessage(message))
+}
+
+func (user *User) rateLimitHandler(_ *discordgo.Session, rl *discordgo.RateLimit) {
+	user.logError("rate limit", fmt.Sprintf("Rate limited by Discord on %s for %s", rl.URL, rl.RetryAfter))
+	if bucketKey, ok := rateLimitBucketKey(rl.URL); ok {
+		user.trackRoute(bucketKey)
+	}
+}
+
+var cmdErrors = &commands.FullHandler{
+	Func: wrapCommand(fnErrors),
+	Name: "errors",
+	Help: commands.HelpMeta{
+		Section:     commands.HelpSectionUnclassified,
+		Description: "List the recent errors the bridge ran into for you, like failed sends, disconnects and rate limits",
+		Args:        "[_limit_]",
+	},
+}
+
+func fnErrors(ce *WrappedCommandEvent) {
+	limit := 10
+	if len(ce.Args) > 0 {
+		var err error
+		limit, err = strconv.Atoi(ce.Args[0])
+		if err != nil || limit <= 0 {
+			ce.Reply("**Usage**: `$cmdprefix errors [limit]`")
+			return
+		} else if limit > userErrorLogSize {
+			limit = userErrorLogSize
+		}
+	}
+	errs := ce.User.errorLog.recent(limit)
+	if len(errs) == 0 {
+		ce.Reply("No errors since the bridge was started")
+		return
+	}
+	var output strings.Builder
+	for _, userErr := range errs {
+		message := strings.ReplaceAll(userErr.Message, "\n", " ")
+		if runes := []rune(message); len(runes) > 300 {
+			message = string(runes[:300]) + "…"
+		}
+		_, _ = fmt.Fprintf(&output, "* %s (%s): %s\n", userErr.Timestamp.UTC().Format(time.RFC3339), userErr.Kind, message)
+	}
+	ce.Reply("Recent errors (undelivered messages are also listed by `$cmdprefix dead-letters`):\n\n%s", output.String())
+}
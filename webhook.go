@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// isWebhookIdentityMessage checks whether the message was sent by a webhook with a per-message username and avatar.
+// Interaction responses also have a webhook ID, but they're authored by the application's bot user.
+func isWebhookIdentityMessage(msg *discordgo.Message) bool {
+	return msg.WebhookID != "" && msg.Author != nil && msg.Author.ID == msg.WebhookID && msg.Interaction == nil
+}
+
+// webhookIdentityPuppetIDPattern matches the IDs made by webhookIdentityPuppetID. It's a part of the pattern
+// used to parse puppet user IDs, so a group mustn't be added here.
+const webhookIdentityPuppetIDPattern = `[0-9]+_[0-9a-f]{8}`
+
+var webhookIdentityPuppetIDRegex = regexp.MustCompile("^" + webhookIdentityPuppetIDPattern + "$")
+
+func isWebhookIdentityPuppetID(puppetID string) bool {
+	return webhookIdentityPuppetIDRegex.MatchString(puppetID)
+}
+
+// webhookIdentityPuppetID makes the ID of the puppet used for a webhook when it sends messages as the given username.
+func webhookIdentityPuppetID(webhookID, username string) string {
+	hash := sha256.Sum256([]byte(username))
+	return fmt.Sprintf("%s_%x", webhookID, hash[:4])
+}
+
+// getWebhookIdentityPuppet finds or creates the puppet for the username a webhook message was sent as.
+func (br *DiscordBridge) getWebhookIdentityPuppet(msg *discordgo.Message) *Puppet {
+	puppetID := br.DB.WebhookIdentity.GetPuppetID(msg.WebhookID, msg.Author.Username)
+	if puppetID == "" {
+		puppetID = webhookIdentityPuppetID(msg.WebhookID, msg.Author.Username)
+		br.DB.WebhookIdentity.Insert(msg.WebhookID, msg.Author.Username, puppetID)
+	}
+	return br.GetPuppetByID(puppetID)
+}
+
+// getMessageAuthorPuppet returns the puppet that should send the given message to Matrix and syncs its profile.
+// Webhook messages carry the profile in the message itself, so the avatar is updated whenever a message has a new one.
+func (portal *Portal) getMessageAuthorPuppet(source *User, msg *discordgo.Message) *Puppet {
+	if !portal.bridge.Config.Bridge.WebhookIdentities || !isWebhookIdentityMessage(msg) {
+		puppet := portal.bridge.GetPuppetByID(msg.Author.ID)
+		puppet.UpdateInfo(source, msg.Author)
+		return puppet
+	}
+	puppet := portal.bridge.getWebhookIdentityPuppet(msg)
+	info := *msg.Author
+	if info.Discriminator == "" {
+		info.Discriminator = "0000"
+	}
+	puppet.UpdateInfo(source, &info)
+	return puppet
+}
+
+// getMessageAuthor is like getMessageAuthorPuppet, but doesn't update the profile of the puppet.
+func (portal *Portal) getMessageAuthor(msg *discordgo.Message) *Puppet {
+	if portal.bridge.Config.Bridge.WebhookIdentities && isWebhookIdentityMessage(msg) {
+		return portal.bridge.getWebhookIdentityPuppet(msg)
+	}
+	return portal.bridge.GetPuppetByID(msg.Author.ID)
+}
@@ -0,0 +1,55 @@
+// mautrix-discord - A Matrix-Discord puppeting bridge.
+// Copyright (C) 2022 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+
+	"go.mau.fi/mautrix-discord/config"
+)
+
+func TestWebhookIdentityPuppetMXIDRoundTrip(t *testing.T) {
+	var cfg config.Config
+	err := yaml.Unmarshal([]byte(`
+homeserver:
+  domain: example.com
+bridge:
+  username_template: discord_{{.}}
+  displayname_template: '{{.Username}}'
+`), &cfg)
+	if !assert.NoError(t, err) {
+		return
+	}
+	br := &DiscordBridge{Config: &cfg}
+
+	puppetID := webhookIdentityPuppetID("1234567890", "Some Bot")
+	assert.True(t, isWebhookIdentityPuppetID(puppetID))
+	parsed, ok := br.ParsePuppetMXID(br.FormatPuppetMXID(puppetID))
+	assert.True(t, ok)
+	assert.Equal(t, puppetID, parsed)
+
+	parsed, ok = br.ParsePuppetMXID(br.FormatPuppetMXID("1234567890"))
+	assert.True(t, ok)
+	assert.Equal(t, "1234567890", parsed)
+	assert.False(t, isWebhookIdentityPuppetID(parsed))
+
+	_, ok = br.ParsePuppetMXID("@discord_1234567890_nothex:example.com")
+	assert.False(t, ok)
+}